@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/logging"
+	"time"
+)
+
+// auditCmd represents the Audit command
+var auditCmd = &cobra.Command{
+	Use:   "audit",
+	Short: "Inspect the audit logs of validation requests and changes made by operators",
+	Long:  ``,
+}
+
+// auditQueryCmd represents the Query Audit Log command
+var auditQueryCmd = &cobra.Command{
+	Use:   "query",
+	Short: "Show the validation requests matching the filters",
+	Long: `Show the validation requests recorded in the auth_log table, the latest
+first, filtered by YubiKey public name, client id, response status and time
+range. Times are given as 2006-01-02, 2006-01-02 15:04:05 or RFC 3339, in
+local time unless a zone is given. Each line has the time, client id, public
+name, status, session and use counters, source IP address and sync level.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if auditSince != "" {
+			if auditFilter.Since, err = parseTime(auditSince); err != nil {
+				return err
+			}
+		}
+		if auditUntil != "" {
+			if auditFilter.Until, err = parseTime(auditUntil); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		queryAuditLog()
+	},
+}
+
+// auditAdminCmd represents the Admin Log command
+var auditAdminCmd = &cobra.Command{
+	Use:   "admin",
+	Short: "Show the changes made by operators",
+	Long: `Show the changes made by operators with the management commands, recorded in 
+the admin_log table, the latest first. Each line has the time, operator, 
+action, target and details of the change.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		queryAdminLog()
+	},
+}
+
+var (
+	adminTarget string
+	adminLimit  int
+)
+
+var (
+	auditFilter database.AuthLogFilter
+	auditSince  string
+	auditUntil  string
+)
+
+func init() {
+	auditQueryCmd.Flags().StringVar(&auditFilter.PublicName, "public-name", "", "only show requests with this YubiKey")
+	auditQueryCmd.Flags().Int32Var(&auditFilter.ClientId, "client-id", 0, "only show requests of this client")
+	auditQueryCmd.Flags().StringVar(&auditFilter.Status, "status", "", "only show requests answered with this status, e.g. OK or REPLAYED_OTP")
+	auditQueryCmd.Flags().StringVar(&auditSince, "since", "", "only show requests at or after this time")
+	auditQueryCmd.Flags().StringVar(&auditUntil, "until", "", "only show requests before this time")
+	auditQueryCmd.Flags().IntVar(&auditFilter.Limit, "limit", 100, "set the maximum number of requests shown, 0 shows all")
+	auditCmd.AddCommand(auditQueryCmd)
+	auditAdminCmd.Flags().StringVar(&adminTarget, "target", "", "only show changes of this YubiKey public name or client id")
+	auditAdminCmd.Flags().IntVar(&adminLimit, "limit", 100, "set the maximum number of changes shown, 0 shows all")
+	auditCmd.AddCommand(auditAdminCmd)
+	rootCmd.AddCommand(auditCmd)
+}
+
+func queryAuditLog() {
+	logging.Setup("audit-query")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	entries, err := database.Store.GetAuthLogs(auditFilter)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s\t%d\t%s\t%s\tsession_counter=%d use_counter=%d\t%s\tsl=%d\n",
+			time.Unix(int64(e.LoggedAt), 0).Format("2006-01-02 15:04:05"),
+			e.ClientId, e.PublicName, e.Status, e.SessionCounter, e.UseCounter, e.SourceIp, e.SyncLevel)
+	}
+}
+
+func queryAdminLog() {
+	logging.Setup("audit-admin")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	entries, err := database.Store.GetAdminLogs(adminTarget, adminLimit)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	for _, e := range entries {
+		fmt.Printf("%s\t%s\t%s\t%s\t%s\n",
+			time.Unix(int64(e.LoggedAt), 0).Format("2006-01-02 15:04:05"),
+			e.Operator, e.Action, e.Target, e.Details)
+	}
+}
+
+// parseTime parses a time given on the command line as a unix timestamp.
+func parseTime(value string) (int32, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return int32(t.Unix()), nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return int32(t.Unix()), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid time %s, expected 2006-01-02, 2006-01-02 15:04:05 or RFC 3339\n", value)
+}
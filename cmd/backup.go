@@ -0,0 +1,289 @@
+package cmd
+
+import (
+	"filippo.io/age"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/backup"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/logging"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// backupCmd represents the Backup command
+var backupCmd = &cobra.Command{
+	Use:   "backup",
+	Short: "Create and restore encrypted backups of the yubikey-val database",
+	Long: `Create and restore encrypted backups containing the organizations, clients,
+YubiKeys with their secrets, the sync queue and the schema version. Backups are
+age files, encrypted either with a passphrase or to age X25519 recipients, so
+they can also be decrypted with the age tool. YubiKey secrets are backed up as
+stored: the master key (or the PKCS#11 token) is needed to use them after a
+restore and has to be kept safe separately.`,
+}
+
+// backupCreateCmd represents the Create Backup command
+var backupCreateCmd = &cobra.Command{
+	Use:   "create <file>",
+	Short: "Write an encrypted backup of the database to a new file",
+	Long: `Write an encrypted backup of the database to a new file, read in a single
+transaction. The backup is encrypted with the passphrase read from
+--passphrase-file or the YKVAL_BACKUP_PASSPHRASE environment variable, or to the
+age public keys (age1...) given with --recipient.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if len(backupRecipients) > 0 && backupPassphraseFile != "" {
+			return fmt.Errorf("a backup is encrypted either with a passphrase or to recipients\n")
+		}
+		if len(backupRecipients) == 0 && !hasBackupPassphrase() {
+			return fmt.Errorf("a passphrase or at least one --recipient should be set\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		createBackup(args[0])
+	},
+}
+
+// backupRestoreCmd represents the Restore Backup command
+var backupRestoreCmd = &cobra.Command{
+	Use:   "restore <file>",
+	Short: "Restore the database from an encrypted backup",
+	Long: `Decrypt a backup with the passphrase read from --passphrase-file or the
+YKVAL_BACKUP_PASSPHRASE environment variable, or with the age identities in the
+file given with --identity. The whole backup is authenticated and checked before
+anything is written, its schema version has to match the database (see
+` + "`go-ykval migrate`" + `). The organizations, clients, YubiKeys and queue are then
+replaced in a single transaction, the logs and the YubiKey history are kept. A
+database which already contains clients or YubiKeys is only replaced with --force.
+Counters are never lowered: YubiKeys used since the backup was created keep their
+stored counters, so their OTPs can not be replayed.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if backupIdentityFile != "" && backupPassphraseFile != "" {
+			return fmt.Errorf("a backup is decrypted either with a passphrase or with an identity\n")
+		}
+		if backupIdentityFile == "" && !hasBackupPassphrase() {
+			return fmt.Errorf("a passphrase or --identity should be set\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		restoreBackup(args[0])
+	},
+}
+
+var (
+	backupPassphraseFile string
+	backupRecipients     []string
+	backupIdentityFile   string
+	backupForce          bool
+)
+
+func init() {
+	backupCmd.PersistentFlags().StringVar(&backupPassphraseFile, "passphrase-file", "", "read the passphrase from this file")
+	backupCreateCmd.Flags().StringArrayVar(&backupRecipients, "recipient", nil, "encrypt to this age public key, can be repeated")
+	backupRestoreCmd.Flags().StringVar(&backupIdentityFile, "identity", "", "decrypt with the age identities in this file")
+	backupRestoreCmd.Flags().BoolVar(&backupForce, "force", false, "replace a database which already contains clients or YubiKeys")
+	backupCmd.AddCommand(backupCreateCmd)
+	backupCmd.AddCommand(backupRestoreCmd)
+	rootCmd.AddCommand(backupCmd)
+}
+
+func createBackup(file string) {
+	logging.Setup("backup-create")
+	defer logging.File.Close()
+
+	var recipients []age.Recipient
+	if len(backupRecipients) > 0 {
+		for _, r := range backupRecipients {
+			recipient, err := age.ParseX25519Recipient(r)
+			if err != nil {
+				log.Error(err)
+				fmt.Println(err)
+				return
+			}
+			recipients = append(recipients, recipient)
+		}
+	} else {
+		passphrase, err := backupPassphrase()
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		recipient, err := age.NewScryptRecipient(passphrase)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	database.Setup()
+	defer database.Close()
+
+	version, err := database.Store.SchemaVersion()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	snapshot, err := database.Store.GetSnapshot()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	err = backup.Write(out, backup.NewArchive(snapshot, version, int32(time.Now().Unix())), recipients...)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file)
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	log.Infof("Created backup %s: %d organizations, %d clients, %d YubiKeys, %d queued changes",
+		file, len(snapshot.Organizations), len(snapshot.Clients), len(snapshot.YubiKeys), len(snapshot.Queue))
+	fmt.Printf("Created backup %s: %d organizations, %d clients, %d YubiKeys, %d queued changes\n",
+		file, len(snapshot.Organizations), len(snapshot.Clients), len(snapshot.YubiKeys), len(snapshot.Queue))
+}
+
+func restoreBackup(file string) {
+	logging.Setup("backup-restore")
+	defer logging.File.Close()
+
+	var identities []age.Identity
+	if backupIdentityFile != "" {
+		in, err := os.Open(backupIdentityFile)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		identities, err = age.ParseIdentities(in)
+		_ = in.Close()
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+	} else {
+		passphrase, err := backupPassphrase()
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		identity, err := age.NewScryptIdentity(passphrase)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		identities = append(identities, identity)
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	archive, err := backup.Read(in, identities...)
+	_ = in.Close()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		fmt.Println("Nothing has been restored")
+		return
+	}
+
+	database.Setup()
+	defer database.Close()
+
+	version, err := database.Store.SchemaVersion()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if version != archive.SchemaVersion {
+		log.Errorf("The backup has schema version %d, the database has version %d", archive.SchemaVersion, version)
+		fmt.Printf("The backup has schema version %d, the database has version %d, migrate the database to version %d first\n",
+			archive.SchemaVersion, version, archive.SchemaVersion)
+		return
+	}
+
+	if !backupForce {
+		current, err := database.Store.GetSnapshot()
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		if len(current.Clients) > 0 || len(current.YubiKeys) > 0 {
+			log.Error("The database already contains clients or YubiKeys, nothing has been restored")
+			fmt.Println("The database already contains clients or YubiKeys, use --force to replace them")
+			return
+		}
+	}
+
+	snapshot := archive.Snapshot()
+	kept, err := database.Store.Restore(snapshot)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		fmt.Println("Nothing has been restored")
+		return
+	}
+
+	createdAt := time.Unix(int64(archive.CreatedAt), 0).Format("2006-01-02 15:04:05")
+	log.Infof("Restored backup %s created at %s: %d organizations, %d clients, %d YubiKeys, %d queued changes",
+		file, createdAt, len(snapshot.Organizations), len(snapshot.Clients), len(snapshot.YubiKeys), len(snapshot.Queue))
+	fmt.Printf("Restored backup %s created at %s: %d organizations, %d clients, %d YubiKeys, %d queued changes\n",
+		file, createdAt, len(snapshot.Organizations), len(snapshot.Clients), len(snapshot.YubiKeys), len(snapshot.Queue))
+	if kept > 0 {
+		log.Infof("Kept the higher counters of %d YubiKeys used since the backup was created", kept)
+		fmt.Printf("Kept the higher counters of %d YubiKeys used since the backup was created\n", kept)
+	}
+}
+
+func hasBackupPassphrase() bool {
+	return backupPassphraseFile != "" || os.Getenv("YKVAL_BACKUP_PASSPHRASE") != ""
+}
+
+// backupPassphrase reads the passphrase from the environment variable, or from the file without its line break.
+func backupPassphrase() (string, error) {
+	passphrase := os.Getenv("YKVAL_BACKUP_PASSPHRASE")
+	if backupPassphraseFile != "" {
+		content, err := ioutil.ReadFile(backupPassphraseFile)
+		if err != nil {
+			return "", err
+		}
+		passphrase = strings.TrimRight(string(content), "\r\n")
+	}
+	if passphrase == "" {
+		return "", fmt.Errorf("the passphrase is empty")
+	}
+	return passphrase, nil
+}
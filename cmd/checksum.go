@@ -6,8 +6,12 @@ import (
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/config"
 	"go-yubikey-val/internal/database"
 	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/merkle"
+	"go-yubikey-val/internal/services/state"
+	"strings"
 )
 
 // checksumCmd represents the Checksum command
@@ -17,7 +21,7 @@ var checksumCmd = &cobra.Command{
 	Long: `Calculate a checksum of the state of all deactivated YubiKey Info or 
 Client Info data in the yubikey-val server database. This checksum can be used 
 to easily compare the state of disabled YubiKeys in two yubikey-val servers 
-in the same sync pool.`,
+in the same sync pool, ` + "`go-ykval checksum compare`" + ` lists which rows differ.`,
 }
 
 // checksumDeactivatedKeysCmd represents the Checksum Deactivated YubiKeys command (originally ykval-checksum-deactivated)
@@ -45,14 +49,52 @@ sync pool`,
 	},
 }
 
+// checksumCompareCmd represents the Compare State command
+var checksumCompareCmd = &cobra.Command{
+	Use:   "compare <peer-url>",
+	Short: "Compare the YubiKeys and clients with another yubikey-val server",
+	Long: `Compare the state of all YubiKeys and clients in the yubikey-val server 
+database with another server of the same sync pool, given by its base URL 
+(e.g. https://192.168.1.2:8080). Both servers build hash trees of their rows, 
+only the branches which differ are requested from the peer, and every public 
+name or client id which differs is listed with how it differs, from the local 
+to the peer's value. The requests and answers are authenticated with the 
+stateKey of the sync configuration, which has to be the same on both servers, 
+and the peer has to be serving. Secrets are never sent: the YubiKey secrets 
+are only compared by whether they are set, the client secrets by a keyed 
+fingerprint.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if !strings.HasPrefix(args[0], "http://") && !strings.HasPrefix(args[0], "https://") {
+			return fmt.Errorf("the peer url should start with http:// or https://\n")
+		}
+		if compareTable != "" && compareTable != state.TABLE_YUBIKEYS && compareTable != state.TABLE_CLIENTS {
+			return fmt.Errorf("table should be one of yubikeys or clients\n")
+		}
+		if orgName != "" {
+			return fmt.Errorf("the state is always compared for all organizations\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		compareState(args[0])
+	},
+}
+
 var (
-	verbose bool
+	verbose      bool
+	compareTable string
 )
 
 func init() {
 	checksumCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "make the operation more talkative")
+	checksumCmd.PersistentFlags().StringVar(&orgName, "org", "", "only include the data of this organization")
 	checksumCmd.AddCommand(checksumDeactivatedKeysCmd)
+	checksumCompareCmd.Flags().StringVar(&compareTable, "table", "", "only compare this table: yubikeys or clients")
 	checksumCmd.AddCommand(checksumClientsCmd)
+	checksumCmd.AddCommand(checksumCompareCmd)
 	rootCmd.AddCommand(checksumCmd)
 }
 
@@ -61,9 +103,16 @@ func checksumDeactivatedKeys() {
 	defer logging.File.Close()
 
 	database.Setup()
-	defer database.DB.Close()
+	defer database.Close()
+
+	orgId, err := organizationFilter()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
 
-	rows, err := database.DB.Queryx(`SELECT public_name, session_counter, use_counter FROM yubikeys WHERE active=FALSE ORDER BY public_name`)
+	keys, err := database.Store.GetDeactivatedYubiKeys(orgId)
 	if err != nil {
 		log.Error(err)
 		fmt.Println(err)
@@ -71,14 +120,7 @@ func checksumDeactivatedKeys() {
 	}
 
 	var everything string
-	for rows.Next() {
-		var key database.YubiKey
-		err := rows.StructScan(&key)
-		if err != nil {
-			log.Error(err)
-			fmt.Println(err)
-			return
-		}
+	for _, key := range keys {
 		everything += fmt.Sprintf("%s\t%d\t%d\n",
 			key.PublicName, key.SessionCounter, key.UseCounter)
 	}
@@ -99,9 +141,16 @@ func checksumClients() {
 	defer logging.File.Close()
 
 	database.Setup()
-	defer database.DB.Close()
+	defer database.Close()
+
+	orgId, err := organizationFilter()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
 
-	rows, err := database.DB.Queryx(`SELECT id, active, secret FROM clients ORDER BY id`)
+	clients, err := database.Store.GetClients(orgId)
 	if err != nil {
 		log.Error(err)
 		fmt.Println(err)
@@ -109,14 +158,7 @@ func checksumClients() {
 	}
 
 	var everything string
-	for rows.Next() {
-		var client database.Client
-		err := rows.StructScan(&client)
-		if err != nil {
-			log.Error(err)
-			fmt.Println(err)
-			return
-		}
+	for _, client := range clients {
 		var active int32
 		if client.Active {
 			active = 1
@@ -135,3 +177,58 @@ func checksumClients() {
 
 	fmt.Println(hash[0:10])
 }
+
+func compareState(peerUrl string) {
+	logging.Setup("checksum-compare")
+	defer logging.File.Close()
+
+	if config.Sync.StateKey == "" {
+		log.Error("No state key configured")
+		fmt.Println("The stateKey of the sync configuration should be set, the same as on the peer")
+		return
+	}
+
+	database.Setup()
+	defer database.Close()
+
+	tables := []string{state.TABLE_YUBIKEYS, state.TABLE_CLIENTS}
+	if compareTable != "" {
+		tables = []string{compareTable}
+	}
+	for _, table := range tables {
+		tree, err := state.LoadTree(table)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		differences, err := merkle.Compare(tree, state.Fetch(peerUrl, table))
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			fmt.Printf("Failed to compare %s with %s\n", table, peerUrl)
+			return
+		}
+
+		for _, difference := range differences {
+			var line string
+			switch {
+			case difference.Peer == nil:
+				line = "- " + difference.Key + ": only on this server"
+			case difference.Local == nil:
+				line = "+ " + difference.Key + ": only on the peer"
+			default:
+				line = "~ " + difference.Key + ": " + strings.Join(difference.Changes(), ", ")
+			}
+			fmt.Println(line)
+			log.Info("Differs from ", peerUrl, ": ", line)
+		}
+		if len(differences) == 0 {
+			log.Infof("The %s are identical on %s", table, peerUrl)
+			fmt.Printf("The %s are identical on %s (%s)\n", table, peerUrl, tree.Root()[0:10])
+		} else {
+			log.Infof("%d %s differ from %s", len(differences), table, peerUrl)
+			fmt.Printf("%d %s differ from %s\n", len(differences), table, peerUrl)
+		}
+	}
+}
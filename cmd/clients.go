@@ -0,0 +1,516 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/logging"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// clientsCmd represents the Clients command
+var clientsCmd = &cobra.Command{
+	Use:   "clients",
+	Short: "Manage the clients (API consumers) of the validation server",
+	Long: `Manage the clients sending validation requests, without their secrets being
+shown. New clients are created with the ` + "`go-ykval gen clients` command" + `.
+Changes are recorded in the admin log.`,
+}
+
+// clientsListCmd represents the List Clients command
+var clientsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the clients",
+	Long:  `List the clients with their state, organization, creation time, e-mail, notes and otp.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if listActive && listInactive {
+			return fmt.Errorf("only one of --active or --inactive should be set\n")
+		}
+		if outputFormat != "table" && outputFormat != "json" {
+			return fmt.Errorf("output should be one of table or json\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		listClients()
+	},
+}
+
+// clientsShowCmd represents the Show Client command
+var clientsShowCmd = &cobra.Command{
+	Use:   "show <id>",
+	Short: "Show a client",
+	Long: `Show everything about a client but its secret, and the changes made to it
+with the clients commands.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := clientIdArg(args); err != nil {
+			return err
+		}
+		if outputFormat != "table" && outputFormat != "json" {
+			return fmt.Errorf("output should be one of table or json\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		showClient(argClientId)
+	},
+}
+
+// clientsEnableCmd represents the Enable Client command
+var clientsEnableCmd = &cobra.Command{
+	Use:   "enable <id>",
+	Short: "Enable a disabled client",
+	Long:  ``,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := clientIdArg(args); err != nil {
+			return err
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		toggleClient(argClientId, true)
+	},
+}
+
+// clientsDisableCmd represents the Disable Client command
+var clientsDisableCmd = &cobra.Command{
+	Use:   "disable <id>",
+	Short: "Disable a client",
+	Long: `Disable a client, its validation requests are answered with NO_SUCH_CLIENT
+until it is enabled again.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := clientIdArg(args); err != nil {
+			return err
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		toggleClient(argClientId, false)
+	},
+}
+
+// clientsRotateSecretCmd represents the Rotate Client Secret command
+var clientsRotateSecretCmd = &cobra.Command{
+	Use:   "rotate-secret <id>",
+	Short: "Generate a new API key for a client",
+	Long: `Generate a new API key for a client and print it base64 encoded. It is only
+printed this once. The old API key is still accepted during the grace period
+set with --grace, so the instances of the client can be updated one by one,
+the responses are signed with the API key the request was signed with. Check
+with ` + "`go-ykval clients secret-usage`" + ` which instances still use the old one.
+With --grace 0 the old API key is rejected right away.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := clientIdArg(args); err != nil {
+			return err
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		rotateClientSecret(argClientId)
+	},
+}
+
+// clientsSecretUsageCmd represents the Client Secret Usage command
+var clientsSecretUsageCmd = &cobra.Command{
+	Use:   "secret-usage",
+	Short: "Report which API key each client is signing its requests with",
+	Long: `Report for each client how many validation requests since --since (the last
+7 days by default) were signed with its current API key, with its previous
+API key, or not signed at all, and when the last of them was made. Clients
+still in the grace period of a rotated API key are marked with its expiry.
+The report is made from the audit log, so it needs audit.enabled.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		var err error
+		if usageSince != "" {
+			if usageSinceTime, err = parseTime(usageSince); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		reportSecretUsage()
+	},
+}
+
+// clientsSetCmd represents the Set Client Fields command
+var clientsSetCmd = &cobra.Command{
+	Use:   "set <id>",
+	Short: "Set the e-mail or notes field of a client",
+	Long:  `Set the fields of a client given with --email and --notes, the others are kept.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if err := clientIdArg(args); err != nil {
+			return err
+		}
+		if !cmd.Flags().Changed("email") && !cmd.Flags().Changed("notes") {
+			return fmt.Errorf("at least one of --email or --notes should be set\n")
+		}
+		if utf8.RuneCountInString(notes) > database.MAX_NOTES_LENGTH {
+			return fmt.Errorf("--notes should be at most %d characters\n", database.MAX_NOTES_LENGTH)
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		setClient(argClientId, cmd.Flags().Changed("email"), cmd.Flags().Changed("notes"))
+	},
+}
+
+var (
+	rotateGrace    time.Duration
+	usageSince     string
+	usageSinceTime int32
+	argClientId    int32
+)
+
+func init() {
+	clientsListCmd.Flags().BoolVar(&listActive, "active", false, "only list enabled clients")
+	clientsListCmd.Flags().BoolVar(&listInactive, "inactive", false, "only list disabled clients")
+	clientsListCmd.Flags().StringVar(&orgName, "org", "", "only list the clients of this organization")
+	clientsListCmd.Flags().StringVar(&outputFormat, "output", "table", "set the output format: table or json")
+	clientsCmd.AddCommand(clientsListCmd)
+	clientsShowCmd.Flags().StringVar(&outputFormat, "output", "table", "set the output format: table or json")
+	clientsCmd.AddCommand(clientsShowCmd)
+	clientsSecretUsageCmd.Flags().StringVar(&usageSince, "since", "", "only count the requests at or after this time")
+	clientsCmd.AddCommand(clientsSecretUsageCmd)
+	clientsRotateSecretCmd.Flags().DurationVar(&rotateGrace, "grace", 24*time.Hour, "accept the old API key for this long, e.g. 72h")
+	clientsSetCmd.Flags().StringVar(&email, "email", "", "set the e-mail field of the client")
+	clientsSetCmd.Flags().StringVar(&notes, "notes", "", "set the notes field of the client")
+	for _, c := range []*cobra.Command{clientsEnableCmd, clientsDisableCmd, clientsRotateSecretCmd, clientsSetCmd} {
+		c.Flags().StringVar(&changeBy, "by", currentUsername(), "set the operator recorded in the admin log")
+		c.Flags().StringVar(&changeReason, "reason", "", "set the reason recorded in the admin log")
+		clientsCmd.AddCommand(c)
+	}
+	rootCmd.AddCommand(clientsCmd)
+}
+
+// clientIdArg checks that the only argument is a client id, and parses it into argClientId.
+func clientIdArg(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("invalid number of args\n")
+	}
+	id, err := strconv.ParseInt(args[0], 10, 32)
+	if err != nil || id <= 0 {
+		return fmt.Errorf("invalid client id %s\n", args[0])
+	}
+	argClientId = int32(id)
+	return nil
+}
+
+// clientInfo is what clients list and clients show tell about a client, its secret is left out.
+type clientInfo struct {
+	Id        int32      `json:"id"`
+	Active    bool       `json:"active"`
+	OrgId     int32      `json:"org_id"`
+	CreatedAt *time.Time `json:"created_at,omitempty"`
+	Email     string     `json:"email"`
+	Notes     string     `json:"notes"`
+	Otp       string     `json:"otp"`
+
+	PreviousSecretExpiresAt *time.Time `json:"previous_secret_expires_at,omitempty"`
+}
+
+func newClientInfo(client database.Client) clientInfo {
+	return clientInfo{
+		Id:        client.Id,
+		Active:    client.Active,
+		OrgId:     client.OrgId,
+		CreatedAt: timestamp(client.CreatedAt),
+		Email:     client.Email,
+		Notes:     client.Notes,
+		Otp:       client.Otp,
+
+		PreviousSecretExpiresAt: previousSecretExpiry(client, time.Now()),
+	}
+}
+
+// previousSecretExpiry gets when the previous API key of a client expires, nil if it is not accepted anymore.
+func previousSecretExpiry(client database.Client, now time.Time) *time.Time {
+	if client.PreviousSecret == "" || int64(client.PreviousSecretExpiresAt) <= now.Unix() {
+		return nil
+	}
+	return timestamp(client.PreviousSecretExpiresAt)
+}
+
+func listClients() {
+	logging.Setup("clients-list")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	orgId, err := organizationFilter()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	clients, err := database.Store.GetClients(orgId)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	infos := make([]clientInfo, 0, len(clients))
+	for _, client := range clients {
+		if (listActive && !client.Active) || (listInactive && client.Active) {
+			continue
+		}
+		infos = append(infos, newClientInfo(client))
+	}
+
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(infos)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tACTIVE\tORG\tCREATED\tEMAIL\tNOTES\tOTP")
+	for _, info := range infos {
+		fmt.Fprintf(writer, "%d\t%t\t%d\t%s\t%s\t%s\t%s\n",
+			info.Id, info.Active, info.OrgId, formatTimestamp(info.CreatedAt), info.Email, info.Notes, info.Otp)
+	}
+	_ = writer.Flush()
+}
+
+func showClient(clientId int32) {
+	logging.Setup("clients-show")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	client, err := database.Store.GetClient(clientId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("client %d not found", clientId)
+		}
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	changes, err := database.Store.GetAdminLogs(strconv.Itoa(int(clientId)), 0)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	info := newClientInfo(client)
+
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(info)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "id:\t%d\n", info.Id)
+	fmt.Fprintf(writer, "active:\t%t\n", info.Active)
+	fmt.Fprintf(writer, "organization:\t%d\n", info.OrgId)
+	fmt.Fprintf(writer, "created:\t%s\n", formatTimestamp(info.CreatedAt))
+	fmt.Fprintf(writer, "email:\t%s\n", info.Email)
+	fmt.Fprintf(writer, "notes:\t%s\n", info.Notes)
+	fmt.Fprintf(writer, "otp:\t%s\n", info.Otp)
+	if info.PreviousSecretExpiresAt != nil {
+		fmt.Fprintf(writer, "previous secret:\taccepted until %s\n", formatTimestamp(info.PreviousSecretExpiresAt))
+	}
+	_ = writer.Flush()
+
+	for _, c := range changes {
+		fmt.Printf("%s\t%s\t%s\t%s\n",
+			time.Unix(int64(c.LoggedAt), 0).Format("2006-01-02 15:04:05"), c.Operator, c.Action, c.Details)
+	}
+}
+
+func toggleClient(clientId int32, active bool) {
+	action := "enable"
+	if !active {
+		action = "disable"
+	}
+	logging.Setup("clients-" + action)
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	change, err := clientChange(action, clientId, url.Values{})
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	toggled, err := database.Store.ToggleClient(clientId, active, change)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if !toggled {
+		fmt.Printf("Client %d not found\n", clientId)
+		return
+	}
+
+	log.Infof("Successfully %sd client %d by %s", action, clientId, changeBy)
+	fmt.Printf("Successfully %sd client %d\n", action, clientId)
+}
+
+func rotateClientSecret(clientId int32) {
+	logging.Setup("clients-rotate-secret")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	secret, err := generateClientSecret()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	var previousExpiresAt int32
+	if rotateGrace > 0 {
+		previousExpiresAt = int32(time.Now().Add(rotateGrace).Unix())
+	}
+	change, err := clientChange("rotate-secret", clientId, url.Values{"grace": {rotateGrace.String()}})
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	updated, err := database.Store.RotateClientSecret(clientId, secret, previousExpiresAt, change)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if !updated {
+		fmt.Printf("Client %d not found\n", clientId)
+		return
+	}
+
+	log.Infof("Successfully rotated the secret of client %d by %s", clientId, changeBy)
+	fmt.Printf("%d,%s\n", clientId, secret)
+}
+
+func reportSecretUsage() {
+	logging.Setup("clients-secret-usage")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	now := time.Now()
+	if usageSince == "" {
+		usageSinceTime = int32(now.AddDate(0, 0, -7).Unix())
+	}
+	usage, err := database.Store.GetSecretUsage(usageSinceTime)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	clients, err := database.Store.GetClients(database.ALL_ORGANIZATIONS)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	expiries := make(map[int32]*time.Time)
+	for _, client := range clients {
+		expiries[client.Id] = previousSecretExpiry(client, now)
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "ID\tSIGNED WITH\tREQUESTS\tLAST REQUEST\tPREVIOUS SECRET EXPIRES")
+	for _, u := range usage {
+		signedWith := u.SignedWith
+		if signedWith == "" {
+			signedWith = "unsigned"
+		}
+		expiry := "-"
+		if expiries[u.ClientId] != nil {
+			expiry = formatTimestamp(expiries[u.ClientId])
+		}
+		fmt.Fprintf(writer, "%d\t%s\t%d\t%s\t%s\n",
+			u.ClientId, signedWith, u.Requests, formatTimestamp(timestamp(u.LastUsedAt)), expiry)
+	}
+	_ = writer.Flush()
+}
+
+func setClient(clientId int32, setEmail bool, setNotes bool) {
+	logging.Setup("clients-set")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	client, err := database.Store.GetClient(clientId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("client %d not found", clientId)
+		}
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	changes := url.Values{}
+	if setEmail {
+		client.Email = email
+		changes.Set("email", email)
+	}
+	if setNotes {
+		client.Notes = notes
+		changes.Set("notes", notes)
+	}
+	change, err := clientChange("set", clientId, changes)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	updated, err := database.Store.UpdateClient(client, change)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if !updated {
+		fmt.Printf("Client %d not found\n", clientId)
+		return
+	}
+
+	log.Infof("Successfully updated client %d by %s", clientId, changeBy)
+	fmt.Printf("Successfully updated client %d\n", clientId)
+}
+
+// clientChange builds the admin log entry of a change of a client, which is written together with the
+// change. Clients are not synced with the sync pool.
+func clientChange(action string, clientId int32, details url.Values) (*database.AdminChange, error) {
+	if changeReason != "" {
+		details.Set("reason", changeReason)
+	}
+	encoded := details.Encode()
+	if len(encoded) > database.MAX_INFO_LENGTH {
+		return nil, fmt.Errorf("the details of the change are %d characters long encoded, the admin log holds at most %d",
+			len(encoded), database.MAX_INFO_LENGTH)
+	}
+	return &database.AdminChange{Log: database.AdminLog{
+		LoggedAt: int32(time.Now().Unix()),
+		Operator: changeBy,
+		Action:   "clients " + action,
+		Target:   strconv.Itoa(int(clientId)),
+		Details:  encoded,
+	}}, nil
+}
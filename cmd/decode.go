@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/services/ksm"
+	"strings"
+	"time"
+)
+
+// decodeCmd represents the Decode OTP command
+var decodeCmd = &cobra.Command{
+	Use:   "decode <otp>",
+	Short: "Decrypt an OTP and compare it with the stored YubiKey",
+	Long: `Decrypt an OTP with the secret of its YubiKey stored in the yubikey-val
+server database, with the master key or inside the PKCS#11 token, and print its
+public id, private id, counters, timestamp and whether its CRC is valid. The
+counters are compared with the stored ones the way the validation does, to
+tell whether the OTP would be replayed, is ahead or jumps sessions. Nothing is
+written, so the OTP can still be validated afterwards.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if !ksm.ValidOtp(strings.ToLower(args[0])) {
+			return fmt.Errorf("the OTP should be 32 to 48 modhex characters\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		decodeOtp(strings.ToLower(args[0]))
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(decodeCmd)
+}
+
+func decodeOtp(otp string) {
+	logging.Setup("decode")
+	defer logging.File.Close()
+
+	defer setupSecretKeys()()
+
+	database.Setup()
+	defer database.Close()
+
+	inspection, err := ksm.InspectOtp(otp)
+	if err != nil {
+		log.Error(err)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			fmt.Println("Unknown YubiKey", otp[:len(otp)-32])
+		case errors.Is(err, database.ErrEmptySecretKey):
+			fmt.Println("The YubiKey", otp[:len(otp)-32], "has no secret")
+		default:
+			fmt.Println(err)
+		}
+		return
+	}
+	log.Info("Decoded OTP of YubiKey ", inspection.PublicId)
+
+	privateId := "matches the stored one"
+	if !inspection.PrivateIdMatches {
+		privateId = "does not match the stored one"
+	}
+	fmt.Printf("public id:       %s\n", inspection.PublicId)
+	fmt.Printf("private id:      %s (%s)\n", inspection.PrivateId, privateId)
+	fmt.Printf("session counter: %d\n", inspection.SessionCounter)
+	fmt.Printf("use counter:     %d\n", inspection.UseCounter)
+	fmt.Printf("timestamp:       %d (%.1f s after the YubiKey was powered up)\n",
+		inspection.Timestamp(), float64(inspection.Timestamp())/8)
+	if !inspection.CrcValid {
+		fmt.Println("CRC:             invalid, the OTP is corrupted or was not generated with the stored secret")
+		return
+	}
+	fmt.Println("CRC:             valid")
+
+	stored, err := database.Store.GetYubiKey(inspection.PublicId)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	lastValidated := "never"
+	if stored.ModifiedAt > 0 {
+		lastValidated = time.Unix(int64(stored.ModifiedAt), 0).Format("2006-01-02 15:04:05")
+	}
+	if stored.SessionCounter < 0 {
+		fmt.Printf("stored:          no counters, last validated %s\n", lastValidated)
+	} else {
+		fmt.Printf("stored:          session counter %d, use counter %d, timestamp %d, last validated %s\n",
+			stored.SessionCounter, stored.UseCounter, (stored.TimestampHigh<<16)+stored.TimestampLow, lastValidated)
+	}
+	if !stored.Active {
+		fmt.Println("                 the YubiKey is disabled, its OTPs are rejected")
+	}
+	if !inspection.PrivateIdMatches {
+		fmt.Println("                 the private id does not match, the OTP is rejected")
+	}
+	fmt.Printf("compared:        %s\n", ksm.CompareCounters(stored, inspection.OtpInfo))
+
+	// within a session the timestamp should have advanced about as much as time passed on the server
+	if inspection.SessionCounter == stored.SessionCounter && inspection.UseCounter > stored.UseCounter && stored.ModifiedAt > 0 {
+		advanced := float64(inspection.Timestamp()-((stored.TimestampHigh<<16)+stored.TimestampLow)) / 8
+		elapsed := time.Since(time.Unix(int64(stored.ModifiedAt), 0)).Seconds()
+		fmt.Printf("timing:          the timestamp advanced %.1f s, %.0f s passed since the last validation\n", advanced, elapsed)
+	}
+}
@@ -1,29 +1,56 @@
 package cmd
 
 import (
+	"encoding/csv"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+	"go-yubikey-val/internal/keyfile"
 	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/secrets"
+	"go-yubikey-val/internal/transfer"
+	"os"
+	"time"
 )
 
 // exportCmd represents the Export command
 var exportCmd = &cobra.Command{
 	Use:   "export",
 	Short: "Export YubiKey Info or Client Info data from the yubikey-val server",
-	Long: `Output comma separated values containing YubiKey Info or Client Info 
-formatted data from the yubikey-val database. This data can later be imported 
-using the ` + "`go-ykval import` command",
+	Long: `Output YubiKey Info or Client Info formatted data from the yubikey-val 
+database as CSV, JSON or JSON Lines (--format), starting with a header naming 
+the schema and its version. This data can later be imported using 
+the ` + "`go-ykval import` command",
 }
 
 // exportKeysCmd represents the Export YubiKeys command
 var exportKeysCmd = &cobra.Command{
 	Use:   "keys",
 	Short: "Export YubiKey Info data from the yubikey-val server",
-	Long: `Output comma separated values containing YubiKey Info formatted data from 
-the yubikey-val database. This data can later be imported using 
-the ` + "`go-ykval import keys` command",
+	Long: `Output YubiKey Info formatted data from the yubikey-val database. This data 
+can later be imported using the ` + "`go-ykval import keys` command" + `. YubiKey 
+secrets are only exported if requested with --secrets, either as stored 
+(encrypted with the master key, secrets still stored in plaintext are encrypted 
+for the export) or decrypted to plaintext, together with the private ids. 
+Secrets wrapped by the PKCS#11 token can not be decrypted to plaintext, those 
+YubiKeys are exported without their secret. 
+With --format ykksm the YubiKeys are written in the ykksm-export CSV layout 
+of the YK-KSM, which requires --secrets plaintext and leaves out YubiKeys 
+without a secret or with a secret wrapped by the PKCS#11 token.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if !transfer.ValidFormat(exportFormat) && exportFormat != keyfile.FORMAT_YKKSM {
+			return fmt.Errorf("format should be one of csv, json, jsonl or ykksm\n")
+		}
+		if exportSecrets != "none" && exportSecrets != "encrypted" && exportSecrets != "plaintext" {
+			return fmt.Errorf("secrets should be one of none, encrypted or plaintext\n")
+		}
+		if exportFormat == keyfile.FORMAT_YKKSM && exportSecrets != "plaintext" {
+			return fmt.Errorf("the ykksm format requires --secrets plaintext\n")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		exportYubiKeys()
 	},
@@ -33,15 +60,28 @@ the ` + "`go-ykval import keys` command",
 var exportClientsCmd = &cobra.Command{
 	Use:   "clients",
 	Short: "Export Client Info data from the yubikey-val server",
-	Long: `Output comma separated values containing Client Info formatted data from 
-the yubikey-val database. This data can later be imported using 
-the ` + "`go-ykval import clients` command",
+	Long: `Output Client Info formatted data from the yubikey-val database. This data 
+can later be imported using the ` + "`go-ykval import clients` command",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if !transfer.ValidFormat(exportFormat) {
+			return fmt.Errorf("format should be one of csv, json or jsonl\n")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		exportClients()
 	},
 }
 
+var (
+	exportSecrets string
+	exportFormat  string
+)
+
 func init() {
+	exportKeysCmd.Flags().StringVar(&exportSecrets, "secrets", "none", "export YubiKey secrets: none, encrypted or plaintext")
+	exportCmd.PersistentFlags().StringVar(&exportFormat, "format", transfer.FORMAT_CSV, "set the output format: csv, json or jsonl, or ykksm for YubiKeys")
+	exportCmd.PersistentFlags().StringVar(&orgName, "org", "", "only export the data of this organization")
 	exportCmd.AddCommand(exportKeysCmd)
 	exportCmd.AddCommand(exportClientsCmd)
 	rootCmd.AddCommand(exportCmd)
@@ -51,39 +91,111 @@ func exportYubiKeys() {
 	logging.Setup("export-yubikeys")
 	defer logging.File.Close()
 
+	if exportSecrets != "none" {
+		secrets.Setup()
+	}
+	if exportSecrets == "plaintext" {
+		log.Warn("Exporting YubiKey secrets in plaintext")
+	}
+
 	database.Setup()
-	defer database.DB.Close()
+	defer database.Close()
+
+	orgId, err := organizationFilter()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
 
-	rows, err := database.DB.Queryx(`SELECT active, created_at, modified_at, public_name, session_counter, use_counter, timestamp_low, timestamp_high, nonce, notes FROM yubikeys ORDER BY public_name`)
+	keys, err := database.Store.GetYubiKeys(orgId)
 	if err != nil {
 		log.Error(err)
 		return
 	}
 
-	for rows.Next() {
-		var key database.YubiKey
-		err := rows.StructScan(&key)
+	if exportFormat == keyfile.FORMAT_YKKSM {
+		exportKsmKeys(keys)
+		return
+	}
+
+	records := make([]transfer.KeyRecord, 0, len(keys))
+	for _, key := range keys {
+		record := transfer.NewKeyRecord(key)
+		switch exportSecrets {
+		case "encrypted":
+			record.SecretKey, err = transfer.EncryptedSecretKey(secrets.MasterKey, key)
+			if err != nil {
+				log.Error(err)
+				fmt.Println(err)
+				return
+			}
+			record.PrivateId = key.PrivateId
+		case "plaintext":
+			if hsm.IsWrapped(key.SecretKey) {
+				log.Warnf("Exported YubiKey %s without its secret, it is wrapped by the PKCS#11 token", key.PublicName)
+			} else if key.SecretKey != "" {
+				record.SecretKey, err = secrets.Open(secrets.MasterKey, key.PublicName, key.SecretKey)
+				if err != nil {
+					log.Error(err)
+					fmt.Println(err)
+					return
+				}
+			}
+			record.PrivateId = key.PrivateId
+		}
+		records = append(records, record)
+	}
+
+	err = transfer.WriteKeys(os.Stdout, exportFormat, records)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+	}
+}
+
+// exportKsmKeys writes the YubiKeys with their decrypted secrets as ykksm-export lines, the YubiKey
+// serial numbers are not stored so they are exported as 0.
+func exportKsmKeys(keys []database.YubiKey) {
+	writer := csv.NewWriter(os.Stdout)
+	var skipped int
+	for _, key := range keys {
+		if key.SecretKey == "" || hsm.IsWrapped(key.SecretKey) {
+			log.Warnf("Skipped YubiKey %s, its secret can not be exported", key.PublicName)
+			skipped++
+			continue
+		}
+		secretKey, err := secrets.Open(secrets.MasterKey, key.PublicName, key.SecretKey)
 		if err != nil {
 			log.Error(err)
+			fmt.Println(err)
+			return
 		}
-
-		var active int8
-		if key.Active {
-			active = 1
+		fields, err := keyfile.Format(keyfile.FORMAT_YKKSM, keyfile.Record{
+			PublicId:  key.PublicName,
+			PrivateId: key.PrivateId,
+			SecretKey: secretKey,
+			Created:   time.Unix(int64(key.CreatedAt), 0),
+			Active:    key.Active,
+		})
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		if err := writer.Write(fields); err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
 		}
-		fmt.Printf("%d,%d,%d,%s,%d,%d,%d,%d,%s,%s\n",
-			active,
-			key.CreatedAt,
-			key.ModifiedAt,
-			key.PublicName,
-			key.SessionCounter,
-			key.UseCounter,
-			key.TimestampLow,
-			key.TimestampHigh,
-			key.Nonce,
-			key.Notes,
-		)
 	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	log.Infof("Exported %d YubiKeys in the ykksm format, skipped %d without an exportable secret", len(keys)-skipped, skipped)
 }
 
 func exportClients() {
@@ -91,33 +203,29 @@ func exportClients() {
 	defer logging.File.Close()
 
 	database.Setup()
-	defer database.DB.Close()
+	defer database.Close()
 
-	rows, err := database.DB.Queryx(`SELECT id, active, created_at, secret, email, notes, otp FROM clients ORDER BY id`)
+	orgId, err := organizationFilter()
 	if err != nil {
 		log.Error(err)
+		fmt.Println(err)
 		return
 	}
 
-	for rows.Next() {
-		var client database.Client
-		err := rows.StructScan(&client)
-		if err != nil {
-			log.Error(err)
-		}
+	clients, err := database.Store.GetClients(orgId)
+	if err != nil {
+		log.Error(err)
+		return
+	}
 
-		var active int8
-		if client.Active {
-			active = 1
-		}
-		fmt.Printf("%d,%d,%d,%s,%s,%s,%s\n",
-			client.Id,
-			active,
-			client.CreatedAt,
-			client.Secret,
-			client.Email,
-			client.Notes,
-			client.Otp,
-		)
+	records := make([]transfer.ClientRecord, 0, len(clients))
+	for _, client := range clients {
+		records = append(records, transfer.NewClientRecord(client))
+	}
+
+	err = transfer.WriteClients(os.Stdout, exportFormat, records)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
 	}
 }
@@ -4,11 +4,17 @@ import (
 	"crypto/rand"
 	"database/sql"
 	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
 	"fmt"
+	"github.com/conformal/yubikey"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/keyfile"
 	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/utils"
+	"os"
 	"strconv"
 	"time"
 )
@@ -22,9 +28,15 @@ var generateCmd = &cobra.Command{
 
 // generateKeysCmd represents the Generate YubiKeys command (originally yhsm-generate-keys)
 var generateKeysCmd = &cobra.Command{
-	Use:   "keys",
+	Use:   "keys [num_keys]",
 	Short: "Generate YubiKey secrets",
-	Long: `Generate secrets for YubiKeys using YubiHSM`,
+	Long: `Generate AES secrets, private ids and public ids for YubiKeys, and insert them 
+into the yubikey-val database with their secrets encrypted, all of them in one 
+transaction. Once stored they are printed to stdout in the CSV log format of 
+YubiKey Manager or ykpersonalize, containing the public id, private id and AES 
+secret for programming the YubiKeys, errors are printed to stderr. Public ids 
+are numbered sequentially after the existing ones with the same prefix, or chosen 
+randomly with --random.`,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) == 0 {
 			return nil
@@ -32,18 +44,18 @@ var generateKeysCmd = &cobra.Command{
 		if len(args) == 1 {
 			_, err := strconv.Atoi(args[0])
 			if err != nil && err.(*strconv.NumError).Err == strconv.ErrSyntax {
-				return fmt.Errorf("num_clients should be an integer\n")
+				return fmt.Errorf("num_keys should be an integer\n")
 			}
 			return err
 		}
 		return fmt.Errorf("invalid number of args\n")
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		numClients := 1
+		numKeys := 1
 		if len(args) == 1 {
-			numClients, _ = strconv.Atoi(args[0])
+			numKeys, _ = strconv.Atoi(args[0])
 		}
-		generateClients(numClients)
+		generateKeys(numKeys)
 	},
 }
 
@@ -81,14 +93,26 @@ var (
 	email   string
 	notes   string
 	otp     string
+
+	publicIdPrefix string
+	publicIdLength int
+	randomPublicId bool
+	keysFormat     string
 )
 
 func init() {
+	generateKeysCmd.Flags().StringVar(&publicIdPrefix, "prefix", "vv", "set the modhex prefix of the generated public ids")
+	generateKeysCmd.Flags().IntVar(&publicIdLength, "length", 12, "set the length of the generated public ids in modhex characters")
+	generateKeysCmd.Flags().BoolVar(&randomPublicId, "random", false, "generate random public ids instead of sequential ones")
+	generateKeysCmd.Flags().StringVar(&keysFormat, "format", keyfile.FORMAT_YKMAN, "set the output format: ykman or ykpersonalize")
+	generateKeysCmd.Flags().StringVar(&notes, "notes", "", "set the notes field of the created YubiKeys")
+	generateKeysCmd.Flags().StringVar(&orgName, "org", "", "create the YubiKeys in this organization")
 	generateCmd.AddCommand(generateKeysCmd)
 	generateClientsCmd.Flags().BoolVar(&urandom, "urandom", false, "use /dev/urandom instead of /dev/random as entropy source")
 	generateClientsCmd.Flags().StringVar(&email, "email", "", "set the e-mail field of the created clients")
 	generateClientsCmd.Flags().StringVar(&notes, "notes", "", "set the notes field of the created clients")
 	generateClientsCmd.Flags().StringVar(&otp, "otp", "", "set the otp field of the created clients")
+	generateClientsCmd.Flags().StringVar(&orgName, "org", "", "create the clients in this organization")
 	generateCmd.AddCommand(generateClientsCmd)
 	rootCmd.AddCommand(generateCmd)
 }
@@ -98,18 +122,17 @@ func generateClients(numClients int) {
 	defer logging.File.Close()
 
 	database.Setup()
-	defer database.DB.Close()
+	defer database.Close()
 
-	var nextId int32
-	err := database.DB.QueryRow(`SELECT id FROM clients ORDER BY id DESC LIMIT 1`).Scan(&nextId)
-	if err != nil && err != sql.ErrNoRows {
+	orgId, err := organizationOwner()
+	if err != nil {
 		log.Error(err)
 		fmt.Println(err)
 		return
 	}
 
-	stmtInsertClient, err := database.DB.PrepareNamed(`INSERT INTO clients VALUES (:id, :active, :created_at, :secret, :email, :notes, :otp)`)
-	if err != nil {
+	nextId, err := database.Store.GetLastClientId()
+	if err != nil && err != sql.ErrNoRows {
 		log.Error(err)
 		fmt.Println(err)
 		return
@@ -117,9 +140,7 @@ func generateClients(numClients int) {
 
 	for i := 0; i < numClients; i++ {
 		nextId++
-		// generate random bytes for the client secret
-		b := make([]byte, 20)
-		_, err := rand.Read(b)
+		secret, err := generateClientSecret()
 		if err != nil {
 			log.Error(err)
 			fmt.Println(err)
@@ -130,12 +151,13 @@ func generateClients(numClients int) {
 			Id:        nextId,
 			Active:    true,
 			CreatedAt: int32(time.Now().Unix()),
-			Secret:    base64.StdEncoding.EncodeToString(b),
+			Secret:    secret,
 			Email:     email,
 			Notes:     notes,
 			Otp:       otp,
+			OrgId:     orgId,
 		}
-		_, err = stmtInsertClient.Exec(client)
+		err = database.Store.InsertClient(client)
 		if err != nil {
 			log.Error(err)
 			log.Error("Failed to insert new client with query", client)
@@ -149,3 +171,190 @@ func generateClients(numClients int) {
 
 	log.Info("Successfully inserted generated clients into database")
 }
+
+func generateKeys(numKeys int) {
+	logging.Setup("generate-keys")
+	defer logging.File.Close()
+
+	// the generated YubiKeys are written to stdout, so errors go to stderr
+	if !keyfile.IsModhex(publicIdPrefix) || len(publicIdPrefix) >= publicIdLength || publicIdLength > keyfile.MAX_PUBLIC_ID_LENGTH {
+		fmt.Fprintf(os.Stderr, "prefix should be modhex and shorter than the public id length (at most %d)\n", keyfile.MAX_PUBLIC_ID_LENGTH)
+		return
+	}
+	if _, err := keyfile.Format(keysFormat, keyfile.Record{}); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	defer setupSecretKeys()()
+
+	database.Setup()
+	defer database.Close()
+
+	orgId, err := organizationOwner()
+	if err != nil {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	var lastPublicId string
+	if !randomPublicId {
+		lastPublicId, err = lastSequentialPublicId()
+		if err != nil {
+			log.Error(err)
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+	}
+
+	records := make([]keyfile.Record, 0, numKeys)
+	keys := make([]database.YubiKey, 0, numKeys)
+	generated := make(map[string]bool)
+	for i := 0; i < numKeys; i++ {
+		var publicId string
+		if randomPublicId {
+			for publicId == "" || generated[publicId] {
+				publicId, err = randomUnusedPublicId()
+				if err != nil {
+					log.Error(err)
+					fmt.Fprintln(os.Stderr, err)
+					return
+				}
+			}
+			generated[publicId] = true
+		} else {
+			var ok bool
+			publicId, ok = keyfile.ModhexIncrement(lastPublicId)
+			if !ok {
+				fmt.Fprintln(os.Stderr, "No sequential public ids left with prefix", publicIdPrefix)
+				return
+			}
+			lastPublicId = publicId
+		}
+
+		privateId, secretKey, err := generateSecrets()
+		if err != nil {
+			log.Error(err)
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		record := keyfile.Record{
+			PublicId:  publicId,
+			PrivateId: privateId,
+			SecretKey: secretKey,
+			Created:   time.Now(),
+		}
+
+		storedSecretKey, err := protectSecretKey(record.PublicId, record.SecretKey)
+		if err != nil {
+			log.Error(err)
+			fmt.Fprintln(os.Stderr, err)
+			return
+		}
+		records = append(records, record)
+		keys = append(keys, database.YubiKey{
+			Active:         true,
+			CreatedAt:      int32(record.Created.Unix()),
+			ModifiedAt:     -1,
+			PublicName:     record.PublicId,
+			SessionCounter: -1,
+			UseCounter:     -1,
+			TimestampLow:   -1,
+			TimestampHigh:  -1,
+			Nonce:          "0000000000000000",
+			Notes:          notes,
+			SecretKey:      storedSecretKey,
+			PrivateId:      record.PrivateId,
+			OrgId:          orgId,
+		})
+	}
+
+	// the YubiKeys are only written out once all of them are stored
+	err = database.Store.InsertYubiKeys(keys)
+	if err != nil {
+		log.Error(err)
+		log.Error("Failed to insert the generated YubiKeys, none of them has been inserted")
+		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintln(os.Stderr, "Failed to insert the generated YubiKeys, none of them has been inserted")
+		return
+	}
+
+	writer := csv.NewWriter(os.Stdout)
+	for _, record := range records {
+		fields, _ := keyfile.Format(keysFormat, record)
+		_ = writer.Write(fields)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Error(err)
+		fmt.Fprintln(os.Stderr, err)
+		return
+	}
+
+	log.Info("Successfully inserted generated YubiKeys into database")
+}
+
+// generateClientSecret generates a random API key for a client, base64 encoded.
+func generateClientSecret() (string, error) {
+	b := make([]byte, 20)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// generateSecrets generates a random private id and AES secret, both hex encoded.
+func generateSecrets() (string, string, error) {
+	b := make([]byte, yubikey.UidSize+yubikey.KeySize)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:yubikey.UidSize]), hex.EncodeToString(b[yubikey.UidSize:]), nil
+}
+
+// lastSequentialPublicId finds the highest existing public id with the prefix and length,
+// or the one before the first possible public id if there is none.
+func lastSequentialPublicId() (string, error) {
+	publicNames, err := database.Store.GetPublicNamesWithPrefix(publicIdPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	last := publicIdPrefix
+	for len(last) < publicIdLength {
+		last += "c"
+	}
+	// modhex doesn't sort like the numbers it encodes, but hex does
+	for _, publicName := range publicNames {
+		if len(publicName) == publicIdLength && keyfile.IsModhex(publicName) &&
+			utils.Strtr(publicName, "cbdefghijklnrtuv", "0123456789abcdef") >
+				utils.Strtr(last, "cbdefghijklnrtuv", "0123456789abcdef") {
+			last = publicName
+		}
+	}
+
+	return last, nil
+}
+
+// randomUnusedPublicId generates a random public id with the prefix which isn't used yet.
+func randomUnusedPublicId() (string, error) {
+	for {
+		b := make([]byte, (publicIdLength-len(publicIdPrefix)+1)/2)
+		_, err := rand.Read(b)
+		if err != nil {
+			return "", err
+		}
+		publicId := publicIdPrefix + string(yubikey.ModHexEncode(b))[:publicIdLength-len(publicIdPrefix)]
+
+		exists, err := database.Store.YubiKeyExists(publicId)
+		if err != nil {
+			return "", err
+		}
+		if !exists {
+			return publicId, nil
+		}
+	}
+}
@@ -5,10 +5,14 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+	"go-yubikey-val/internal/keyfile"
 	"go-yubikey-val/internal/logging"
-	"go-yubikey-val/internal/utils"
+	"go-yubikey-val/internal/secrets"
+	"go-yubikey-val/internal/transfer"
 	"os"
-	"strconv"
+	"strings"
+	"time"
 )
 
 // importCmd represents the Import command
@@ -26,7 +30,26 @@ var importKeysCmd = &cobra.Command{
 	Short: "Import Yubikey Info data into the yubikey-val server",
 	Long: `Read yubikey-val Yubikey Info data from stdin and import it into the 
 yubikey-val servers database. The data should previously have been exported 
-using the ` + "`go-ykval export keys` command",
+using the ` + "`go-ykval export keys` command" + `. All records are validated 
+before anything is written, then they are imported in a single transaction (or 
+in batches with --batch-size). Existing YubiKeys are updated if their imported 
+counters are higher, --mode insert-only skips them and --mode overwrite always 
+updates them. With --dry-run the inserts, updates and skips are printed 
+without importing anything. Exported YubiKey secrets are imported as well, 
+plaintext secrets are encrypted with the master key (or wrapped by the PKCS#11 
+token) before they are stored. With --format ykksm a ykksm-export file of the 
+YK-KSM is read instead: it has no counters, so new YubiKeys are created unused 
+and only the secrets of existing YubiKeys are set, when they have none, or 
+replaced with --mode overwrite.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if !transfer.ValidFormat(importFormat) && importFormat != keyfile.FORMAT_YKKSM {
+			return fmt.Errorf("format should be one of csv, json, jsonl or ykksm\n")
+		}
+		if !database.ValidImportMode(importKeysMode) {
+			return fmt.Errorf("mode should be one of insert-only, update-if-newer or overwrite\n")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		importYubiKeys()
 	},
@@ -38,13 +61,72 @@ var importClientsCmd = &cobra.Command{
 	Short: "Import Client Info data into the yubikey-val server",
 	Long: `Read yubikey-val Client Info data from stdin and import it into the 
 yubikey-val servers database. The data should previously have been exported 
-using ` + "`go-ykval export clients` command",
+using ` + "`go-ykval export clients` command" + `. All records are validated 
+before anything is written, then they are imported in a single transaction (or 
+in batches with --batch-size). Existing clients are skipped unless --mode 
+overwrite is set. With --dry-run the inserts, updates and skips are printed 
+without importing anything.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if !transfer.ValidFormat(importFormat) {
+			return fmt.Errorf("format should be one of csv, json or jsonl\n")
+		}
+		if importClientsMode != database.IMPORT_INSERT_ONLY && importClientsMode != database.IMPORT_OVERWRITE {
+			return fmt.Errorf("mode should be one of insert-only or overwrite\n")
+		}
+		return nil
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		importClients()
 	},
 }
 
+// importSecretsCmd represents the Import YubiKey Secrets command
+var importSecretsCmd = &cobra.Command{
+	Use:   "secrets",
+	Short: "Import YubiKey secrets from programming logs into the yubikey-val server",
+	Long: `Read the CSV log of YubiKey Manager or ykpersonalize, or a ykksm-export file, 
+from stdin and import the public ids, private ids and AES secrets into the 
+yubikey-val servers database for the built-in KSM. All lines are validated 
+before anything is written, the secrets are imported in one transaction (or 
+in batches with --batch-size). New YubiKeys are created, YubiKeys which already 
+have a secret are skipped unless --overwrite is set, re-programmed YubiKeys 
+should be updated using the ` + "`go-ykval keys rekey` command instead.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if secretsFormat != keyfile.FORMAT_YKMAN && secretsFormat != keyfile.FORMAT_YKPERSONALIZE &&
+			secretsFormat != keyfile.FORMAT_YKKSM {
+			return fmt.Errorf("format should be one of ykman, ykpersonalize or ykksm\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		importSecrets()
+	},
+}
+
+var (
+	secretsFormat     string
+	overwriteSecret   bool
+	importFormat      string
+	importKeysMode    string
+	importClientsMode string
+	importDryRun      bool
+	importBatchSize   int
+)
+
 func init() {
+	importSecretsCmd.Flags().StringVar(&secretsFormat, "format", keyfile.FORMAT_YKMAN, "set the input format: ykman, ykpersonalize or ykksm")
+	importSecretsCmd.Flags().BoolVar(&overwriteSecret, "overwrite", false, "overwrite the secrets of YubiKeys which already have one")
+	importKeysCmd.Flags().StringVar(&importKeysMode, "mode", database.IMPORT_UPDATE_IF_NEWER, "set how existing YubiKeys are treated: insert-only, update-if-newer or overwrite")
+	importClientsCmd.Flags().StringVar(&importClientsMode, "mode", database.IMPORT_INSERT_ONLY, "set how existing clients are treated: insert-only or overwrite")
+	importKeysCmd.Flags().StringVar(&importFormat, "format", transfer.FORMAT_CSV, "set the input format: csv, json, jsonl or ykksm")
+	importClientsCmd.Flags().StringVar(&importFormat, "format", transfer.FORMAT_CSV, "set the input format: csv, json or jsonl")
+	for _, cmd := range []*cobra.Command{importSecretsCmd, importKeysCmd, importClientsCmd} {
+		cmd.Flags().BoolVar(&importDryRun, "dry-run", false, "print what would be inserted, updated and skipped without importing anything")
+		cmd.Flags().IntVar(&importBatchSize, "batch-size", 0, "import in transactions of this many records, 0 imports everything in one transaction")
+	}
+	importKeysCmd.Flags().StringVar(&orgName, "org", "", "import the YubiKeys into this organization")
+	importClientsCmd.Flags().StringVar(&orgName, "org", "", "import the clients into this organization")
+	importCmd.AddCommand(importSecretsCmd)
 	importCmd.AddCommand(importKeysCmd)
 	importCmd.AddCommand(importClientsCmd)
 	rootCmd.AddCommand(importCmd)
@@ -54,160 +136,238 @@ func importYubiKeys() {
 	logging.Setup("import-yubikeys")
 	defer logging.File.Close()
 
-	lines, err := utils.Fgetcsv(os.Stdin, 0, ',')
-	if err != nil {
-		log.Error(err)
-		fmt.Println(err)
+	keys, errs := readYubiKeys()
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+			fmt.Println(err)
+		}
+		fmt.Println("Found invalid records, nothing has been imported")
 		return
 	}
 
+	// a dry run does not store the secrets, so they are not encrypted either
+	if !importDryRun {
+		defer setupSecretKeys()()
+	}
+
 	database.Setup()
-	defer database.DB.Close()
+	defer database.Close()
 
-	stmtCheckKeyExists, err := database.DB.Preparex(`SELECT EXISTS (SELECT 1 FROM yubikeys WHERE public_name=?)`)
-	if err != nil {
-		log.Error(err)
-		fmt.Println(err)
-		return
-	}
-	stmtInsertKey, err := database.DB.PrepareNamed(`INSERT INTO yubikeys VALUES (:public_name, :active, :created_at, :modified_at, :session_counter, :use_counter, :timestamp_low, :timestamp_high, :nonce, :notes, :secret_key)`)
+	orgId, err := organizationOwner()
 	if err != nil {
 		log.Error(err)
 		fmt.Println(err)
 		return
 	}
-	stmtUpdateKey, err := database.DB.PrepareNamed(`UPDATE yubikeys SET active=:active, created_at=:created_at, modified_at=:modified_at, session_counter=:session_counter, use_counter=:use_counter, timestamp_low=:timestamp_low, timestamp_high=:timestamp_high, nonce=:nonce, notes=:notes WHERE public_name=:public_name AND (session_counter<:session_counter OR (session_counter=:session_counter AND use_counter<:use_counter))`)
-	if err != nil {
-		log.Error(err)
-		fmt.Println(err)
-		return
-	}
-
-	for _, line := range lines {
-		key := database.YubiKey{
-			Active:         true,
-			CreatedAt:      mustToInt32(line[1]),
-			ModifiedAt:     mustToInt32(line[2]),
-			PublicName:     line[3],
-			SessionCounter: mustToInt32(line[4]),
-			UseCounter:     mustToInt32(line[5]),
-			TimestampLow:   mustToInt32(line[6]),
-			TimestampHigh:  mustToInt32(line[7]),
-			Nonce:          line[8],
-			Notes:          line[9],
-		}
-		if line[0] == "0" {
-			key.Active = false
-		}
 
-		var keyExists bool
-		err := stmtCheckKeyExists.Get(&keyExists, key.PublicName)
-		if err != nil {
-			log.Error(err)
-			log.Error("Failed to check existence of YubiKey with query", key)
-			fmt.Println(err)
-			fmt.Println("Failed to check existence of YubiKey with query", key)
-			return
-		}
-
-		if keyExists {
-			_, err := stmtUpdateKey.Exec(key)
-			if err != nil {
-				log.Error(err)
-				log.Error("Failed to update YubiKey with query", key)
-				fmt.Println(err)
-				fmt.Println("Failed to update YubiKey with query", key)
-				return
-			}
-		} else {
-			_, err := stmtInsertKey.Exec(key)
+	for i := range keys {
+		key := &keys[i]
+		key.OrgId = orgId
+		if !importDryRun && key.SecretKey != "" && !secrets.IsSealed(key.SecretKey) && !hsm.IsWrapped(key.SecretKey) {
+			key.SecretKey, err = protectSecretKey(key.PublicName, key.SecretKey)
 			if err != nil {
 				log.Error(err)
-				log.Error("Failed to insert new YubiKey with query", key)
+				log.Error("Failed to encrypt secret of YubiKey ", key.PublicName)
 				fmt.Println(err)
-				fmt.Println("Failed to insert new YubiKey with query", key)
+				fmt.Println("Failed to encrypt secret of YubiKey", key.PublicName)
 				return
 			}
 		}
 	}
 
-	log.Info("Successfully imported yubikeys to database")
-	fmt.Println("Successfully imported yubikeys to database")
+	options := importOptions(importKeysMode, orgId)
+	options.SecretsOnly = importFormat == keyfile.FORMAT_YKKSM
+	changes, err := database.Store.ImportYubiKeys(keys, options)
+	reportImport("YubiKeys", changes, err)
+}
+
+// readYubiKeys reads the YubiKeys from stdin, a ykksm-export file contains no counters so its
+// YubiKeys are read as unused ones.
+func readYubiKeys() ([]database.YubiKey, []error) {
+	if importFormat != keyfile.FORMAT_YKKSM {
+		records, errs := transfer.ReadKeys(os.Stdin, importFormat)
+		keys := make([]database.YubiKey, 0, len(records))
+		for _, record := range records {
+			keys = append(keys, record.YubiKey())
+		}
+		return keys, errs
+	}
+
+	records, errs := keyfile.Parse(keyfile.FORMAT_YKKSM, os.Stdin)
+	keys, duplicates := keyfileYubiKeys(records)
+	return keys, append(errs, duplicates...)
+}
+
+// keyfileYubiKeys converts the records of a programming log or ykksm-export file to unused YubiKeys
+// with plaintext secrets, a YubiKey must not be listed twice.
+func keyfileYubiKeys(records []keyfile.Record) ([]database.YubiKey, []error) {
+	var errs []error
+	keys := make([]database.YubiKey, 0, len(records))
+	seen := make(map[string]int)
+	for _, record := range records {
+		if first, ok := seen[record.PublicId]; ok {
+			errs = append(errs, fmt.Errorf("line %d: duplicate YubiKey %s, first on line %d", record.Line, record.PublicId, first))
+			continue
+		}
+		seen[record.PublicId] = record.Line
+
+		createdAt := record.Created
+		if createdAt.IsZero() {
+			createdAt = time.Now()
+		}
+		keys = append(keys, database.YubiKey{
+			Active:         record.Active,
+			CreatedAt:      int32(createdAt.Unix()),
+			ModifiedAt:     -1,
+			PublicName:     record.PublicId,
+			SessionCounter: -1,
+			UseCounter:     -1,
+			TimestampLow:   -1,
+			TimestampHigh:  -1,
+			Nonce:          "0000000000000000",
+			SecretKey:      record.SecretKey,
+			PrivateId:      record.PrivateId,
+		})
+	}
+	return keys, errs
 }
 
 func importClients() {
 	logging.Setup("import-clients")
 	defer logging.File.Close()
 
-	lines, err := utils.Fgetcsv(os.Stdin, 0, ',')
-	if err != nil {
-		log.Error(err)
-		fmt.Println(err)
+	records, errs := transfer.ReadClients(os.Stdin, importFormat)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+			fmt.Println(err)
+		}
+		fmt.Println("Found invalid records, nothing has been imported")
 		return
 	}
 
 	database.Setup()
-	defer database.DB.Close()
+	defer database.Close()
 
-	stmtCheckClientExists, err := database.DB.Preparex(`SELECT EXISTS (SELECT 1 FROM clients WHERE id=?)`)
+	orgId, err := organizationOwner()
 	if err != nil {
 		log.Error(err)
 		fmt.Println(err)
 		return
 	}
-	stmtInsertClient, err := database.DB.PrepareNamed(`INSERT INTO clients VALUES (:id, :active, :created_at, :secret, :email, :notes, :otp)`)
+
+	clients := make([]database.Client, 0, len(records))
+	for _, record := range records {
+		client := record.Client()
+		client.OrgId = orgId
+		clients = append(clients, client)
+	}
+
+	changes, err := database.Store.ImportClients(clients, importOptions(importClientsMode, orgId))
+	reportImport("clients", changes, err)
+}
+
+// importOptions only allows changing existing records of the organization set with --org.
+func importOptions(mode string, orgId int32) database.ImportOptions {
+	options := database.ImportOptions{
+		Mode:         mode,
+		Organization: database.ALL_ORGANIZATIONS,
+		BatchSize:    importBatchSize,
+		DryRun:       importDryRun,
+	}
+	if orgName != "" {
+		options.Organization = orgId
+	}
+	return options
+}
+
+// reportImport prints what an import did, or the diff of what it would do on a dry run.
+func reportImport(kind string, changes []database.ImportChange, err error) {
+	var inserted, updated, skipped int
+	for _, change := range changes {
+		var line string
+		switch change.Action {
+		case database.IMPORT_ACTION_INSERT:
+			line = "+ " + change.Target
+			inserted++
+		case database.IMPORT_ACTION_UPDATE:
+			line = "~ " + change.Target + ": " + strings.Join(change.Changes, ", ")
+			updated++
+		case database.IMPORT_ACTION_SKIP:
+			line = "= " + change.Target + ": skipped, " + change.Reason
+			skipped++
+		}
+		if importDryRun {
+			fmt.Println(line)
+		} else {
+			log.Info("Imported ", line)
+		}
+	}
+
 	if err != nil {
 		log.Error(err)
 		fmt.Println(err)
+		if importErr, ok := err.(*database.ImportError); ok && importErr.Committed > 0 {
+			log.Errorf("Failed to import record %d, the %d records before its batch have been imported", importErr.Index+1, importErr.Committed)
+			fmt.Printf("Failed to import record %d, the %d records before its batch have been imported\n", importErr.Index+1, importErr.Committed)
+			return
+		}
+		fmt.Println("Failed to import", kind+", nothing has been imported")
 		return
 	}
 
-	for _, line := range lines {
-		client := database.Client{
-			Id:        mustToInt32(line[0]),
-			Active:    true,
-			CreatedAt: mustToInt32(line[2]),
-			Secret:    line[3],
-			Email:     line[4],
-			Notes:     line[5],
-			Otp:       line[6],
-		}
-		if line[1] == "0" {
-			client.Active = false
+	if importDryRun {
+		fmt.Printf("Dry run, nothing has been imported: %d %s would be inserted, %d updated, %d skipped\n", inserted, kind, updated, skipped)
+		return
+	}
+	log.Infof("Successfully imported %s: %d inserted, %d updated, %d skipped", kind, inserted, updated, skipped)
+	fmt.Printf("Successfully imported %s: %d inserted, %d updated, %d skipped\n", kind, inserted, updated, skipped)
+}
+
+func importSecrets() {
+	logging.Setup("import-secrets")
+	defer logging.File.Close()
+
+	records, errs := keyfile.Parse(secretsFormat, os.Stdin)
+	keys, duplicates := keyfileYubiKeys(records)
+	errs = append(errs, duplicates...)
+	if len(errs) > 0 {
+		for _, err := range errs {
+			log.Error(err)
+			fmt.Println(err)
 		}
+		fmt.Println("Found invalid lines, nothing has been imported")
+		return
+	}
 
-		var clientExists bool
-		err := stmtCheckClientExists.Get(&clientExists, client.Id)
+	// a dry run does not store the secrets, so they are not encrypted either
+	if !importDryRun {
+		defer setupSecretKeys()()
+	}
+
+	database.Setup()
+	defer database.Close()
+
+	for i := 0; i < len(keys) && !importDryRun; i++ {
+		key := &keys[i]
+		var err error
+		key.SecretKey, err = protectSecretKey(key.PublicName, key.SecretKey)
 		if err != nil {
 			log.Error(err)
-			log.Error("Failed to check existence of client with query", client)
+			log.Error("Failed to encrypt secret of YubiKey ", key.PublicName)
 			fmt.Println(err)
-			fmt.Println("Failed to check existence of client with query", client)
+			fmt.Println("Failed to encrypt secret of YubiKey", key.PublicName)
 			return
 		}
-
-		if clientExists == false {
-			_, err := stmtInsertClient.Exec(client)
-			if err != nil {
-				log.Error(err)
-				log.Error("Failed to insert new client with query", client)
-				fmt.Println(err)
-				fmt.Println("Failed to insert new client with query", client)
-				return
-			}
-		}
 	}
 
-	log.Info("Successfully imported clients to database")
-	fmt.Println("Successfully imported clients to database")
-}
-
-func mustToInt32(str string) int32 {
-	integer, err := strconv.Atoi(str)
-	if err != nil {
-		log.Error(err)
-		fmt.Println(err)
-		os.Exit(1)
+	mode := database.IMPORT_UPDATE_IF_NEWER
+	if overwriteSecret {
+		mode = database.IMPORT_OVERWRITE
 	}
-	return int32(integer)
+	options := importOptions(mode, database.ALL_ORGANIZATIONS)
+	options.SecretsOnly = true
+	changes, err := database.Store.ImportYubiKeys(keys, options)
+	reportImport("YubiKey secrets", changes, err)
 }
@@ -0,0 +1,772 @@
+package cmd
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+	"go-yubikey-val/internal/keyfile"
+	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/secrets"
+	"go-yubikey-val/internal/services/sync"
+	"net/url"
+	"os"
+	"os/user"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+)
+
+// keysCmd represents the YubiKeys command
+var keysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Manage YubiKeys and their secrets",
+	Long:  ``,
+}
+
+// keysRewrapCmd represents the Rewrap YubiKey Secrets command
+var keysRewrapCmd = &cobra.Command{
+	Use:   "rewrap",
+	Short: "Re-encrypt all YubiKey secrets with the current master key",
+	Long: `Decrypt all YubiKey secrets with the old master key and encrypt them again 
+with the current master key (set by ksm.master_key_file or the YKVAL_MASTER_KEY 
+environment variable) in a single transaction. Secrets stored in plaintext are 
+encrypted as well. The old master key is read from --old-key-file or the 
+YKVAL_OLD_MASTER_KEY environment variable, the current master key is used if 
+neither of them is set.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		rewrapKeys()
+	},
+}
+
+// keysWrapPkcs11Cmd represents the Wrap YubiKey Secrets with PKCS#11 command
+var keysWrapPkcs11Cmd = &cobra.Command{
+	Use:   "wrap-pkcs11",
+	Short: "Wrap all YubiKey secrets with the wrapping key of the PKCS#11 token",
+	Long: `Wrap all YubiKey secrets, stored in plaintext or encrypted with the master key, 
+with the wrapping key of the configured PKCS#11 token in a single transaction. 
+Wrapped secrets can only be used with ksm.use_pkcs11 enabled.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		wrapKeysPkcs11()
+	},
+}
+
+// keysRekeyCmd represents the Rekey YubiKey command
+var keysRekeyCmd = &cobra.Command{
+	Use:   "rekey <public-name>",
+	Short: "Install a new secret for a re-programmed YubiKey",
+	Long: `Archive the current secret and counters of a YubiKey, which has been 
+re-programmed with a new AES secret but keeps its public id, into the YubiKey 
+history, then install the new secret and reset the counters in a single 
+transaction. The new secret and private id are either given with --secret and 
+--private-id, or generated with --generate and printed for programming the 
+YubiKey. The operator and the time are recorded in the history. The other 
+servers of the sync pool are sent the rekey to reset their counters as well, 
+unless they validated an OTP since. The new secret is not sent: servers with 
+their own built-in KSM database have to be rekeyed with the same secret too.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if rekeyGenerate == (rekeySecret != "" || rekeyPrivateId != "") {
+			return fmt.Errorf("either --generate or --secret and --private-id should be set\n")
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		rekeyYubiKey(args[0])
+	},
+}
+
+// keysHistoryCmd represents the YubiKey History command
+var keysHistoryCmd = &cobra.Command{
+	Use:   "history <public-name>",
+	Short: "Show the archived secrets and counters of a YubiKey",
+	Long: `Show the counters archived each time the YubiKey has been re-keyed, 
+when and by whom, the latest first. The archived secrets are not shown.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		showYubiKeyHistory(args[0])
+	},
+}
+
+// keysListCmd represents the List YubiKeys command
+var keysListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the YubiKeys",
+	Long: `List the YubiKeys with their state, organization, creation time, last use,
+counters, kind of stored secret and notes, but not the secrets themselves. A
+YubiKey is last used when its counters were last updated, YubiKeys never used
+are listed with --used-before as well. Times are given as 2006-01-02,
+2006-01-02 15:04:05 or RFC 3339.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if listActive && listInactive {
+			return fmt.Errorf("only one of --active or --inactive should be set\n")
+		}
+		if outputFormat != "table" && outputFormat != "json" {
+			return fmt.Errorf("output should be one of table or json\n")
+		}
+		var err error
+		if listUsedBefore != "" {
+			if keysFilter.UsedBefore, err = parseTime(listUsedBefore); err != nil {
+				return err
+			}
+		}
+		if listUsedAfter != "" {
+			if keysFilter.UsedAfter, err = parseTime(listUsedAfter); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		listYubiKeys()
+	},
+}
+
+// keysShowCmd represents the Show YubiKey command
+var keysShowCmd = &cobra.Command{
+	Use:   "show <public-name>",
+	Short: "Show a YubiKey",
+	Long: `Show everything about a YubiKey but its secrets, and the changes made to it
+with the keys commands.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if outputFormat != "table" && outputFormat != "json" {
+			return fmt.Errorf("output should be one of table or json\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		showYubiKey(args[0])
+	},
+}
+
+// keysEnableCmd represents the Enable YubiKey command
+var keysEnableCmd = &cobra.Command{
+	Use:   "enable <public-name>",
+	Short: "Enable a disabled YubiKey",
+	Long: `Enable a YubiKey, so its OTPs are validated again. The change is recorded in 
+the admin log and sent to the servers of the sync pool.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		toggleYubiKey(args[0], true)
+	},
+}
+
+// keysDisableCmd represents the Disable YubiKey command
+var keysDisableCmd = &cobra.Command{
+	Use:   "disable <public-name>",
+	Short: "Disable a YubiKey, e.g. a lost one",
+	Long: `Disable a YubiKey, its OTPs are answered with BAD_OTP until it is enabled 
+again. The change is recorded in the admin log and sent to the servers of the 
+sync pool.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		toggleYubiKey(args[0], false)
+	},
+}
+
+// keysDeleteCmd represents the Delete YubiKey command
+var keysDeleteCmd = &cobra.Command{
+	Use:   "delete <public-name>",
+	Short: "Delete a YubiKey",
+	Long: `Delete a YubiKey with its secret and counters, its history is kept. Only 
+disabled YubiKeys are deleted unless --force is set: a deleted YubiKey is 
+discovered again by its next OTP when an external KSM is used, with its 
+counters reset. The change is recorded in the admin log and sent to the 
+servers of the sync pool.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		deleteYubiKey(args[0])
+	},
+}
+
+// keysSetNotesCmd represents the Set YubiKey Notes command
+var keysSetNotesCmd = &cobra.Command{
+	Use:   "set-notes <public-name> <notes>",
+	Short: "Set the notes field of a YubiKey",
+	Long: `Set the notes field of a YubiKey, e.g. its owner. The change is recorded in 
+the admin log and sent to the servers of the sync pool.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if utf8.RuneCountInString(args[1]) > database.MAX_NOTES_LENGTH {
+			return fmt.Errorf("notes should be at most %d characters\n", database.MAX_NOTES_LENGTH)
+		}
+		return checkChangeFlags()
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		setYubiKeyNotes(args[0], args[1])
+	},
+}
+
+var (
+	outputFormat   string
+	keysFilter     database.YubiKeyFilter
+	listActive     bool
+	listInactive   bool
+	listUsedBefore string
+	listUsedAfter  string
+	changeBy       string
+	changeReason   string
+	deleteForce    bool
+)
+
+var (
+	oldKeyFile string
+
+	rekeySecret    string
+	rekeyPrivateId string
+	rekeyGenerate  bool
+	rekeyFormat    string
+)
+
+func init() {
+	keysRewrapCmd.Flags().StringVar(&oldKeyFile, "old-key-file", "", "read the old master key from this file")
+	keysCmd.AddCommand(keysRewrapCmd)
+	keysCmd.AddCommand(keysWrapPkcs11Cmd)
+	keysRekeyCmd.Flags().StringVar(&rekeySecret, "secret", "", "set the new AES secret in hex")
+	keysRekeyCmd.Flags().StringVar(&rekeyPrivateId, "private-id", "", "set the new private id in hex")
+	keysRekeyCmd.Flags().BoolVar(&rekeyGenerate, "generate", false, "generate a new AES secret and private id")
+	keysRekeyCmd.Flags().StringVar(&rekeyFormat, "format", keyfile.FORMAT_YKMAN, "set the output format of generated secrets: ykman or ykpersonalize")
+	keysRekeyCmd.Flags().StringVar(&changeBy, "by", currentUsername(), "set the operator recorded in the history and the admin log")
+	keysRekeyCmd.Flags().StringVar(&changeReason, "reason", "", "set the reason recorded in the history and the admin log")
+	keysCmd.AddCommand(keysRekeyCmd)
+	keysCmd.AddCommand(keysHistoryCmd)
+	keysListCmd.Flags().BoolVar(&listActive, "active", false, "only list enabled YubiKeys")
+	keysListCmd.Flags().BoolVar(&listInactive, "inactive", false, "only list disabled YubiKeys")
+	keysListCmd.Flags().StringVar(&listUsedBefore, "used-before", "", "only list YubiKeys last used before this time")
+	keysListCmd.Flags().StringVar(&listUsedAfter, "used-after", "", "only list YubiKeys last used at or after this time")
+	keysListCmd.Flags().StringVar(&outputFormat, "output", "table", "set the output format: table or json")
+	keysCmd.AddCommand(keysListCmd)
+	keysShowCmd.Flags().StringVar(&outputFormat, "output", "table", "set the output format: table or json")
+	keysCmd.AddCommand(keysShowCmd)
+	for _, c := range []*cobra.Command{keysEnableCmd, keysDisableCmd, keysDeleteCmd, keysSetNotesCmd} {
+		c.Flags().StringVar(&changeBy, "by", currentUsername(), "set the operator recorded in the admin log")
+		c.Flags().StringVar(&changeReason, "reason", "", "set the reason recorded in the admin log")
+		keysCmd.AddCommand(c)
+	}
+	keysDeleteCmd.Flags().BoolVar(&deleteForce, "force", false, "delete the YubiKey even if it is enabled")
+	rootCmd.AddCommand(keysCmd)
+}
+
+func rewrapKeys() {
+	logging.Setup("keys-rewrap")
+	defer logging.File.Close()
+
+	secrets.Setup()
+	if secrets.MasterKey == nil {
+		log.Error(secrets.ErrNoMasterKey)
+		fmt.Println(secrets.ErrNoMasterKey)
+		return
+	}
+	oldMasterKey, err := secrets.LoadMasterKey(os.Getenv("YKVAL_OLD_MASTER_KEY"), oldKeyFile)
+	if err == secrets.ErrNoMasterKey {
+		oldMasterKey = secrets.MasterKey
+	} else if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	database.Setup()
+	defer database.Close()
+
+	count, err := database.Store.ReplaceSecretKeys(func(publicName string, secretKey string) (string, error) {
+		if hsm.IsWrapped(secretKey) {
+			return secretKey, nil
+		}
+		plaintext, err := secrets.Open(oldMasterKey, publicName, secretKey)
+		if err != nil {
+			return "", err
+		}
+		return secrets.Seal(secrets.MasterKey, publicName, plaintext)
+	})
+	if err != nil {
+		log.Error(err)
+		log.Error("Failed to rewrap YubiKey secrets, nothing has been changed")
+		fmt.Println(err)
+		fmt.Println("Failed to rewrap YubiKey secrets, nothing has been changed")
+		return
+	}
+
+	log.Infof("Successfully rewrapped %d YubiKey secrets", count)
+	fmt.Printf("Successfully rewrapped %d YubiKey secrets\n", count)
+}
+
+func wrapKeysPkcs11() {
+	logging.Setup("keys-wrap-pkcs11")
+	defer logging.File.Close()
+
+	secrets.Setup()
+	hsm.Setup()
+	defer hsm.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	count, err := database.Store.ReplaceSecretKeys(func(publicName string, secretKey string) (string, error) {
+		if hsm.IsWrapped(secretKey) {
+			return secretKey, nil
+		}
+		plaintext, err := secrets.Open(secrets.MasterKey, publicName, secretKey)
+		if err != nil {
+			return "", err
+		}
+		return hsm.Wrap(plaintext)
+	})
+	if err != nil {
+		log.Error(err)
+		log.Error("Failed to wrap YubiKey secrets, nothing has been changed")
+		fmt.Println(err)
+		fmt.Println("Failed to wrap YubiKey secrets, nothing has been changed")
+		return
+	}
+
+	log.Infof("Successfully wrapped %d YubiKey secrets", count)
+	fmt.Printf("Successfully wrapped %d YubiKey secrets\n", count)
+}
+
+// setupSecretKeys prepares encrypting YubiKey secrets for storage, it returns a function to clean up.
+func setupSecretKeys() func() {
+	if config.Ksm.UsePkcs11 {
+		hsm.Setup()
+		return hsm.Close
+	}
+	secrets.Setup()
+	return func() {}
+}
+
+// protectSecretKey encrypts a plaintext secret key for storage, it's wrapped by the PKCS#11 token
+// if it's enabled or sealed with the master key otherwise.
+func protectSecretKey(publicName string, secretKey string) (string, error) {
+	if config.Ksm.UsePkcs11 {
+		return hsm.Wrap(secretKey)
+	}
+	return secrets.Seal(secrets.MasterKey, publicName, secretKey)
+}
+
+func rekeyYubiKey(publicName string) {
+	logging.Setup("keys-rekey")
+	defer logging.File.Close()
+
+	record := keyfile.Record{
+		PublicId:  publicName,
+		PrivateId: strings.ToLower(rekeyPrivateId),
+		SecretKey: strings.ToLower(rekeySecret),
+		Created:   time.Now(),
+	}
+	if rekeyGenerate {
+		var err error
+		record.PrivateId, record.SecretKey, err = generateSecrets()
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+	}
+	if err := record.Validate(); err != nil {
+		fmt.Println(err)
+		return
+	}
+	if _, err := keyfile.Format(rekeyFormat, record); err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	defer setupSecretKeys()()
+
+	database.Setup()
+	defer database.Close()
+
+	storedSecretKey, err := protectSecretKey(publicName, record.SecretKey)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	change, err := keyChange(sync.ACTION_REKEY, publicName, url.Values{})
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	err = database.Store.RekeyYubiKey(publicName, storedSecretKey, record.PrivateId, changeBy, changeReason, change)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("YubiKey %s not found", publicName)
+		}
+		log.Error(err)
+		log.Error("Failed to rekey YubiKey ", publicName)
+		fmt.Println(err)
+		fmt.Println("Failed to rekey YubiKey", publicName)
+		return
+	}
+
+	if rekeyGenerate {
+		fields, _ := keyfile.Format(rekeyFormat, record)
+		writer := csv.NewWriter(os.Stdout)
+		_ = writer.Write(fields)
+		writer.Flush()
+	}
+
+	log.Infof("Successfully rekeyed YubiKey %s by %s", publicName, changeBy)
+	fmt.Printf("Successfully rekeyed YubiKey %s\n", publicName)
+	sendKeyChanges()
+}
+
+func showYubiKeyHistory(publicName string) {
+	logging.Setup("keys-history")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	history, err := database.Store.GetYubiKeyHistory(publicName)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	for _, h := range history {
+		fmt.Printf("%s\t%s\tsession_counter=%d use_counter=%d\t%s\n",
+			time.Unix(int64(h.ArchivedAt), 0).Format("2006-01-02 15:04:05"),
+			h.ArchivedBy, h.SessionCounter, h.UseCounter, h.Reason)
+	}
+}
+
+// keyInfo is what keys list and keys show tell about a YubiKey, its secrets are left out.
+type keyInfo struct {
+	PublicName     string     `json:"public_name"`
+	Active         bool       `json:"active"`
+	OrgId          int32      `json:"org_id"`
+	CreatedAt      *time.Time `json:"created_at,omitempty"`
+	LastUsedAt     *time.Time `json:"last_used_at,omitempty"`
+	SessionCounter int32      `json:"session_counter"`
+	UseCounter     int32      `json:"use_counter"`
+	Secret         string     `json:"secret"`
+	Notes          string     `json:"notes"`
+}
+
+func newKeyInfo(key database.YubiKey) keyInfo {
+	info := keyInfo{
+		PublicName:     key.PublicName,
+		Active:         key.Active,
+		OrgId:          key.OrgId,
+		CreatedAt:      timestamp(key.CreatedAt),
+		LastUsedAt:     timestamp(key.ModifiedAt),
+		SessionCounter: key.SessionCounter,
+		UseCounter:     key.UseCounter,
+		Secret:         "none",
+		Notes:          key.Notes,
+	}
+	switch {
+	case key.SecretKey == "":
+	case hsm.IsWrapped(key.SecretKey):
+		info.Secret = "wrapped"
+	case secrets.IsSealed(key.SecretKey):
+		info.Secret = "encrypted"
+	default:
+		info.Secret = "plaintext"
+	}
+	return info
+}
+
+// timestamp converts a unix timestamp of the database, nil if it has never been set.
+func timestamp(t int32) *time.Time {
+	if t <= 0 {
+		return nil
+	}
+	tm := time.Unix(int64(t), 0)
+	return &tm
+}
+
+func formatTimestamp(t *time.Time) string {
+	if t == nil {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04:05")
+}
+
+func listYubiKeys() {
+	logging.Setup("keys-list")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	if listActive || listInactive {
+		keysFilter.Active = &listActive
+	}
+	keys, err := database.Store.FindYubiKeys(keysFilter)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	infos := make([]keyInfo, 0, len(keys))
+	for _, key := range keys {
+		infos = append(infos, newKeyInfo(key))
+	}
+
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(infos)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "PUBLIC NAME\tACTIVE\tORG\tCREATED\tLAST USED\tSESSION\tUSE\tSECRET\tNOTES")
+	for _, info := range infos {
+		fmt.Fprintf(writer, "%s\t%t\t%d\t%s\t%s\t%d\t%d\t%s\t%s\n",
+			info.PublicName, info.Active, info.OrgId, formatTimestamp(info.CreatedAt), formatTimestamp(info.LastUsedAt),
+			info.SessionCounter, info.UseCounter, info.Secret, info.Notes)
+	}
+	_ = writer.Flush()
+}
+
+func showYubiKey(publicName string) {
+	logging.Setup("keys-show")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	key, err := database.Store.GetYubiKey(publicName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("YubiKey %s not found", publicName)
+		}
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	changes, err := database.Store.GetAdminLogs(publicName, 0)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	info := newKeyInfo(key)
+
+	if outputFormat == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		_ = encoder.Encode(info)
+		return
+	}
+
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(writer, "public name:\t%s\n", info.PublicName)
+	fmt.Fprintf(writer, "active:\t%t\n", info.Active)
+	fmt.Fprintf(writer, "organization:\t%d\n", info.OrgId)
+	fmt.Fprintf(writer, "created:\t%s\n", formatTimestamp(info.CreatedAt))
+	fmt.Fprintf(writer, "last used:\t%s\n", formatTimestamp(info.LastUsedAt))
+	fmt.Fprintf(writer, "counters:\tsession_counter=%d use_counter=%d\n", info.SessionCounter, info.UseCounter)
+	fmt.Fprintf(writer, "secret:\t%s\n", info.Secret)
+	fmt.Fprintf(writer, "notes:\t%s\n", info.Notes)
+	_ = writer.Flush()
+
+	for _, c := range changes {
+		fmt.Printf("%s\t%s\t%s\t%s\n",
+			time.Unix(int64(c.LoggedAt), 0).Format("2006-01-02 15:04:05"), c.Operator, c.Action, c.Details)
+	}
+}
+
+func toggleYubiKey(publicName string, active bool) {
+	action := sync.ACTION_ENABLE
+	if !active {
+		action = sync.ACTION_DISABLE
+	}
+	logging.Setup("keys-" + action)
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	change, err := keyChange(action, publicName, url.Values{})
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	toggled, err := database.Store.ToggleYubiKey(publicName, active, change)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if !toggled {
+		fmt.Printf("YubiKey %s not found\n", publicName)
+		return
+	}
+
+	log.Infof("Successfully %sd YubiKey %s by %s", action, publicName, changeBy)
+	fmt.Printf("Successfully %sd YubiKey %s\n", action, publicName)
+	sendKeyChanges()
+}
+
+func deleteYubiKey(publicName string) {
+	logging.Setup("keys-delete")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	key, err := database.Store.GetYubiKey(publicName)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			err = fmt.Errorf("YubiKey %s not found", publicName)
+		}
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if key.Active && !deleteForce {
+		fmt.Printf("YubiKey %s is enabled, disable it first or use --force\n", publicName)
+		return
+	}
+
+	change, err := keyChange(sync.ACTION_DELETE, publicName, url.Values{})
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	deleted, err := database.Store.DeleteYubiKey(publicName, change)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if !deleted {
+		fmt.Printf("YubiKey %s not found\n", publicName)
+		return
+	}
+
+	log.Infof("Successfully deleted YubiKey %s by %s", publicName, changeBy)
+	fmt.Printf("Successfully deleted YubiKey %s\n", publicName)
+	sendKeyChanges()
+}
+
+func setYubiKeyNotes(publicName string, notes string) {
+	logging.Setup("keys-set-notes")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	change, err := keyChange(sync.ACTION_SET_NOTES, publicName, url.Values{"notes": {notes}})
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	updated, err := database.Store.UpdateYubiKeyNotes(publicName, notes, change)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if !updated {
+		fmt.Printf("YubiKey %s not found\n", publicName)
+		return
+	}
+
+	log.Infof("Successfully set notes of YubiKey %s by %s", publicName, changeBy)
+	fmt.Printf("Successfully set notes of YubiKey %s\n", publicName)
+	sendKeyChanges()
+}
+
+// keyChange builds the record of a change of a YubiKey, its admin log entry and the queue entries
+// sending it to the servers of the sync pool, which is written together with the change.
+func keyChange(action string, publicName string, details url.Values) (*database.AdminChange, error) {
+	if changeReason != "" {
+		details.Set("reason", changeReason)
+	}
+	encoded := details.Encode()
+	if len(encoded) > database.MAX_INFO_LENGTH {
+		return nil, fmt.Errorf("the details of the change are %d characters long encoded, the admin log holds at most %d",
+			len(encoded), database.MAX_INFO_LENGTH)
+	}
+	now := time.Now()
+	queue, err := sync.QueueChange(action, publicName, changeBy, details, now)
+	if err != nil {
+		return nil, err
+	}
+	return &database.AdminChange{
+		Log: database.AdminLog{
+			LoggedAt: int32(now.Unix()),
+			Operator: changeBy,
+			Action:   "keys " + action,
+			Target:   publicName,
+			Details:  encoded,
+		},
+		Queue: queue,
+	}, nil
+}
+
+// checkChangeFlags checks that the operator and the reason of a change fit in the admin log.
+func checkChangeFlags() error {
+	if utf8.RuneCountInString(changeBy) > database.MAX_NOTES_LENGTH {
+		return fmt.Errorf("--by should be at most %d characters\n", database.MAX_NOTES_LENGTH)
+	}
+	if utf8.RuneCountInString(changeReason) > database.MAX_NOTES_LENGTH {
+		return fmt.Errorf("--reason should be at most %d characters\n", database.MAX_NOTES_LENGTH)
+	}
+	return nil
+}
+
+// sendKeyChanges sends the queued changes to the sync pool right away, the changes which can not be
+// sent are retried by the servers.
+func sendKeyChanges() {
+	if len(config.Sync.Pool) == 0 {
+		return
+	}
+	sent, queued, err := sync.SendChanges(database.Store)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+	}
+	log.Infof("Sent %d changes to the sync pool, %d are still queued", sent, queued)
+	if queued > 0 {
+		fmt.Printf("%d changes are queued for servers of the sync pool which could not be reached, serve retries them\n", queued)
+	}
+}
+
+// currentUsername returns the name of the user running the command, to be recorded as the operator.
+func currentUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,100 @@
+package cmd
+
+import (
+	"fmt"
+	fasthttprouter "github.com/fasthttp/router"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/secrets"
+	"go-yubikey-val/internal/services/ksm"
+)
+
+// ksmCmd represents the KSM command
+var ksmCmd = &cobra.Command{
+	Use:   "ksm",
+	Short: "Built-in Key Storage Module operations",
+	Long:  ``,
+}
+
+// ksmServeCmd represents the Serve KSM command
+var ksmServeCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "Start a YK-KSM compatible decryption server",
+	Long: `Start a YK-KSM compatible decryption server listening on specified host and port. 
+It decrypts OTPs with the secrets stored in the yubikeys table, and answers 
+requests to /wsapi/decrypt?otp=... in the same format as Yubico's YK-KSM, so 
+other validation servers can use it as their KSM. Only IP addresses listed in 
+ksm.server.allowed_ip_addresses are allowed to use it.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		serveKsm()
+	},
+}
+
+// ksmInitPkcs11Cmd represents the Initialize PKCS#11 Token command
+var ksmInitPkcs11Cmd = &cobra.Command{
+	Use:   "init-pkcs11",
+	Short: "Generate the wrapping key in the PKCS#11 token",
+	Long: `Generate a non-extractable AES wrapping key labeled ksm.pkcs11.wrapping_key_label 
+inside the configured PKCS#11 token. YubiKey secrets wrapped with this key can 
+only be used for decrypting OTPs inside the token.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		initPkcs11()
+	},
+}
+
+var (
+	ksmHost string
+	ksmPort int32
+)
+
+func init() {
+	ksmServeCmd.Flags().StringVar(&ksmHost, "host", "127.0.0.1",
+		"set the host which the server should listen on")
+	ksmServeCmd.Flags().Int32Var(&ksmPort, "port", 8002,
+		"set the port which the server should listen on")
+	ksmCmd.AddCommand(ksmServeCmd)
+	ksmCmd.AddCommand(ksmInitPkcs11Cmd)
+	rootCmd.AddCommand(ksmCmd)
+}
+
+func serveKsm() {
+	logging.Setup("ksm-server")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+	database.CheckSchema()
+	if config.Ksm.UsePkcs11 {
+		hsm.Setup()
+		defer hsm.Close()
+	} else {
+		secrets.Setup()
+	}
+
+	router := fasthttprouter.New()
+	router.GET("/wsapi/decrypt", ksm.Decrypt) // YK-KSM compatible decryption route
+
+	listen(router, ksmHost, ksmPort)
+}
+
+func initPkcs11() {
+	logging.Setup("ksm-init-pkcs11")
+	defer logging.File.Close()
+
+	hsm.Setup()
+	defer hsm.Close()
+
+	err := hsm.GenerateWrappingKey()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	log.Info("Successfully generated the wrapping key in the PKCS#11 token")
+	fmt.Println("Successfully generated the wrapping key in the PKCS#11 token")
+}
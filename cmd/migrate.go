@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/logging"
+	"time"
+)
+
+// migrateCmd represents the Migrate command
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Migrate the database schema",
+	Long: `Apply or revert the versioned schema migrations embedded in yubikey-val.
+The applied migrations are recorded in the schema_version table, serve refuses
+to start if the database schema is older than the latest migration.`,
+}
+
+// migrateUpCmd represents the Migrate Up command
+var migrateUpCmd = &cobra.Command{
+	Use:   "up",
+	Short: "Apply all pending migrations",
+	Long: `Apply all pending migrations, or only up to the version set with --to.
+Databases set up with db.sql before migrations existed are adopted by the
+first migration without changes, and updated by the following ones.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		migrateUp()
+	},
+}
+
+// migrateDownCmd represents the Migrate Down command
+var migrateDownCmd = &cobra.Command{
+	Use:   "down",
+	Short: "Revert the latest migrations",
+	Long: `Revert the latest migration, or the number of migrations set with --steps.
+Reverting a migration drops the data stored in the tables and columns it added,
+reverting the first migration drops all tables. An empty SQLite database is
+created again with the latest schema on the next start.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		migrateDown()
+	},
+}
+
+// migrateStatusCmd represents the Migrate Status command
+var migrateStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the applied and pending migrations",
+	Long:  ``,
+	Run: func(cmd *cobra.Command, args []string) {
+		migrateStatus()
+	},
+}
+
+var (
+	migrateTo    int
+	migrateSteps int
+)
+
+func init() {
+	migrateUpCmd.Flags().IntVar(&migrateTo, "to", 0, "set the schema version to migrate to (default is the latest version)")
+	migrateDownCmd.Flags().IntVar(&migrateSteps, "steps", 1, "set the number of migrations to revert")
+	migrateCmd.AddCommand(migrateUpCmd)
+	migrateCmd.AddCommand(migrateDownCmd)
+	migrateCmd.AddCommand(migrateStatusCmd)
+	rootCmd.AddCommand(migrateCmd)
+}
+
+func migrateUp() {
+	logging.Setup("migrate-up")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	version := migrateTo
+	if version == 0 {
+		var err error
+		version, err = database.LatestVersion(config.DB.Driver)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+	}
+	current, err := database.Store.SchemaVersion()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	if version < current {
+		fmt.Printf("Schema is already at version %d, use migrate down to revert migrations\n", current)
+		return
+	}
+
+	runMigrations(version)
+}
+
+func migrateDown() {
+	logging.Setup("migrate-down")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	current, err := database.Store.SchemaVersion()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	version := current - migrateSteps
+	if migrateSteps < 0 || version < 0 {
+		fmt.Printf("Can not revert %d migrations, schema is at version %d\n", migrateSteps, current)
+		return
+	}
+
+	runMigrations(version)
+}
+
+func runMigrations(version int) {
+	migrations, err := database.Store.Migrate(version)
+	for _, m := range migrations {
+		log.Infof("Migrated %d_%s", m.Version, m.Name)
+		fmt.Printf("Migrated %d_%s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	log.Info("Schema is at version ", version)
+	fmt.Println("Schema is at version", version)
+}
+
+func migrateStatus() {
+	logging.Setup("migrate-status")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	migrations, err := database.Migrations(config.DB.Driver)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+	applied, err := database.Store.AppliedMigrations()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	var version int
+	for _, m := range migrations {
+		status := "pending"
+		if appliedAt, ok := applied[m.Version]; ok {
+			status = "applied " + time.Unix(int64(appliedAt), 0).Format("2006-01-02 15:04:05")
+			version = m.Version
+		}
+		fmt.Printf("%d\t%s\t%s\n", m.Version, m.Name, status)
+	}
+	fmt.Printf("Schema is at version %d of %d\n", version, len(migrations))
+}
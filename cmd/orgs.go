@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"database/sql"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/logging"
+	"time"
+)
+
+// orgsCmd represents the Organizations command
+var orgsCmd = &cobra.Command{
+	Use:     "orgs",
+	Aliases: []string{"organizations"},
+	Short:   "Manage the organizations owning clients and YubiKeys",
+	Long: `Manage the organizations (tenants) owning clients and YubiKeys. YubiKeys of
+an organization are only validated for clients of the same organization,
+YubiKeys without an organization are validated for every client. Clients and
+YubiKeys are created in an organization with the --org flag of the gen and
+import commands, or moved into one with ` + "`go-ykval orgs assign`" + `.`,
+}
+
+// orgsAddCmd represents the Add Organization command
+var orgsAddCmd = &cobra.Command{
+	Use:   "add <name>",
+	Short: "Create an organization",
+	Long:  ``,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		addOrganization(args[0])
+	},
+}
+
+// orgsListCmd represents the List Organizations command
+var orgsListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the organizations",
+	Long:  `List the id, state, creation time, name and notes of all organizations.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		listOrganizations()
+	},
+}
+
+// orgsEnableCmd represents the Enable Organization command
+var orgsEnableCmd = &cobra.Command{
+	Use:   "enable <name>",
+	Short: "Enable a disabled organization",
+	Long: `Enable an organization again, its clients and YubiKeys are back to their own
+active state.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		toggleOrganization(args[0], true)
+	},
+}
+
+// orgsDisableCmd represents the Disable Organization command
+var orgsDisableCmd = &cobra.Command{
+	Use:   "disable <name>",
+	Short: "Disable an organization with all its clients and YubiKeys",
+	Long: `Disable an organization, all its clients and YubiKeys are disabled at once:
+validation requests of its clients are answered with NO_SUCH_CLIENT and the
+built-in KSM does not decrypt OTPs of its YubiKeys. The active state of the
+clients and YubiKeys themselves is kept, so enabling the organization again
+restores them.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		toggleOrganization(args[0], false)
+	},
+}
+
+// orgsAssignCmd represents the Assign to Organization command
+var orgsAssignCmd = &cobra.Command{
+	Use:   "assign <name>",
+	Short: "Move existing clients and YubiKeys into an organization",
+	Long: `Move the clients given with --clients and the YubiKeys given with --keys into
+an organization. With the name "-" they are moved out of their organization.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if len(assignClients) == 0 && len(assignKeys) == 0 {
+			return fmt.Errorf("at least one of --clients or --keys should be set\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		assignToOrganization(args[0])
+	},
+}
+
+var (
+	orgName       string
+	orgNotes      string
+	assignClients []int
+	assignKeys    []string
+)
+
+func init() {
+	orgsAddCmd.Flags().StringVar(&orgNotes, "notes", "", "set the notes field of the organization")
+	orgsAssignCmd.Flags().IntSliceVar(&assignClients, "clients", nil, "comma separated ids of the clients to move")
+	orgsAssignCmd.Flags().StringSliceVar(&assignKeys, "keys", nil, "comma separated public names of the YubiKeys to move")
+	orgsCmd.AddCommand(orgsAddCmd)
+	orgsCmd.AddCommand(orgsListCmd)
+	orgsCmd.AddCommand(orgsEnableCmd)
+	orgsCmd.AddCommand(orgsDisableCmd)
+	orgsCmd.AddCommand(orgsAssignCmd)
+	rootCmd.AddCommand(orgsCmd)
+}
+
+func addOrganization(name string) {
+	logging.Setup("orgs-add")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	err := database.Store.InsertOrganization(database.Organization{
+		Name:      name,
+		Active:    true,
+		CreatedAt: int32(time.Now().Unix()),
+		Notes:     orgNotes,
+	})
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	log.Info("Created organization ", name)
+	fmt.Println("Created organization", name)
+}
+
+func listOrganizations() {
+	logging.Setup("orgs-list")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	orgs, err := database.Store.GetOrganizations()
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	for _, org := range orgs {
+		state := "active"
+		if !org.Active {
+			state = "disabled"
+		}
+		fmt.Printf("%d\t%s\t%s\t%s\t%s\n",
+			org.Id, state, time.Unix(int64(org.CreatedAt), 0).Format("2006-01-02 15:04:05"), org.Name, org.Notes)
+	}
+}
+
+func toggleOrganization(name string, active bool) {
+	logging.Setup("orgs-toggle")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	orgId, err := lookupOrganization(name)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	err = database.Store.ToggleOrganization(orgId, active)
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	state := "Enabled"
+	if !active {
+		state = "Disabled"
+	}
+	log.Info(state, " organization ", name)
+	fmt.Println(state, "organization", name)
+}
+
+func assignToOrganization(name string) {
+	logging.Setup("orgs-assign")
+	defer logging.File.Close()
+
+	database.Setup()
+	defer database.Close()
+
+	var orgId int32
+	if name != "-" {
+		var err error
+		orgId, err = lookupOrganization(name)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+	}
+
+	for _, clientId := range assignClients {
+		moved, err := database.Store.SetClientOrganization(int32(clientId), orgId)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		if !moved {
+			log.Warn("Unknown client ", clientId)
+			fmt.Println("Unknown client", clientId)
+			continue
+		}
+		log.Info("Moved client ", clientId, " to organization ", name)
+	}
+
+	for _, publicName := range assignKeys {
+		moved, err := database.Store.SetYubiKeyOrganization(publicName, orgId)
+		if err != nil {
+			log.Error(err)
+			fmt.Println(err)
+			return
+		}
+		if !moved {
+			log.Warn("Unknown YubiKey ", publicName)
+			fmt.Println("Unknown YubiKey", publicName)
+			continue
+		}
+		log.Info("Moved YubiKey ", publicName, " to organization ", name)
+	}
+
+	fmt.Println("Successfully assigned clients and YubiKeys to organization", name)
+}
+
+// lookupOrganization gets the id of an organization by its name.
+func lookupOrganization(name string) (int32, error) {
+	org, err := database.Store.GetOrganization(name)
+	if err == sql.ErrNoRows {
+		return 0, fmt.Errorf("unknown organization %s", name)
+	}
+	return org.Id, err
+}
+
+// organizationFilter gets the id of the organization set with --org, or all organizations if it is not set.
+func organizationFilter() (int32, error) {
+	if orgName == "" {
+		return database.ALL_ORGANIZATIONS, nil
+	}
+	return lookupOrganization(orgName)
+}
+
+// organizationOwner gets the id of the organization set with --org, or no organization if it is not set.
+func organizationOwner() (int32, error) {
+	if orgName == "" {
+		return 0, nil
+	}
+	return lookupOrganization(orgName)
+}
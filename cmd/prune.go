@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/retention"
+	"time"
+)
+
+// pruneCmd represents the Prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete audit log, queue and YubiKey history rows past their retention",
+	Long: `Delete the rows of the auth_log, queue and yubikeys_history tables which are
+older than the number of days configured for the table in retention, tables
+without a retention are kept forever. Changes made with the keys commands stay
+queued until they have been sent to the sync pool. Rows are deleted in batches
+of retention.batch_size, so the tables are not locked for long. With --dry-run
+the rows are only counted. serve prunes in the background as well if
+retention.interval is set.`,
+	Run: func(cmd *cobra.Command, args []string) {
+		prune()
+	},
+}
+
+var pruneDryRun bool
+
+func init() {
+	pruneCmd.Flags().BoolVar(&pruneDryRun, "dry-run", false, "only print how many rows would be deleted")
+	rootCmd.AddCommand(pruneCmd)
+}
+
+func prune() {
+	logging.Setup("prune")
+	defer logging.File.Close()
+
+	policies := retention.Policies()
+	if len(policies) == 0 {
+		fmt.Println("No retention configured, nothing to prune")
+		return
+	}
+
+	database.Setup()
+	defer database.Close()
+
+	results, err := retention.Prune(database.Store, policies, time.Now(), retention.BatchSize(), pruneDryRun)
+	retention.LogResults(results, pruneDryRun)
+	for _, r := range results {
+		action := "deleted"
+		if pruneDryRun {
+			action = "would be deleted"
+		}
+		fmt.Printf("%s: %d rows older than %s %s\n",
+			r.Table, r.Rows, r.Before.Format("2006-01-02 15:04:05"), action)
+	}
+	if err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+}
@@ -6,8 +6,16 @@ import (
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/audit"
+	"go-yubikey-val/internal/config"
 	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
 	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/retention"
+	"go-yubikey-val/internal/secrets"
+	"go-yubikey-val/internal/services/ksm"
+	"go-yubikey-val/internal/services/state"
+	"go-yubikey-val/internal/services/sync"
 	"go-yubikey-val/internal/services/validation"
 	"os"
 	"os/signal"
@@ -47,13 +55,41 @@ func serve() {
 	defer logging.File.Close()
 
 	database.Setup()
-	defer database.DB.Close()
-	database.PrepareStatements()
-	defer database.CloseStatements()
+	defer database.Close()
+	database.CheckSchema()
+	audit.Setup()
+	defer audit.Close()
+	retention.Start()
+	defer retention.Stop()
+	sync.Start()
+	defer sync.Stop()
+	if config.Ksm.UsePkcs11 {
+		hsm.Setup()
+		defer hsm.Close()
+	} else if ksm.UsesBuiltin() || config.Ksm.Server.Enabled {
+		secrets.Setup()
+	}
 
 	router := fasthttprouter.New()
 	router.GET("/wsapi/2.0/verify", validation.Verify) // OTP Validation route
+	if config.Ksm.Server.Enabled {
+		router.GET("/wsapi/decrypt", ksm.Decrypt) // YK-KSM compatible decryption route
+		log.Info("YK-KSM decryption route enabled")
+	}
+	if len(config.Sync.AllowedSyncPool) > 0 {
+		router.GET(sync.PATH, sync.Sync) // route receiving the changes made on the servers of the sync pool
+		log.Info("Sync route enabled")
+	}
+	if config.Sync.StateKey != "" {
+		router.GET(state.PATH, state.State) // state comparison route of the sync pool
+		log.Info("State comparison route enabled")
+	}
+
+	listen(router, host, port)
+}
 
+// listen starts a server with the router and blocks until it receives a termination signal.
+func listen(router *fasthttprouter.Router, host string, port int32) {
 	server := fasthttp.Server{
 		Handler: router.Handler,
 	}
@@ -0,0 +1,141 @@
+package cmd
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"go-yubikey-val/internal/client"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/logging"
+	"go-yubikey-val/internal/services/ksm"
+	"go-yubikey-val/internal/utils"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// verifyCmd represents the Verify OTP command
+var verifyCmd = &cobra.Command{
+	Use:   "verify <otp>",
+	Short: "Verify an OTP against one or more validation servers",
+	Long: `Send a signed verification request for an OTP to one or more validation
+servers in parallel, like a client of the Validation Protocol Version 2.0
+does. Each response is checked: its signature has to match the API key of the
+client and the OTP and nonce have to be echoed. The status, the server time
+and the timestamp and counters of the YubiKey are printed for each server. The
+client id, its API key and the URLs are read from the verify section of the
+config file unless they are given with --id, --secret and --url.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return fmt.Errorf("invalid number of args\n")
+		}
+		if !ksm.ValidOtp(strings.ToLower(args[0])) {
+			return fmt.Errorf("the OTP should be 32 to 48 modhex characters\n")
+		}
+		if verifySyncLevel != "" && verifySyncLevel != "fast" && verifySyncLevel != "secure" {
+			level, err := strconv.Atoi(verifySyncLevel)
+			if err != nil || level < 0 || level > 100 {
+				return fmt.Errorf("sl should be fast, secure or a percentage from 0 to 100\n")
+			}
+		}
+		if verifyClientId <= 0 && config.Verify.ClientId <= 0 {
+			return fmt.Errorf("a client id should be set with --id or in the config\n")
+		}
+		if verifySecret == "" && config.Verify.Secret == "" {
+			return fmt.Errorf("the API key of the client should be set with --secret or in the config\n")
+		}
+		if len(verifyUrls) == 0 && len(config.Verify.Urls) == 0 {
+			return fmt.Errorf("at least one --url or URL in the config should be set\n")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		verifyOtp(strings.ToLower(args[0]))
+	},
+}
+
+var (
+	verifyClientId  int32
+	verifySecret    string
+	verifyUrls      []string
+	verifySyncLevel string
+	verifyTimeout   int32
+)
+
+func init() {
+	verifyCmd.Flags().Int32Var(&verifyClientId, "id", 0, "the id of the client")
+	verifyCmd.Flags().StringVar(&verifySecret, "secret", "", "the base64 encoded API key of the client")
+	verifyCmd.Flags().StringArrayVar(&verifyUrls, "url", nil, "the verify URL of a validation server, can be repeated")
+	verifyCmd.Flags().StringVar(&verifySyncLevel, "sl", "", "the sync level: fast, secure or a percentage")
+	verifyCmd.Flags().Int32Var(&verifyTimeout, "timeout", 0, "the timeout of each request in seconds (default 10)")
+	rootCmd.AddCommand(verifyCmd)
+}
+
+func verifyOtp(otp string) {
+	logging.Setup("verify")
+	defer logging.File.Close()
+
+	request := client.Request{
+		Otp:       otp,
+		ClientId:  config.Verify.ClientId,
+		Secret:    config.Verify.Secret,
+		Nonce:     utils.GenerateNonce(),
+		SyncLevel: verifySyncLevel,
+	}
+	if verifyClientId > 0 {
+		request.ClientId = verifyClientId
+	}
+	if verifySecret != "" {
+		request.Secret = verifySecret
+	}
+	urls := config.Verify.Urls
+	if len(verifyUrls) > 0 {
+		urls = verifyUrls
+	}
+	timeout := config.Verify.Timeout
+	if verifyTimeout > 0 {
+		timeout = verifyTimeout
+	}
+	if timeout <= 0 {
+		timeout = 10
+	}
+
+	if _, err := request.Query(); err != nil {
+		log.Error(err)
+		fmt.Println(err)
+		return
+	}
+
+	responses := client.VerifyAll(urls, request, time.Duration(timeout)*time.Second)
+	valid := 0
+	for _, response := range responses {
+		fmt.Println(response.Url)
+		if response.Err != nil {
+			log.Errorf("Failed to verify OTP with %s: %v", response.Url, response.Err)
+			fmt.Println("  error:", response.Err)
+			continue
+		}
+
+		fmt.Println("  status:", response.Status())
+		fmt.Println("  server time:", response.Params["t"])
+		if timestamp, ok := response.Params["timestamp"]; ok {
+			ticks, _ := strconv.Atoi(timestamp)
+			fmt.Printf("  timestamp: %s (%.1f s after the YubiKey was powered up), session counter: %s, session use: %s\n",
+				timestamp, float64(ticks)/8, response.Params["sessioncounter"], response.Params["sessionuse"])
+		}
+		if sl, ok := response.Params["sl"]; ok {
+			fmt.Println("  sync level:", sl+"%")
+		}
+		for _, problem := range response.Problems {
+			fmt.Println("  warning:", problem)
+		}
+		if !response.SignatureValid && len(response.Problems) == 0 {
+			fmt.Println("  the response is not signed, the server rejected the request before identifying the client")
+		}
+		if response.Valid() {
+			valid++
+		}
+		log.Infof("Verified OTP with %s: %s, %d problems", response.Url, response.Params["status"], len(response.Problems))
+	}
+	fmt.Printf("The OTP is valid according to %d of %d servers\n", valid, len(responses))
+}
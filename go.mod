@@ -1,15 +1,19 @@
 module go-yubikey-val
 
-go 1.14
+go 1.16
 
 require (
+	filippo.io/age v1.0.0
 	github.com/conformal/yubikey v0.0.0-20140117205816-65ac3de5ed8f
 	github.com/fasthttp/router v0.7.0
 	github.com/go-sql-driver/mysql v1.5.0
 	github.com/jmoiron/sqlx v1.2.0
+	github.com/lib/pq v1.10.9
+	github.com/miekg/pkcs11 v1.1.1
 	github.com/sirupsen/logrus v1.2.0
 	github.com/spf13/cobra v0.0.6
 	github.com/spf13/viper v1.6.2
 	github.com/stretchr/testify v1.2.2
 	github.com/valyala/fasthttp v1.9.0
+	modernc.org/sqlite v1.21.2
 )
@@ -28,7 +28,9 @@ func init() {
 	}
 }
 
-// RetrieveUrlAsync retrieves from URLs asynchronously.
+// RetrieveUrlAsync retrieves from URLs asynchronously, until ansReq responses match the pattern.
+// Responses which don't match are skipped, so that an error answer of one YK-KSM does not count
+// towards the answers required by the KSM strategies.
 func RetrieveUrlAsync(ident string, urls []string, ansReq int32, pattern string, retUrl bool, timeout int32) []string {
 	reqTimeout := time.Second * time.Duration(timeout)
 	client = &http.Client{
@@ -41,9 +43,9 @@ func RetrieveUrlAsync(ident string, urls []string, ansReq int32, pattern string,
 	var answers []string
 	ch := make(chan *httpResponse, len(urls))
 	for _, url := range urls {
-		go func() {
+		go func(url string) {
 			ch <- httpGet(ctx, url)
-		}()
+		}(url)
 	}
 	for range urls {
 		select {
@@ -53,9 +55,11 @@ func RetrieveUrlAsync(ident string, urls []string, ansReq int32, pattern string,
 				log.Info(ident, "errno/error:", res.err)
 				continue
 			}
-			if match, _ := regexp.Match(pattern, res.body); match {
-				log.Debug(ident, "response matches", pattern)
+			if match, _ := regexp.Match(pattern, res.body); !match {
+				log.Info(ident, " response doesn't match ", pattern, ": ", string(res.body))
+				continue
 			}
+			log.Debug(ident, "response matches", pattern)
 			if retUrl {
 				answers = append(answers, "url="+res.url+"\n"+string(res.body))
 			} else {
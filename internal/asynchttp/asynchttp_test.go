@@ -0,0 +1,36 @@
+package asynchttp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func startServer(body string, delay time.Duration) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(delay)
+		_, _ = io.WriteString(w, body)
+	}))
+}
+
+func TestRetrieveUrlAsync(t *testing.T) {
+	unknown := startServer("ERR Unknown yubikey\n", 0)
+	defer unknown.Close()
+	first := startServer("OK counter=0001\n", 50*time.Millisecond)
+	defer first.Close()
+	second := startServer("OK counter=0002\n", 100*time.Millisecond)
+	defer second.Close()
+
+	// the error answers first, but it does not count as an answer
+	answers := RetrieveUrlAsync("test", []string{unknown.URL, first.URL}, 1, "^OK", false, 1)
+	assert.Equal(t, []string{"OK counter=0001\n"}, answers)
+
+	answers = RetrieveUrlAsync("test", []string{unknown.URL, first.URL, second.URL}, 2, "^OK", true, 1)
+	assert.Equal(t, []string{"url=" + first.URL + "\nOK counter=0001\n", "url=" + second.URL + "\nOK counter=0002\n"}, answers)
+
+	answers = RetrieveUrlAsync("test", []string{unknown.URL, first.URL}, 2, "^OK", false, 1)
+	assert.Nil(t, answers, "not enough answers match")
+}
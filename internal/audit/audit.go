@@ -0,0 +1,109 @@
+package audit
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DEFAULT_BUFFER_SIZE = 10000
+
+	batchSize     = 100
+	flushInterval = time.Second
+)
+
+var (
+	// mutex guards entries, Log holds it for reading so that Close does not close the channel during a send
+	mutex   sync.RWMutex
+	entries chan database.AuthLog
+	done    chan struct{}
+	dropped uint64
+)
+
+// Setup starts writing the audit log in the background, if it is enabled.
+func Setup() {
+	if !config.Audit.Enabled {
+		return
+	}
+	bufferSize := config.Audit.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = DEFAULT_BUFFER_SIZE
+	}
+	Start(database.Store, bufferSize)
+	log.Info("Audit log enabled")
+}
+
+// Start writes the logged entries to the storage in batches, until Close is called.
+func Start(store database.Storage, bufferSize int) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	entries = make(chan database.AuthLog, bufferSize)
+	done = make(chan struct{})
+	go write(store, entries, done)
+}
+
+// Log queues an entry without blocking the request, the entry is dropped if the buffer is full.
+func Log(entry database.AuthLog) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	if entries == nil {
+		return
+	}
+	select {
+	case entries <- entry:
+	default:
+		if atomic.AddUint64(&dropped, 1)%1000 == 1 {
+			log.Warnf("Audit log buffer is full, %d entries have been dropped", atomic.LoadUint64(&dropped))
+		}
+	}
+}
+
+// Close writes the queued entries and stops the writer, entries logged afterwards are ignored.
+func Close() {
+	mutex.Lock()
+	if entries == nil {
+		mutex.Unlock()
+		return
+	}
+	close(entries)
+	entries = nil
+	mutex.Unlock()
+	<-done
+}
+
+func write(store database.Storage, entries <-chan database.AuthLog, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]database.AuthLog, 0, batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := store.InsertAuthLogs(batch); err != nil {
+			log.Errorf("Could not write %d audit log entries: %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case entry, ok := <-entries:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, entry)
+			if len(batch) >= batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
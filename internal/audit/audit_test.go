@@ -0,0 +1,60 @@
+package audit
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-yubikey-val/internal/database"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := database.Open(database.DRIVER_SQLITE, "file:"+filepath.Join(dir, "ykval.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	Log(database.AuthLog{Status: "OK"}) // ignored before Start
+
+	Start(store, 1000)
+	for i := 0; i < 250; i++ {
+		Log(database.AuthLog{LoggedAt: int32(i), ClientId: 1, Status: "OK"})
+	}
+	Close()
+	Log(database.AuthLog{Status: "OK"}) // ignored after Close
+
+	entries, err := store.GetAuthLogs(database.AuthLogFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, entries, 250, "queued entries are written on Close")
+	for _, entry := range entries {
+		assert.Equal(t, int32(1), entry.ClientId)
+	}
+}
+
+func TestCloseWhileLogging(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := database.Open(database.DRIVER_SQLITE, "file:"+filepath.Join(dir, "ykval.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	Start(store, 10)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				Log(database.AuthLog{ClientId: 1, Status: "OK"}) // must not send on the closed buffer
+			}
+		}()
+	}
+	Close()
+	wg.Wait()
+}
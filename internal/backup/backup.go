@@ -0,0 +1,215 @@
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"filippo.io/age"
+	"fmt"
+	"go-yubikey-val/internal/database"
+	"io"
+	"io/ioutil"
+)
+
+const (
+	FORMAT = "ykval-backup"
+
+	// VERSION is the version of the archive layout, the database schema has its own version.
+	VERSION = 1
+)
+
+// ErrCorrupted is returned when an archive can not be decrypted or fails its integrity check.
+var ErrCorrupted = errors.New("backup is corrupted or was not encrypted for this passphrase or identity")
+
+// Archive is the content of a backup, encrypted with age and compressed with gzip. The age payload
+// is authenticated, so any modification of an archive is detected when it is read.
+type Archive struct {
+	Format        string         `json:"format"`
+	Version       int            `json:"version"`
+	SchemaVersion int            `json:"schema_version"`
+	CreatedAt     int32          `json:"created_at"`
+	Organizations []Organization `json:"organizations"`
+	Clients       []Client       `json:"clients"`
+	YubiKeys      []YubiKey      `json:"yubikeys"`
+	Queue         []QueueEntry   `json:"queue"`
+}
+
+type Organization struct {
+	Id        int32  `json:"id"`
+	Name      string `json:"name"`
+	Active    bool   `json:"active"`
+	CreatedAt int32  `json:"created_at"`
+	Notes     string `json:"notes"`
+}
+
+type Client struct {
+	Id                      int32  `json:"id"`
+	Active                  bool   `json:"active"`
+	CreatedAt               int32  `json:"created_at"`
+	Secret                  string `json:"secret"`
+	Email                   string `json:"email"`
+	Notes                   string `json:"notes"`
+	Otp                     string `json:"otp"`
+	OrgId                   int32  `json:"org_id"`
+	PreviousSecret          string `json:"previous_secret"`
+	PreviousSecretExpiresAt int32  `json:"previous_secret_expires_at"`
+}
+
+// YubiKey contains the secrets as stored, so they are encrypted with the master key or wrapped by the
+// PKCS#11 token, which is needed to use them after a restore.
+type YubiKey struct {
+	Active         bool   `json:"active"`
+	CreatedAt      int32  `json:"created_at"`
+	ModifiedAt     int32  `json:"modified_at"`
+	PublicName     string `json:"public_name"`
+	SessionCounter int32  `json:"session_counter"`
+	UseCounter     int32  `json:"use_counter"`
+	TimestampLow   int32  `json:"timestamp_low"`
+	TimestampHigh  int32  `json:"timestamp_high"`
+	Nonce          string `json:"nonce"`
+	Notes          string `json:"notes"`
+	SecretKey      string `json:"secret_key"`
+	PrivateId      string `json:"private_id"`
+	OrgId          int32  `json:"org_id"`
+}
+
+type QueueEntry struct {
+	QueuedAt    int32  `json:"queued_at"`
+	ModifiedAt  int32  `json:"modified_at"`
+	ServerNonce string `json:"server_nonce"`
+	Otp         string `json:"otp"`
+	Server      string `json:"server"`
+	Info        string `json:"info"`
+}
+
+// NewArchive creates the archive of a database snapshot.
+func NewArchive(snapshot database.Snapshot, schemaVersion int, createdAt int32) Archive {
+	archive := Archive{
+		Format:        FORMAT,
+		Version:       VERSION,
+		SchemaVersion: schemaVersion,
+		CreatedAt:     createdAt,
+		Organizations: make([]Organization, 0, len(snapshot.Organizations)),
+		Clients:       make([]Client, 0, len(snapshot.Clients)),
+		YubiKeys:      make([]YubiKey, 0, len(snapshot.YubiKeys)),
+		Queue:         make([]QueueEntry, 0, len(snapshot.Queue)),
+	}
+	for _, o := range snapshot.Organizations {
+		archive.Organizations = append(archive.Organizations, Organization(o))
+	}
+	for _, c := range snapshot.Clients {
+		archive.Clients = append(archive.Clients, Client(c))
+	}
+	for _, y := range snapshot.YubiKeys {
+		archive.YubiKeys = append(archive.YubiKeys, YubiKey(y))
+	}
+	for _, q := range snapshot.Queue {
+		archive.Queue = append(archive.Queue, QueueEntry(q))
+	}
+	return archive
+}
+
+// Snapshot converts the archive back to a database snapshot.
+func (a Archive) Snapshot() database.Snapshot {
+	var snapshot database.Snapshot
+	for _, o := range a.Organizations {
+		snapshot.Organizations = append(snapshot.Organizations, database.Organization(o))
+	}
+	for _, c := range a.Clients {
+		snapshot.Clients = append(snapshot.Clients, database.Client(c))
+	}
+	for _, y := range a.YubiKeys {
+		snapshot.YubiKeys = append(snapshot.YubiKeys, database.YubiKey(y))
+	}
+	for _, q := range a.Queue {
+		snapshot.Queue = append(snapshot.Queue, database.QueueEntry(q))
+	}
+	return snapshot
+}
+
+// Write encrypts the archive to the recipients, a passphrase or age X25519 public keys.
+func Write(w io.Writer, archive Archive, recipients ...age.Recipient) error {
+	encrypted, err := age.Encrypt(w, recipients...)
+	if err != nil {
+		return err
+	}
+	compressed := gzip.NewWriter(encrypted)
+	if err := json.NewEncoder(compressed).Encode(archive); err != nil {
+		return err
+	}
+	if err := compressed.Close(); err != nil {
+		return err
+	}
+	return encrypted.Close()
+}
+
+// Read decrypts an archive with one of the identities and verifies it, the whole archive is
+// authenticated before it is returned.
+func Read(r io.Reader, identities ...age.Identity) (Archive, error) {
+	var archive Archive
+	decrypted, err := age.Decrypt(r, identities...)
+	if err != nil {
+		var noMatch *age.NoIdentityMatchError
+		if errors.As(err, &noMatch) {
+			return archive, ErrCorrupted
+		}
+		return archive, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	// the payload is authenticated in chunks, the last one only when it has been read completely
+	content, err := ioutil.ReadAll(decrypted)
+	if err != nil {
+		return archive, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	compressed, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return archive, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	decoder := json.NewDecoder(compressed)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&archive); err != nil {
+		return archive, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	return archive, archive.Verify()
+}
+
+// Verify checks the format and version of the archive and the consistency of its content.
+func (a Archive) Verify() error {
+	if a.Format != FORMAT {
+		return fmt.Errorf("not a backup, the format is %q", a.Format)
+	}
+	if a.Version < 1 || a.Version > VERSION {
+		return fmt.Errorf("unsupported backup version %d, expected at most %d", a.Version, VERSION)
+	}
+
+	orgs := make(map[int32]bool)
+	for _, o := range a.Organizations {
+		if orgs[o.Id] {
+			return fmt.Errorf("duplicate organization %d", o.Id)
+		}
+		orgs[o.Id] = true
+	}
+	clients := make(map[int32]bool)
+	for _, c := range a.Clients {
+		if clients[c.Id] {
+			return fmt.Errorf("duplicate client %d", c.Id)
+		}
+		if c.OrgId != 0 && !orgs[c.OrgId] {
+			return fmt.Errorf("client %d belongs to the missing organization %d", c.Id, c.OrgId)
+		}
+		clients[c.Id] = true
+	}
+	yubikeys := make(map[string]bool)
+	for _, y := range a.YubiKeys {
+		if yubikeys[y.PublicName] {
+			return fmt.Errorf("duplicate YubiKey %s", y.PublicName)
+		}
+		if y.OrgId != 0 && !orgs[y.OrgId] {
+			return fmt.Errorf("YubiKey %s belongs to the missing organization %d", y.PublicName, y.OrgId)
+		}
+		yubikeys[y.PublicName] = true
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package backup
+
+import (
+	"bytes"
+	"errors"
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-yubikey-val/internal/database"
+	"testing"
+)
+
+var testSnapshot = database.Snapshot{
+	Organizations: []database.Organization{{Id: 3, Name: "acme", Active: true, CreatedAt: 1600000000}},
+	Clients: []database.Client{
+		{Id: 1, Active: true, CreatedAt: 1600000000, Secret: "c2VjcmV0", Email: "test@example.com", OrgId: 3,
+			PreviousSecret: "b2xk", PreviousSecretExpiresAt: 1600086400},
+	},
+	YubiKeys: []database.YubiKey{
+		{Active: true, CreatedAt: 1600000000, ModifiedAt: 1600000100, PublicName: "cccccccccccb", SessionCounter: 2,
+			UseCounter: 5, Nonce: "abcdef", SecretKey: "v1:sealed", PrivateId: "0123456789ab"},
+	},
+	Queue: []database.QueueEntry{{QueuedAt: 1600000100, ServerNonce: "nonce", Server: "https://peer/wsapi/2.0/sync", Info: "action=delete"}},
+}
+
+// scrypt is slow with the default work factor
+func passphrase(t *testing.T, passphrase string) (age.Recipient, age.Identity) {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	require.NoError(t, err)
+	recipient.SetWorkFactor(10)
+	identity, err := age.NewScryptIdentity(passphrase)
+	require.NoError(t, err)
+	return recipient, identity
+}
+
+func TestRoundTrip(t *testing.T) {
+	x25519, err := age.GenerateX25519Identity()
+	require.NoError(t, err)
+	recipient, identity := passphrase(t, "correct horse")
+
+	var tests = []struct {
+		recipient age.Recipient
+		identity  age.Identity
+	}{
+		{recipient, identity},
+		{x25519.Recipient(), x25519},
+	}
+
+	for _, test := range tests {
+		var out bytes.Buffer
+		require.NoError(t, Write(&out, NewArchive(testSnapshot, 6, 1600000200), test.recipient))
+		assert.NotContains(t, out.String(), "c2VjcmV0")
+
+		archive, err := Read(&out, test.identity)
+		assert.NoError(t, err)
+		assert.Equal(t, 6, archive.SchemaVersion)
+		assert.Equal(t, testSnapshot, archive.Snapshot())
+	}
+}
+
+func TestReadCorrupted(t *testing.T) {
+	recipient, identity := passphrase(t, "correct horse")
+	_, wrong := passphrase(t, "wrong horse")
+	var out bytes.Buffer
+	require.NoError(t, Write(&out, NewArchive(testSnapshot, 6, 1600000200), recipient))
+	archive := out.Bytes()
+
+	_, err := Read(bytes.NewReader(archive), wrong)
+	assert.True(t, errors.Is(err, ErrCorrupted), "wrong passphrase")
+
+	tampered := append([]byte{}, archive...)
+	tampered[len(tampered)-20] ^= 1
+	_, err = Read(bytes.NewReader(tampered), identity)
+	assert.True(t, errors.Is(err, ErrCorrupted), "modified payload")
+
+	_, err = Read(bytes.NewReader(archive[:len(archive)-1]), identity)
+	assert.True(t, errors.Is(err, ErrCorrupted), "truncated payload")
+
+	_, err = Read(bytes.NewReader([]byte("not a backup")), identity)
+	assert.True(t, errors.Is(err, ErrCorrupted), "not encrypted")
+}
+
+func TestVerify(t *testing.T) {
+	var tests = []struct {
+		modify   func(a *Archive)
+		expected string
+	}{
+		{func(a *Archive) {}, ""},
+		{func(a *Archive) { a.Format = "ykval-keys" }, `not a backup, the format is "ykval-keys"`},
+		{func(a *Archive) { a.Version = 2 }, "unsupported backup version 2, expected at most 1"},
+		{func(a *Archive) { a.Clients = append(a.Clients, a.Clients[0]) }, "duplicate client 1"},
+		{func(a *Archive) { a.YubiKeys = append(a.YubiKeys, a.YubiKeys[0]) }, "duplicate YubiKey cccccccccccb"},
+		{func(a *Archive) { a.Organizations = nil }, "client 1 belongs to the missing organization 3"},
+		{func(a *Archive) { a.YubiKeys[0].OrgId = 4 }, "YubiKey cccccccccccb belongs to the missing organization 4"},
+	}
+
+	for _, test := range tests {
+		archive := NewArchive(testSnapshot, 6, 1600000200)
+		test.modify(&archive)
+		err := archive.Verify()
+		if test.expected == "" {
+			assert.NoError(t, err)
+		} else {
+			assert.EqualError(t, err, test.expected)
+		}
+	}
+}
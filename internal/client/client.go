@@ -0,0 +1,191 @@
+package client
+
+import (
+	"encoding/base64"
+	"fmt"
+	"go-yubikey-val/internal/services/validation"
+	"go-yubikey-val/internal/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusDescriptions explain the statuses of the Validation Protocol Version 2.0.
+var statusDescriptions = map[string]string{
+	validation.S_OK:                    "the OTP is valid",
+	validation.S_BAD_OTP:               "the OTP is invalid",
+	validation.S_REPLAYED_OTP:          "the OTP has already been seen by the server",
+	validation.S_DELAYED_OTP:           "the OTP was delayed",
+	validation.S_BAD_SIGNATURE:         "the signature of the request is wrong",
+	validation.S_MISSING_PARAMETER:     "the request lacks a parameter or has an invalid one",
+	validation.S_NO_SUCH_CLIENT:        "the client id does not exist",
+	validation.S_OPERATION_NOT_ALLOWED: "the client is not allowed to verify OTPs",
+	validation.S_BACKEND_ERROR:         "unexpected error in the server",
+	validation.S_NOT_ENOUGH_ANSWERS:    "the server could not get the requested number of syncs before the timeout",
+	validation.S_REPLAYED_REQUEST:      "the server has seen the OTP and nonce combination before",
+}
+
+// Request is a verification request of a client, Secret is its base64 encoded API key.
+type Request struct {
+	Otp       string
+	ClientId  int32
+	Secret    string
+	Nonce     string
+	SyncLevel string
+}
+
+// Response is the answer of a server. SignatureValid tells whether it is signed with the API key of
+// the client, Problems lists why it can not be trusted.
+type Response struct {
+	Url            string
+	Params         map[string]string
+	SignatureValid bool
+	Problems       []string
+	Err            error
+}
+
+// Query returns the signed query string of the request, the timestamps and counters of the YubiKey
+// are always requested.
+func (r Request) Query() (string, error) {
+	apiKey, err := base64.StdEncoding.DecodeString(r.Secret)
+	if err != nil {
+		return "", fmt.Errorf("invalid client secret: %v", err)
+	}
+	params := []string{
+		"id=" + strconv.Itoa(int(r.ClientId)),
+		"nonce=" + r.Nonce,
+		"otp=" + r.Otp,
+		"timestamp=1",
+	}
+	if r.SyncLevel != "" {
+		params = append(params, "sl="+r.SyncLevel)
+	}
+	h := utils.Sign(params, string(apiKey))
+
+	values := url.Values{"h": {h}}
+	for _, param := range params {
+		pair := strings.SplitN(param, "=", 2)
+		values.Set(pair[0], pair[1])
+	}
+	return values.Encode(), nil
+}
+
+// VerifyAll sends the request to all URLs in parallel, the responses are in the order of the URLs.
+func VerifyAll(urls []string, request Request, timeout time.Duration) []Response {
+	responses := make([]Response, len(urls))
+	var wg sync.WaitGroup
+	for i, u := range urls {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			responses[i] = Verify(u, request, timeout)
+		}(i, u)
+	}
+	wg.Wait()
+	return responses
+}
+
+// Verify sends the request to the URL and checks the signature of the response and that the OTP
+// and the nonce are echoed.
+func Verify(u string, request Request, timeout time.Duration) Response {
+	response := Response{Url: u}
+	query, err := request.Query()
+	if err != nil {
+		response.Err = err
+		return response
+	}
+
+	httpClient := &http.Client{Timeout: timeout}
+	resp, err := httpClient.Get(u + "?" + query)
+	if err != nil {
+		// the error of the request repeats the whole signed URL
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		response.Err = err
+		return response
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		response.Err = err
+		return response
+	}
+	if resp.StatusCode != http.StatusOK {
+		response.Err = fmt.Errorf("server answered %s", resp.Status)
+		return response
+	}
+
+	response.Params, err = Parse(string(body))
+	if err != nil {
+		response.Err = err
+		return response
+	}
+	response.check(request)
+	return response
+}
+
+// Parse reads the key=value lines of a response.
+func Parse(body string) (map[string]string, error) {
+	params := make(map[string]string)
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line == "" {
+			continue
+		}
+		pair := strings.SplitN(line, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("invalid response line %q", line)
+		}
+		params[pair[0]] = pair[1]
+	}
+	if params["status"] == "" {
+		return nil, fmt.Errorf("response has no status")
+	}
+	return params, nil
+}
+
+// Status returns the status of the response with its description.
+func (r Response) Status() string {
+	status := r.Params["status"]
+	if description, ok := statusDescriptions[status]; ok {
+		return status + " (" + description + ")"
+	}
+	return status
+}
+
+// Valid tells whether the OTP is valid according to a trusted response.
+func (r Response) Valid() bool {
+	return r.Err == nil && len(r.Problems) == 0 && r.Params["status"] == validation.S_OK
+}
+
+// check verifies the signature of the response and the echoed OTP and nonce, the server can only
+// sign with the API key of a client it knows, so errors about the request itself are not signed,
+// nor is a backend error raised while looking up the client, which is signed with an empty key.
+func (r *Response) check(request Request) {
+	apiKey, _ := base64.StdEncoding.DecodeString(request.Secret)
+	params := make([]string, 0, len(r.Params))
+	for key, value := range r.Params {
+		if key != "h" {
+			params = append(params, key+"="+value)
+		}
+	}
+	r.SignatureValid = r.Params["h"] != "" && utils.Sign(params, string(apiKey)) == r.Params["h"]
+
+	status := r.Params["status"]
+	unsigned := status == validation.S_MISSING_PARAMETER || status == validation.S_NO_SUCH_CLIENT ||
+		(status == validation.S_BACKEND_ERROR && utils.Sign(params, "") == r.Params["h"])
+	if !r.SignatureValid && !unsigned {
+		r.Problems = append(r.Problems, "the response signature does not match")
+	}
+	if nonce, ok := r.Params["nonce"]; (ok || status == validation.S_OK) && nonce != request.Nonce {
+		r.Problems = append(r.Problems, "the nonce is not echoed")
+	}
+	if otp, ok := r.Params["otp"]; (ok || status == validation.S_OK) && otp != request.Otp {
+		r.Problems = append(r.Problems, "the OTP is not echoed")
+	}
+}
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-yubikey-val/internal/utils"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testOtp   = "vvcccccccccbcbevjvdifndbljhrlljurbfgglnfjcfu"
+	testNonce = "0123456789abcdef0123"
+	// base64 of "secret"
+	testSecret = "c2VjcmV0"
+)
+
+// startMockServer answers with the response lines, signed with the key unless it is empty.
+func startMockServer(t *testing.T, key string, lines ...string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		params := []string{"id=" + query.Get("id"), "nonce=" + query.Get("nonce"), "otp=" + query.Get("otp"), "timestamp=" + query.Get("timestamp")}
+		assert.Equal(t, utils.Sign(params, "secret"), query.Get("h"), "the request is signed")
+
+		h := utils.Sign(append([]string{}, lines...), key)
+		_, _ = io.WriteString(w, "h="+h+"\r\n"+strings.Join(lines, "\r\n")+"\r\n\r\n")
+	}))
+}
+
+func TestQuery(t *testing.T) {
+	query, err := Request{Otp: testOtp, ClientId: 1, Secret: testSecret, Nonce: testNonce, SyncLevel: "secure"}.Query()
+	require.NoError(t, err)
+	values, err := url.ParseQuery(query)
+	require.NoError(t, err)
+	assert.Equal(t, "secure", values.Get("sl"))
+	assert.Equal(t, "1", values.Get("timestamp"))
+	assert.Equal(t, utils.Sign([]string{"id=1", "nonce=" + testNonce, "otp=" + testOtp, "sl=secure", "timestamp=1"}, "secret"), values.Get("h"))
+
+	_, err = Request{Otp: testOtp, ClientId: 1, Secret: "not base64"}.Query()
+	assert.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	request := Request{Otp: testOtp, ClientId: 1, Secret: testSecret, Nonce: testNonce}
+	var tests = []struct {
+		key      string
+		lines    []string
+		valid    bool
+		problems []string
+	}{
+		{"secret", []string{"status=OK", "t=2026-10-19T06:00:00Z0123", "otp=" + testOtp, "nonce=" + testNonce, "sl=25", "timestamp=8970147", "sessioncounter=1", "sessionuse=4"},
+			true, nil},
+		{"other", []string{"status=OK", "t=2026-10-19T06:00:00Z0123", "otp=" + testOtp, "nonce=" + testNonce},
+			false, []string{"the response signature does not match"}},
+		{"secret", []string{"status=OK", "t=2026-10-19T06:00:00Z0123", "otp=" + testOtp, "nonce=other"},
+			false, []string{"the nonce is not echoed"}},
+		{"secret", []string{"status=OK", "t=2026-10-19T06:00:00Z0123"},
+			false, []string{"the nonce is not echoed", "the OTP is not echoed"}},
+		{"secret", []string{"status=REPLAYED_OTP", "t=2026-10-19T06:00:00Z0123", "otp=" + testOtp, "nonce=" + testNonce},
+			false, nil},
+		{"", []string{"status=NO_SUCH_CLIENT", "t=2026-10-19T06:00:00Z0123"},
+			false, nil},
+		{"", []string{"status=BACKEND_ERROR", "t=2026-10-19T06:00:00Z0123"},
+			false, nil},
+		{"other", []string{"status=BACKEND_ERROR", "t=2026-10-19T06:00:00Z0123"},
+			false, []string{"the response signature does not match"}},
+	}
+
+	for _, test := range tests {
+		server := startMockServer(t, test.key, test.lines...)
+		responses := VerifyAll([]string{server.URL, server.URL}, request, time.Second)
+		server.Close()
+
+		require.Len(t, responses, 2)
+		response := responses[0]
+		assert.NoError(t, response.Err)
+		assert.Equal(t, test.valid, response.Valid(), test.lines[0])
+		assert.Equal(t, test.problems, response.Problems, test.lines[0])
+	}
+
+	response := Verify("http://127.0.0.1:1/wsapi/2.0/verify", request, time.Second)
+	assert.Error(t, response.Err)
+}
+
+func TestParse(t *testing.T) {
+	params, err := Parse("h=abc=\r\nt=2026-10-19T06:00:00Z0123\r\nstatus=OK\r\n\r\n")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"h": "abc=", "t": "2026-10-19T06:00:00Z0123", "status": "OK"}, params)
+	assert.Equal(t, "OK (the OTP is valid)", Response{Params: params}.Status())
+
+	_, err = Parse("<html>Not Found</html>")
+	assert.EqualError(t, err, `invalid response line "<html>Not Found</html>"`)
+	_, err = Parse("t=2026-10-19T06:00:00Z0123\r\n")
+	assert.EqualError(t, err, "response has no status")
+}
@@ -1,21 +1,29 @@
 package config
 
 import (
+	"fmt"
 	"github.com/spf13/viper"
+	"regexp"
 )
 
 var (
-	Logging loggingConfig
-	DB      databaseConfig
-	Ksm     ksmConfig
-	Sync    syncConfig
+	Logging   loggingConfig
+	DB        databaseConfig
+	Ksm       ksmConfig
+	Sync      syncConfig
+	Audit     auditConfig
+	Retention retentionConfig
+	Verify    verifyConfig
 )
 
 type configuration struct {
-	Logging  loggingConfig
-	Database databaseConfig
-	Ksm      ksmConfig
-	Sync     syncConfig
+	Logging   loggingConfig
+	Database  databaseConfig
+	Ksm       ksmConfig
+	Sync      syncConfig
+	Audit     auditConfig
+	Retention retentionConfig
+	Verify    verifyConfig
 }
 
 type loggingConfig struct {
@@ -24,18 +32,95 @@ type loggingConfig struct {
 }
 
 type databaseConfig struct {
+	Driver             string
+	Path               string
 	Host               string
 	Port               string
 	Name               string
 	Username           string
 	Password           string
-	MaxIdleConnections int `mapstructure:"max_idle_connections"`
-	MaxOpenConnections int `mapstructure:"max_open_connections"`
+	SslMode            string `mapstructure:"ssl_mode"`
+	MaxIdleConnections int    `mapstructure:"max_idle_connections"`
+	MaxOpenConnections int    `mapstructure:"max_open_connections"`
 }
 
 type ksmConfig struct {
-	UseBuiltin bool `mapstructure:"use_builtin"`
-	Urls       []string
+	UseBuiltin    bool   `mapstructure:"use_builtin"`
+	UsePkcs11     bool   `mapstructure:"use_pkcs11"`
+	MasterKeyFile string `mapstructure:"master_key_file"`
+	Urls          []string
+	Strategy      string
+	Timeout       int32
+	Quorum        int32
+	Routes        []KsmRoute
+	Pkcs11        pkcs11Config
+	Server        ksmServerConfig
+}
+
+// KsmRoute routes OTPs matching all of its non-empty conditions to its YK-KSM URLs or to the built-in KSM.
+// PublicIdPattern is PublicIdRegex compiled by CompileKsmRoutes.
+type KsmRoute struct {
+	ClientIds       []int32        `mapstructure:"client_ids"`
+	PublicIdPrefix  string         `mapstructure:"public_id_prefix"`
+	PublicIdRegex   string         `mapstructure:"public_id_regex"`
+	PublicIdPattern *regexp.Regexp `mapstructure:"-"`
+	Urls            []string
+	Builtin         bool
+}
+
+// CompileKsmRoutes compiles the public id regexes of the routes and checks that every route leads
+// to a KSM, so that a broken route is reported when the config is loaded instead of on a request.
+func CompileKsmRoutes(routes []KsmRoute) error {
+	for i := range routes {
+		route := &routes[i]
+		if !route.Builtin && len(route.Urls) == 0 {
+			return fmt.Errorf("KSM route %d has neither urls nor builtin set", i+1)
+		}
+		if route.PublicIdRegex == "" {
+			continue
+		}
+		pattern, err := regexp.Compile(route.PublicIdRegex)
+		if err != nil {
+			return fmt.Errorf("invalid public_id_regex of KSM route %d: %v", i+1, err)
+		}
+		route.PublicIdPattern = pattern
+	}
+	return nil
+}
+
+type pkcs11Config struct {
+	Module           string
+	TokenLabel       string `mapstructure:"token_label"`
+	Pin              string
+	WrappingKeyLabel string `mapstructure:"wrapping_key_label"`
+	Sessions         int
+}
+
+type ksmServerConfig struct {
+	Enabled            bool
+	AllowedIpAddresses []string `mapstructure:"allowed_ip_addresses"`
+}
+
+type auditConfig struct {
+	Enabled    bool
+	BufferSize int `mapstructure:"buffer_size"`
+}
+
+// retentionConfig has the number of days rows are kept for each table, 0 keeps them forever.
+type retentionConfig struct {
+	AuthLog         int `mapstructure:"auth_log"`
+	Queue           int
+	YubiKeysHistory int `mapstructure:"yubikeys_history"`
+	BatchSize       int `mapstructure:"batch_size"`
+	Interval        int
+}
+
+// verifyConfig is the client used by the verify command when none is given on the command line.
+type verifyConfig struct {
+	ClientId int32 `mapstructure:"client_id"`
+	Secret   string
+	Urls     []string
+	Timeout  int32
 }
 
 type syncConfig struct {
@@ -49,6 +134,7 @@ type syncConfig struct {
 	SecureLevel       int32
 	DefaultLevel      int32
 	DefaultTimeout    int32
+	StateKey          string
 }
 
 func Load() {
@@ -58,8 +144,15 @@ func Load() {
 		panic(err)
 	}
 
+	if err := CompileKsmRoutes(conf.Ksm.Routes); err != nil {
+		panic(err)
+	}
+
 	Logging = conf.Logging
 	DB = conf.Database
 	Ksm = conf.Ksm
 	Sync = conf.Sync
+	Audit = conf.Audit
+	Retention = conf.Retention
+	Verify = conf.Verify
 }
@@ -0,0 +1,267 @@
+package database
+
+import (
+	"database/sql"
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"strconv"
+)
+
+// How an import treats clients and YubiKeys which already exist.
+const (
+	IMPORT_INSERT_ONLY     = "insert-only"
+	IMPORT_UPDATE_IF_NEWER = "update-if-newer"
+	IMPORT_OVERWRITE       = "overwrite"
+)
+
+// What an import does with a record.
+const (
+	IMPORT_ACTION_INSERT = "insert"
+	IMPORT_ACTION_UPDATE = "update"
+	IMPORT_ACTION_SKIP   = "skip"
+)
+
+// ImportOptions controls an import. Existing clients and YubiKeys are only changed if they belong to
+// Organization, unless it is ALL_ORGANIZATIONS. Each batch of BatchSize records is imported in its
+// own transaction, or all records in one if it is 0. A DryRun decides the actions without writing.
+// SecretsOnly imports YubiKeys without counters: only the secrets of existing YubiKeys are changed.
+type ImportOptions struct {
+	Mode         string
+	Organization int32
+	BatchSize    int
+	DryRun       bool
+	SecretsOnly  bool
+}
+
+// ImportChange is the action taken for an imported record, Changes lists the changed columns of
+// an update and Reason explains a skip. Secrets are never part of Changes, only whether they changed.
+type ImportChange struct {
+	Target  string
+	Action  string
+	Changes []string
+	Reason  string
+}
+
+// ImportError is the error of the record at Index, the records of the batches before it have been imported.
+type ImportError struct {
+	Index     int
+	Target    string
+	Committed int
+	Err       error
+}
+
+func (e *ImportError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Target, e.Err)
+}
+
+// ValidImportMode checks whether the mode is one of insert-only, update-if-newer or overwrite.
+func ValidImportMode(mode string) bool {
+	return mode == IMPORT_INSERT_ONLY || mode == IMPORT_UPDATE_IF_NEWER || mode == IMPORT_OVERWRITE
+}
+
+// ImportYubiKeys inserts new YubiKeys and updates existing ones as the mode allows: never when inserting
+// only, when the counters are higher if updating if newer, or always when overwriting. The secrets of
+// a YubiKey are only replaced if the imported YubiKey has one, its organization is kept. Without
+// counters, updating if newer only sets the secrets of YubiKeys which have none, the stored counters
+// are always kept so that OTPs can not be replayed.
+func (s *sqlStorage) ImportYubiKeys(yubikeys []YubiKey, options ImportOptions) ([]ImportChange, error) {
+	return s.importBatches(len(yubikeys), options, func(tx *sqlx.Tx, i int) (ImportChange, error) {
+		yubikey := yubikeys[i]
+		change := ImportChange{Target: yubikey.PublicName}
+
+		var existing YubiKey
+		err := tx.Get(&existing, tx.Rebind(`SELECT * FROM yubikeys WHERE public_name=? LIMIT 1`), yubikey.PublicName)
+		if err == sql.ErrNoRows {
+			change.Action = IMPORT_ACTION_INSERT
+			if options.DryRun {
+				return change, nil
+			}
+			_, err = tx.NamedExec(`INSERT INTO yubikeys (public_name, active, created_at, modified_at, session_counter, use_counter, timestamp_low, timestamp_high, nonce, notes, secret_key, private_id, org_id) VALUES (:public_name, :active, :created_at, :modified_at, :session_counter, :use_counter, :timestamp_low, :timestamp_high, :nonce, :notes, :secret_key, :private_id, :org_id)`, yubikey)
+			return change, err
+		}
+		if err != nil {
+			return change, err
+		}
+		if options.Organization != ALL_ORGANIZATIONS && existing.OrgId != options.Organization {
+			return change, fmt.Errorf("YubiKey belongs to another organization")
+		}
+
+		newer := yubikey.SessionCounter > existing.SessionCounter ||
+			(yubikey.SessionCounter == existing.SessionCounter && yubikey.UseCounter > existing.UseCounter)
+		switch {
+		case options.Mode == IMPORT_INSERT_ONLY:
+			return skip(change, "already exists"), nil
+		case options.SecretsOnly && options.Mode == IMPORT_UPDATE_IF_NEWER && existing.SecretKey != "":
+			return skip(change, "already has a secret"), nil
+		case !options.SecretsOnly && options.Mode == IMPORT_UPDATE_IF_NEWER && !newer:
+			return skip(change, "counters are not higher than the stored ones"), nil
+		}
+
+		if options.SecretsOnly {
+			secretKey, privateId := yubikey.SecretKey, yubikey.PrivateId
+			yubikey = existing
+			yubikey.SecretKey, yubikey.PrivateId = secretKey, privateId
+		}
+
+		if yubikey.SecretKey == "" {
+			yubikey.SecretKey, yubikey.PrivateId = existing.SecretKey, existing.PrivateId
+		} else if yubikey.PrivateId == "" {
+			yubikey.PrivateId = existing.PrivateId
+		}
+		change.Changes = diffYubiKeys(existing, yubikey)
+		if len(change.Changes) == 0 {
+			return skip(change, "unchanged"), nil
+		}
+		change.Action = IMPORT_ACTION_UPDATE
+		if options.DryRun {
+			return change, nil
+		}
+		_, err = tx.NamedExec(`UPDATE yubikeys SET active=:active, created_at=:created_at, modified_at=:modified_at, session_counter=:session_counter, use_counter=:use_counter, timestamp_low=:timestamp_low, timestamp_high=:timestamp_high, nonce=:nonce, notes=:notes, secret_key=:secret_key, private_id=:private_id WHERE public_name=:public_name`, yubikey)
+		return change, err
+	})
+}
+
+// ImportClients inserts new clients, existing clients are skipped unless overwriting. An overwritten
+// secret replaces the previous secret of a rotation as well, the organization is kept.
+func (s *sqlStorage) ImportClients(clients []Client, options ImportOptions) ([]ImportChange, error) {
+	if options.Mode == IMPORT_UPDATE_IF_NEWER {
+		return nil, fmt.Errorf("clients can not be updated if newer, they have no counters")
+	}
+
+	return s.importBatches(len(clients), options, func(tx *sqlx.Tx, i int) (ImportChange, error) {
+		client := clients[i]
+		change := ImportChange{Target: strconv.Itoa(int(client.Id))}
+
+		var existing Client
+		err := tx.Get(&existing, tx.Rebind(`SELECT id, active, created_at, secret, email, notes, otp, org_id, previous_secret, previous_secret_expires_at FROM clients WHERE id=?`), client.Id)
+		if err == sql.ErrNoRows {
+			change.Action = IMPORT_ACTION_INSERT
+			if options.DryRun {
+				return change, nil
+			}
+			_, err = tx.NamedExec(`INSERT INTO clients (id, active, created_at, secret, email, notes, otp, org_id) VALUES (:id, :active, :created_at, :secret, :email, :notes, :otp, :org_id)`, client)
+			return change, err
+		}
+		if err != nil {
+			return change, err
+		}
+		if options.Organization != ALL_ORGANIZATIONS && existing.OrgId != options.Organization {
+			return change, fmt.Errorf("client belongs to another organization")
+		}
+		if options.Mode == IMPORT_INSERT_ONLY {
+			return skip(change, "already exists"), nil
+		}
+
+		client.PreviousSecret, client.PreviousSecretExpiresAt = existing.PreviousSecret, existing.PreviousSecretExpiresAt
+		if client.Secret != existing.Secret {
+			client.PreviousSecret, client.PreviousSecretExpiresAt = "", 0
+		}
+		change.Changes = diffClients(existing, client)
+		if len(change.Changes) == 0 {
+			return skip(change, "unchanged"), nil
+		}
+		change.Action = IMPORT_ACTION_UPDATE
+		if options.DryRun {
+			return change, nil
+		}
+		_, err = tx.NamedExec(`UPDATE clients SET active=:active, created_at=:created_at, secret=:secret, email=:email, notes=:notes, otp=:otp, previous_secret=:previous_secret, previous_secret_expires_at=:previous_secret_expires_at WHERE id=:id`, client)
+		return change, err
+	})
+}
+
+// importBatches imports the records in batches, each in its own transaction. A dry run rolls
+// every transaction back.
+func (s *sqlStorage) importBatches(count int, options ImportOptions, importRecord func(tx *sqlx.Tx, i int) (ImportChange, error)) ([]ImportChange, error) {
+	batchSize := options.BatchSize
+	if batchSize <= 0 {
+		batchSize = count
+	}
+
+	changes := make([]ImportChange, 0, count)
+	for start := 0; start < count; start += batchSize {
+		end := start + batchSize
+		if end > count {
+			end = count
+		}
+		batch, err := s.importBatch(start, end, options.DryRun, importRecord)
+		if err != nil {
+			return changes, err
+		}
+		changes = append(changes, batch...)
+	}
+	return changes, nil
+}
+
+func (s *sqlStorage) importBatch(start int, end int, dryRun bool, importRecord func(tx *sqlx.Tx, i int) (ImportChange, error)) ([]ImportChange, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	batch := make([]ImportChange, 0, end-start)
+	for i := start; i < end; i++ {
+		change, err := importRecord(tx, i)
+		if err != nil {
+			return nil, &ImportError{Index: i, Target: change.Target, Committed: start, Err: err}
+		}
+		batch = append(batch, change)
+	}
+
+	if dryRun {
+		return batch, nil
+	}
+	return batch, tx.Commit()
+}
+
+func skip(change ImportChange, reason string) ImportChange {
+	change.Action = IMPORT_ACTION_SKIP
+	change.Reason = reason
+	return change
+}
+
+func diffYubiKeys(old YubiKey, new YubiKey) []string {
+	var changes []string
+	changes = diffField(changes, "active", old.Active, new.Active)
+	changes = diffField(changes, "created_at", old.CreatedAt, new.CreatedAt)
+	changes = diffField(changes, "modified_at", old.ModifiedAt, new.ModifiedAt)
+	changes = diffField(changes, "session_counter", old.SessionCounter, new.SessionCounter)
+	changes = diffField(changes, "use_counter", old.UseCounter, new.UseCounter)
+	changes = diffField(changes, "timestamp_low", old.TimestampLow, new.TimestampLow)
+	changes = diffField(changes, "timestamp_high", old.TimestampHigh, new.TimestampHigh)
+	changes = diffField(changes, "nonce", old.Nonce, new.Nonce)
+	changes = diffField(changes, "notes", old.Notes, new.Notes)
+	changes = diffSecret(changes, "secret_key", old.SecretKey, new.SecretKey)
+	changes = diffSecret(changes, "private_id", old.PrivateId, new.PrivateId)
+	return changes
+}
+
+func diffClients(old Client, new Client) []string {
+	var changes []string
+	changes = diffField(changes, "active", old.Active, new.Active)
+	changes = diffField(changes, "created_at", old.CreatedAt, new.CreatedAt)
+	changes = diffSecret(changes, "secret", old.Secret, new.Secret)
+	changes = diffField(changes, "email", old.Email, new.Email)
+	changes = diffField(changes, "notes", old.Notes, new.Notes)
+	changes = diffField(changes, "otp", old.Otp, new.Otp)
+	changes = diffSecret(changes, "previous_secret", old.PreviousSecret, new.PreviousSecret)
+	return changes
+}
+
+func diffField(changes []string, name string, old interface{}, new interface{}) []string {
+	if old == new {
+		return changes
+	}
+	if _, ok := old.(string); ok {
+		return append(changes, fmt.Sprintf("%s %q -> %q", name, old, new))
+	}
+	return append(changes, fmt.Sprintf("%s %v -> %v", name, old, new))
+}
+
+// diffSecret only tells whether a secret changed, without its values.
+func diffSecret(changes []string, name string, old string, new string) []string {
+	if old == new {
+		return changes
+	}
+	return append(changes, name+" changed")
+}
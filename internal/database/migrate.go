@@ -0,0 +1,244 @@
+package database
+
+import (
+	"embed"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go-yubikey-val/internal/config"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Migration changes the schema from the previous version to its version and back,
+// its SQL is embedded from migrations/<driver>/<version>_<name>.up.sql and .down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+//go:embed migrations
+var migrationFiles embed.FS
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// Migrations gets the embedded migrations of the driver, ordered by version.
+func Migrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for database driver %s", driver)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		matches := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if matches == nil {
+			continue
+		}
+		version, _ := strconv.Atoi(matches[1])
+		content, err := migrationFiles.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: matches[2]}
+			byVersion[version] = m
+		}
+		if matches[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration %d of %s is missing", i+1, driver)
+		}
+	}
+
+	return migrations, nil
+}
+
+// LatestVersion gets the schema version the embedded migrations of the driver lead to.
+func LatestVersion(driver string) (int, error) {
+	migrations, err := Migrations(driver)
+	if err != nil {
+		return 0, err
+	}
+	return len(migrations), nil
+}
+
+// CheckSchema refuses to run against a database whose schema is older than the embedded migrations.
+func CheckSchema() {
+	version, err := Store.SchemaVersion()
+	if err != nil {
+		log.Fatal("Could not get database schema version: ", err)
+	}
+	latest, err := LatestVersion(config.DB.Driver)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if version < latest {
+		log.Fatalf("Database schema is at version %d, but version %d is required, please run migrate up", version, latest)
+	}
+	if version > latest {
+		log.Warnf("Database schema is at version %d, which is newer than the latest known version %d", version, latest)
+	}
+}
+
+// splitStatements splits a migration into its statements, so drivers which
+// only execute a single statement at once can run it as well.
+func splitStatements(script string) []string {
+	var lines []string
+	for _, line := range strings.Split(script, "\n") {
+		if !strings.HasPrefix(strings.TrimSpace(line), "--") {
+			lines = append(lines, line)
+		}
+	}
+
+	var statements []string
+	for _, statement := range strings.Split(strings.Join(lines, "\n"), ";") {
+		statement = strings.TrimSpace(statement)
+		if statement != "" {
+			statements = append(statements, statement)
+		}
+	}
+	return statements
+}
+
+const createSchemaVersionTable = `CREATE TABLE IF NOT EXISTS schema_version (version INT NOT NULL, applied_at INT NOT NULL, PRIMARY KEY (version))`
+
+// AppliedMigrations gets the versions of the applied migrations and when they have been applied.
+func (s *sqlStorage) AppliedMigrations() (map[int]int32, error) {
+	applied := map[int]int32{}
+	exists, err := s.tableExists("schema_version")
+	if err != nil || !exists {
+		return applied, err
+	}
+
+	var rows []struct {
+		Version   int   `db:"version"`
+		AppliedAt int32 `db:"applied_at"`
+	}
+	err = s.db.Select(&rows, `SELECT version, applied_at FROM schema_version`)
+	if err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		applied[row.Version] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+// SchemaVersion gets the version of the latest applied migration, 0 for an empty database.
+func (s *sqlStorage) SchemaVersion() (int, error) {
+	applied, err := s.AppliedMigrations()
+	if err != nil {
+		return 0, err
+	}
+	var version int
+	for v := range applied {
+		if v > version {
+			version = v
+		}
+	}
+	return version, nil
+}
+
+// Migrate applies or reverts migrations until the schema is at the version, it returns the migrations run.
+// Each migration runs in its own transaction, but MySQL commits schema changes right away,
+// so a failed MySQL migration may have to be cleaned up by hand.
+func (s *sqlStorage) Migrate(version int) ([]Migration, error) {
+	migrations, err := Migrations(s.db.DriverName())
+	if err != nil {
+		return nil, err
+	}
+	if version < 0 || version > len(migrations) {
+		return nil, fmt.Errorf("unknown schema version %d, the latest version is %d", version, len(migrations))
+	}
+
+	_, err = s.db.Exec(createSchemaVersionTable)
+	if err != nil {
+		return nil, err
+	}
+	current, err := s.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	var run []Migration
+	for current < version {
+		m := migrations[current]
+		err = s.runMigration(m.Up, `INSERT INTO schema_version (version, applied_at) VALUES (?, ?)`, m.Version, int32(time.Now().Unix()))
+		if err != nil {
+			return run, fmt.Errorf("migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		run = append(run, m)
+		current++
+	}
+	for current > version {
+		m := migrations[current-1]
+		err = s.runMigration(m.Down, `DELETE FROM schema_version WHERE version=?`, m.Version)
+		if err != nil {
+			return run, fmt.Errorf("reverting migration %d_%s failed: %v", m.Version, m.Name, err)
+		}
+		run = append(run, m)
+		current--
+	}
+
+	return run, nil
+}
+
+func (s *sqlStorage) runMigration(script string, record string, args ...interface{}) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range splitStatements(script) {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(tx.Rebind(record), args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *sqlStorage) tableExists(table string) (bool, error) {
+	var query string
+	switch s.db.DriverName() {
+	case DRIVER_MYSQL:
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=DATABASE() AND table_name=?`
+	case DRIVER_POSTGRES:
+		query = `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema=current_schema() AND table_name=?`
+	default:
+		query = `SELECT COUNT(*) FROM sqlite_master WHERE type='table' AND name=?`
+	}
+
+	var count int
+	err := s.db.Get(&count, s.db.Rebind(query), table)
+	return count > 0, err
+}
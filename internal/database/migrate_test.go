@@ -0,0 +1,106 @@
+package database
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMigrations(t *testing.T) {
+	mysql, err := Migrations(DRIVER_MYSQL)
+	require.NoError(t, err)
+	require.NotEmpty(t, mysql)
+
+	for _, driver := range []string{DRIVER_MYSQL, DRIVER_POSTGRES, DRIVER_SQLITE} {
+		migrations, err := Migrations(driver)
+		require.NoError(t, err)
+		require.Len(t, migrations, len(mysql), "every driver has the same migrations")
+		for i, m := range migrations {
+			assert.Equal(t, i+1, m.Version)
+			assert.Equal(t, mysql[i].Name, m.Name)
+			assert.NotEmpty(t, splitStatements(m.Up), "%s %d up", driver, m.Version)
+			assert.NotEmpty(t, splitStatements(m.Down), "%s %d down", driver, m.Version)
+		}
+	}
+
+	_, err = Migrations("oracle")
+	assert.Error(t, err)
+}
+
+func TestSplitStatements(t *testing.T) {
+	statements := splitStatements(`-- comment; with a semicolon
+CREATE TABLE a (id INT);
+
+-- another comment
+CREATE INDEX a_id ON a (id);
+`)
+	assert.Equal(t, []string{"CREATE TABLE a (id INT)", "CREATE INDEX a_id ON a (id)"}, statements)
+}
+
+func TestSqliteMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dsn := sqliteDsn(filepath.Join(dir, "ykval.db"))
+	latest, err := LatestVersion(DRIVER_SQLITE)
+	require.NoError(t, err)
+
+	store, err := Open(DRIVER_SQLITE, dsn)
+	require.NoError(t, err)
+	version, err := store.SchemaVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, latest, version, "new databases are created with the latest schema")
+
+	run, err := store.Migrate(0)
+	assert.NoError(t, err)
+	assert.Len(t, run, latest)
+	applied, err := store.AppliedMigrations()
+	assert.NoError(t, err)
+	assert.Empty(t, applied)
+	_, err = store.GetYubiKeys(ALL_ORGANIZATIONS)
+	assert.Error(t, err, "the tables have been dropped")
+
+	run, err = store.Migrate(latest)
+	assert.NoError(t, err)
+	assert.Len(t, run, latest)
+	run, err = store.Migrate(latest)
+	assert.NoError(t, err)
+	assert.Empty(t, run)
+	_, err = store.Migrate(latest + 1)
+	assert.Error(t, err)
+	require.NoError(t, store.Close())
+}
+
+func TestMigrateBaselineSchema(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(DRIVER_SQLITE, sqliteDsn(filepath.Join(dir, "ykval.db")))
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.Migrate(1)
+	require.NoError(t, err)
+
+	// a YubiKey stored with the schema of db.sql, without a private id
+	db := store.(*sqlStorage).db
+	_, err = db.Exec(`INSERT INTO yubikeys (public_name, active, created_at, modified_at, session_counter, use_counter,
+		timestamp_low, timestamp_high, secret_key) VALUES ('cccccccccccb', TRUE, 1600000000, 1600000000, 1, 2, 3, 4,
+		'000102030405060708090a0b0c0d0e0f')`)
+	require.NoError(t, err)
+
+	latest, err := LatestVersion(DRIVER_SQLITE)
+	require.NoError(t, err)
+	_, err = store.Migrate(latest)
+	require.NoError(t, err)
+	secretKey, privateId, err := store.GetYubiKeySecrets("cccccccccccb")
+	assert.NoError(t, err)
+	assert.Equal(t, "000102030405060708090a0b0c0d0e0f", secretKey)
+	assert.Equal(t, "", privateId)
+	history, err := store.GetYubiKeyHistory("cccccccccccb")
+	assert.NoError(t, err)
+	assert.Empty(t, history)
+}
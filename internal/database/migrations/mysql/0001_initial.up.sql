@@ -1,8 +1,7 @@
--- ----------------------------
--- Table structure for clients
--- ----------------------------
-DROP TABLE IF EXISTS `clients`;
-CREATE TABLE `clients`
+-- The schema of db.sql, databases set up with it before migrations existed already have these tables,
+-- they are only marked as migrated and changed by the following migrations.
+
+CREATE TABLE IF NOT EXISTS `clients`
 (
     `id`         INT         NOT NULL UNIQUE,
     `active`     BOOLEAN     NOT NULL DEFAULT TRUE,
@@ -14,11 +13,7 @@ CREATE TABLE `clients`
     PRIMARY KEY (`id`)
 );
 
--- ----------------------------
--- Table structure for yubikeys
--- ----------------------------
-DROP TABLE IF EXISTS `yubikeys`;
-CREATE TABLE `yubikeys`
+CREATE TABLE IF NOT EXISTS `yubikeys`
 (
     `public_name`     VARCHAR(16) UNIQUE NOT NULL,
     `active`          BOOLEAN            NOT NULL DEFAULT TRUE,
@@ -34,11 +29,7 @@ CREATE TABLE `yubikeys`
     PRIMARY KEY (`public_name`)
 );
 
--- ----------------------------
--- Table structure for queue
--- ----------------------------
-DROP TABLE IF EXISTS `queue`;
-CREATE TABLE `queue`
+CREATE TABLE IF NOT EXISTS `queue`
 (
     `queued_at`    INT DEFAULT NULL,
     `modified_at`  INT DEFAULT NULL,
@@ -0,0 +1,5 @@
+-- encrypted and wrapped secrets are longer than the 32 hex characters of an AES key
+ALTER TABLE `yubikeys` MODIFY `secret_key` VARCHAR(128) DEFAULT '';
+
+-- the private id is checked against the decrypted OTP when it is set
+ALTER TABLE `yubikeys` ADD COLUMN `private_id` VARCHAR(12) DEFAULT '';
@@ -0,0 +1,17 @@
+CREATE TABLE `yubikeys_history`
+(
+    `id`              INT          NOT NULL AUTO_INCREMENT,
+    `public_name`     VARCHAR(16)  NOT NULL,
+    `secret_key`      VARCHAR(128)          DEFAULT '',
+    `private_id`      VARCHAR(12)           DEFAULT '',
+    `modified_at`     INT          NOT NULL,
+    `session_counter` INT          NOT NULL,
+    `use_counter`     INT          NOT NULL,
+    `timestamp_low`   INT          NOT NULL,
+    `timestamp_high`  INT          NOT NULL,
+    `archived_at`     INT          NOT NULL,
+    `archived_by`     VARCHAR(100) NOT NULL,
+    `reason`          VARCHAR(100)          DEFAULT '',
+    PRIMARY KEY (`id`),
+    INDEX (`public_name`)
+);
@@ -0,0 +1,16 @@
+CREATE TABLE `auth_log`
+(
+    `id`              BIGINT      NOT NULL AUTO_INCREMENT,
+    `logged_at`       INT         NOT NULL,
+    `client_id`       INT         NOT NULL,
+    `public_name`     VARCHAR(16) NOT NULL DEFAULT '',
+    `status`          VARCHAR(32) NOT NULL,
+    `session_counter` INT         NOT NULL DEFAULT -1,
+    `use_counter`     INT         NOT NULL DEFAULT -1,
+    `source_ip`       VARCHAR(45) NOT NULL DEFAULT '',
+    `sync_level`      INT         NOT NULL DEFAULT 0,
+    PRIMARY KEY (`id`),
+    INDEX (`logged_at`),
+    INDEX (`public_name`, `logged_at`),
+    INDEX (`client_id`, `logged_at`)
+);
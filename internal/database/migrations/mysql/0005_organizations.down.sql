@@ -0,0 +1,5 @@
+DROP INDEX `yubikeys_org_id` ON `yubikeys`;
+DROP INDEX `clients_org_id` ON `clients`;
+ALTER TABLE `yubikeys` DROP COLUMN `org_id`;
+ALTER TABLE `clients` DROP COLUMN `org_id`;
+DROP TABLE `organizations`;
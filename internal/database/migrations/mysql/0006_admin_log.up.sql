@@ -0,0 +1,12 @@
+CREATE TABLE `admin_log`
+(
+    `id`        BIGINT       NOT NULL AUTO_INCREMENT,
+    `logged_at` INT          NOT NULL,
+    `operator`  VARCHAR(100) NOT NULL,
+    `action`    VARCHAR(32)  NOT NULL,
+    `target`    VARCHAR(100) NOT NULL,
+    `details`   VARCHAR(256) NOT NULL DEFAULT '',
+    PRIMARY KEY (`id`),
+    INDEX (`logged_at`),
+    INDEX (`target`, `logged_at`)
+);
@@ -0,0 +1,3 @@
+ALTER TABLE `auth_log` DROP COLUMN `signed_with`;
+ALTER TABLE `clients` DROP COLUMN `previous_secret_expires_at`;
+ALTER TABLE `clients` DROP COLUMN `previous_secret`;
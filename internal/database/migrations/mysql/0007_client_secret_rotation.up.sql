@@ -0,0 +1,6 @@
+-- the previous secret of a client is accepted until it expires, after its secret has been rotated
+ALTER TABLE `clients` ADD COLUMN `previous_secret` VARCHAR(60) NOT NULL DEFAULT '';
+ALTER TABLE `clients` ADD COLUMN `previous_secret_expires_at` INT NOT NULL DEFAULT 0;
+
+-- the secret a request was signed with: current, previous or empty if it was not signed
+ALTER TABLE `auth_log` ADD COLUMN `signed_with` VARCHAR(8) NOT NULL DEFAULT '';
@@ -0,0 +1,3 @@
+ALTER TABLE yubikeys DROP COLUMN private_id;
+-- fails as long as secrets are stored encrypted or wrapped
+ALTER TABLE yubikeys ALTER COLUMN secret_key TYPE VARCHAR(32);
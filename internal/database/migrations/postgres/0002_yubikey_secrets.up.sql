@@ -0,0 +1,6 @@
+-- encrypted and wrapped secrets are longer than the 32 hex characters of an AES key
+ALTER TABLE yubikeys ALTER COLUMN secret_key TYPE VARCHAR(128);
+
+-- the private id is checked against the decrypted OTP when it is set,
+-- databases set up with db.postgres.sql already have it
+ALTER TABLE yubikeys ADD COLUMN IF NOT EXISTS private_id VARCHAR(12) DEFAULT '';
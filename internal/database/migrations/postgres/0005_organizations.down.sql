@@ -0,0 +1,5 @@
+DROP INDEX yubikeys_org_id;
+DROP INDEX clients_org_id;
+ALTER TABLE yubikeys DROP COLUMN org_id;
+ALTER TABLE clients DROP COLUMN org_id;
+DROP TABLE organizations;
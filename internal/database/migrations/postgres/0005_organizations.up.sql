@@ -0,0 +1,15 @@
+CREATE TABLE organizations
+(
+    id         SERIAL       NOT NULL,
+    name       VARCHAR(100) NOT NULL UNIQUE,
+    active     BOOLEAN      NOT NULL DEFAULT TRUE,
+    created_at INT          NOT NULL,
+    notes      VARCHAR(100)          DEFAULT '',
+    PRIMARY KEY (id)
+);
+
+-- clients and YubiKeys without an organization have org_id 0
+ALTER TABLE clients ADD COLUMN org_id INT NOT NULL DEFAULT 0;
+ALTER TABLE yubikeys ADD COLUMN org_id INT NOT NULL DEFAULT 0;
+CREATE INDEX clients_org_id ON clients (org_id);
+CREATE INDEX yubikeys_org_id ON yubikeys (org_id);
@@ -0,0 +1,12 @@
+CREATE TABLE admin_log
+(
+    id        BIGSERIAL    NOT NULL,
+    logged_at INT          NOT NULL,
+    operator  VARCHAR(100) NOT NULL,
+    action    VARCHAR(32)  NOT NULL,
+    target    VARCHAR(100) NOT NULL,
+    details   VARCHAR(256) NOT NULL DEFAULT '',
+    PRIMARY KEY (id)
+);
+CREATE INDEX admin_log_logged_at ON admin_log (logged_at);
+CREATE INDEX admin_log_target ON admin_log (target, logged_at);
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS queue;
+DROP TABLE IF EXISTS yubikeys;
+DROP TABLE IF EXISTS clients;
@@ -0,0 +1,40 @@
+-- The schema of db.sql, databases auto-created before migrations existed already have these tables
+-- with the changes of the following migrations, see createSqliteSchema.
+
+CREATE TABLE IF NOT EXISTS clients
+(
+    id         INTEGER     NOT NULL UNIQUE,
+    active     BOOLEAN     NOT NULL DEFAULT TRUE,
+    created_at INTEGER     NOT NULL,
+    secret     VARCHAR(60) NOT NULL DEFAULT '',
+    email      VARCHAR(255)         DEFAULT '',
+    notes      VARCHAR(100)         DEFAULT '',
+    otp        VARCHAR(100)         DEFAULT '',
+    PRIMARY KEY (id)
+);
+
+CREATE TABLE IF NOT EXISTS yubikeys
+(
+    public_name     VARCHAR(16) UNIQUE NOT NULL,
+    active          BOOLEAN            NOT NULL DEFAULT TRUE,
+    created_at      INTEGER            NOT NULL,
+    modified_at     INTEGER            NOT NULL,
+    session_counter INTEGER            NOT NULL,
+    use_counter     INTEGER            NOT NULL,
+    timestamp_low   INTEGER            NOT NULL,
+    timestamp_high  INTEGER            NOT NULL,
+    nonce           VARCHAR(40)                 DEFAULT '',
+    notes           VARCHAR(100)                DEFAULT '',
+    secret_key      VARCHAR(32)                 DEFAULT '',
+    PRIMARY KEY (public_name)
+);
+
+CREATE TABLE IF NOT EXISTS queue
+(
+    queued_at    INTEGER DEFAULT NULL,
+    modified_at  INTEGER DEFAULT NULL,
+    server_nonce VARCHAR(32)  NOT NULL,
+    otp          VARCHAR(100) NOT NULL,
+    server       VARCHAR(100) NOT NULL,
+    info         VARCHAR(256) NOT NULL
+);
@@ -0,0 +1 @@
+ALTER TABLE yubikeys DROP COLUMN private_id;
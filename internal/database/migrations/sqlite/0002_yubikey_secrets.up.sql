@@ -0,0 +1,4 @@
+-- SQLite does not enforce the length of secret_key, encrypted and wrapped secrets fit already
+
+-- the private id is checked against the decrypted OTP when it is set
+ALTER TABLE yubikeys ADD COLUMN private_id VARCHAR(12) DEFAULT '';
@@ -0,0 +1 @@
+DROP TABLE yubikeys_history;
@@ -0,0 +1,16 @@
+CREATE TABLE yubikeys_history
+(
+    id              INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    public_name     VARCHAR(16)  NOT NULL,
+    secret_key      VARCHAR(128)          DEFAULT '',
+    private_id      VARCHAR(12)           DEFAULT '',
+    modified_at     INTEGER      NOT NULL,
+    session_counter INTEGER      NOT NULL,
+    use_counter     INTEGER      NOT NULL,
+    timestamp_low   INTEGER      NOT NULL,
+    timestamp_high  INTEGER      NOT NULL,
+    archived_at     INTEGER      NOT NULL,
+    archived_by     VARCHAR(100) NOT NULL,
+    reason          VARCHAR(100)          DEFAULT ''
+);
+CREATE INDEX yubikeys_history_public_name ON yubikeys_history (public_name);
@@ -0,0 +1,15 @@
+CREATE TABLE auth_log
+(
+    id              INTEGER     NOT NULL PRIMARY KEY AUTOINCREMENT,
+    logged_at       INTEGER     NOT NULL,
+    client_id       INTEGER     NOT NULL,
+    public_name     VARCHAR(16) NOT NULL DEFAULT '',
+    status          VARCHAR(32) NOT NULL,
+    session_counter INTEGER     NOT NULL DEFAULT -1,
+    use_counter     INTEGER     NOT NULL DEFAULT -1,
+    source_ip       VARCHAR(45) NOT NULL DEFAULT '',
+    sync_level      INTEGER     NOT NULL DEFAULT 0
+);
+CREATE INDEX auth_log_logged_at ON auth_log (logged_at);
+CREATE INDEX auth_log_public_name ON auth_log (public_name, logged_at);
+CREATE INDEX auth_log_client_id ON auth_log (client_id, logged_at);
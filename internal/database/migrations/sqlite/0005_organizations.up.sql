@@ -0,0 +1,14 @@
+CREATE TABLE organizations
+(
+    id         INTEGER      NOT NULL PRIMARY KEY AUTOINCREMENT,
+    name       VARCHAR(100) NOT NULL UNIQUE,
+    active     BOOLEAN      NOT NULL DEFAULT TRUE,
+    created_at INTEGER      NOT NULL,
+    notes      VARCHAR(100)          DEFAULT ''
+);
+
+-- clients and YubiKeys without an organization have org_id 0
+ALTER TABLE clients ADD COLUMN org_id INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE yubikeys ADD COLUMN org_id INTEGER NOT NULL DEFAULT 0;
+CREATE INDEX clients_org_id ON clients (org_id);
+CREATE INDEX yubikeys_org_id ON yubikeys (org_id);
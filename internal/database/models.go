@@ -8,6 +8,10 @@ type Client struct {
 	Email     string `db:"email"`
 	Notes     string `db:"notes"`
 	Otp       string `db:"otp"`
+	OrgId     int32  `db:"org_id"`
+
+	PreviousSecret          string `db:"previous_secret"`
+	PreviousSecretExpiresAt int32  `db:"previous_secret_expires_at"`
 }
 
 type YubiKey struct {
@@ -22,6 +26,40 @@ type YubiKey struct {
 	Nonce          string `db:"nonce"`
 	Notes          string `db:"notes"`
 	SecretKey      string `db:"secret_key"`
+	PrivateId      string `db:"private_id"`
+	OrgId          int32  `db:"org_id"`
+}
+
+type YubiKeyHistory struct {
+	Id             int32  `db:"id"`
+	PublicName     string `db:"public_name"`
+	SecretKey      string `db:"secret_key"`
+	PrivateId      string `db:"private_id"`
+	ModifiedAt     int32  `db:"modified_at"`
+	SessionCounter int32  `db:"session_counter"`
+	UseCounter     int32  `db:"use_counter"`
+	TimestampLow   int32  `db:"timestamp_low"`
+	TimestampHigh  int32  `db:"timestamp_high"`
+	ArchivedAt     int32  `db:"archived_at"`
+	ArchivedBy     string `db:"archived_by"`
+	Reason         string `db:"reason"`
+}
+
+// YubiKeyFilter selects YubiKeys, empty fields match everything. A YubiKey is last used when
+// its counters were last updated, YubiKeys never used match UsedBefore.
+type YubiKeyFilter struct {
+	Active     *bool
+	UsedBefore int32
+	UsedAfter  int32
+}
+
+// Organization owns clients and YubiKeys, which are unscoped when their OrgId is 0.
+type Organization struct {
+	Id        int32  `db:"id"`
+	Name      string `db:"name"`
+	Active    bool   `db:"active"`
+	CreatedAt int32  `db:"created_at"`
+	Notes     string `db:"notes"`
 }
 
 type Params struct {
@@ -33,3 +71,85 @@ type Params struct {
 	SyncLevel string
 	Timeout   int32
 }
+
+type AuthLog struct {
+	Id             int64  `db:"id"`
+	LoggedAt       int32  `db:"logged_at"`
+	ClientId       int32  `db:"client_id"`
+	PublicName     string `db:"public_name"`
+	Status         string `db:"status"`
+	SessionCounter int32  `db:"session_counter"`
+	UseCounter     int32  `db:"use_counter"`
+	SourceIp       string `db:"source_ip"`
+	SyncLevel      int32  `db:"sync_level"`
+	SignedWith     string `db:"signed_with"`
+}
+
+// The secret of the client a validation request was signed with.
+const (
+	SIGNED_WITH_CURRENT  = "current"
+	SIGNED_WITH_PREVIOUS = "previous"
+)
+
+// SecretUsage is the number of validation requests of a client signed with one of its secrets.
+type SecretUsage struct {
+	ClientId   int32  `db:"client_id"`
+	SignedWith string `db:"signed_with"`
+	Requests   int64  `db:"requests"`
+	LastUsedAt int32  `db:"last_used_at"`
+}
+
+// AuthLogFilter selects audit log entries, empty fields match everything.
+type AuthLogFilter struct {
+	PublicName string
+	ClientId   int32
+	Status     string
+	Since      int32
+	Until      int32
+	Limit      int
+}
+
+// AdminLog records a change made by an operator with one of the commands.
+type AdminLog struct {
+	Id       int64  `db:"id"`
+	LoggedAt int32  `db:"logged_at"`
+	Operator string `db:"operator"`
+	Action   string `db:"action"`
+	Target   string `db:"target"`
+	Details  string `db:"details"`
+}
+
+// The lengths of the columns recording a change made by an operator.
+const (
+	// MAX_NOTES_LENGTH is the length of the notes of YubiKeys and clients, and of the operator and
+	// the reason of a change.
+	MAX_NOTES_LENGTH = 100
+	// MAX_INFO_LENGTH is the length of the details of an admin log entry and of the info of a queue entry.
+	MAX_INFO_LENGTH = 256
+)
+
+// AdminChange is the record of a change made by an operator, written in the same transaction as
+// the change: its admin log entry and the queue entries sending it to the servers of the sync pool.
+type AdminChange struct {
+	Log   AdminLog
+	Queue []QueueEntry
+}
+
+// QueueEntry is a change waiting to be sent to a server of the sync pool.
+type QueueEntry struct {
+	QueuedAt    int32  `db:"queued_at"`
+	ModifiedAt  int32  `db:"modified_at"`
+	ServerNonce string `db:"server_nonce"`
+	Otp         string `db:"otp"`
+	Server      string `db:"server"`
+	Info        string `db:"info"`
+}
+
+// Snapshot is the state of the validation server a backup contains: the clients, the YubiKeys
+// with their secrets as stored, their organizations and the queue of the sync pool.
+type Snapshot struct {
+	Organizations []Organization
+	Clients       []Client
+	YubiKeys      []YubiKey
+	Queue         []QueueEntry
+}
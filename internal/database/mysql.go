@@ -0,0 +1,23 @@
+package database
+
+import (
+	"fmt"
+	"github.com/go-sql-driver/mysql"
+	"go-yubikey-val/internal/config"
+)
+
+func mysqlDsn() string {
+	return fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?charset=utf8mb4",
+		config.DB.Username, config.DB.Password, config.DB.Host, config.DB.Port, config.DB.Name)
+}
+
+// withClientFoundRows makes MySQL report the rows matched by an update instead of the rows changed, so
+// an update setting the values already stored still tells that the row exists, like the other databases.
+func withClientFoundRows(dsn string) (string, error) {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return "", err
+	}
+	cfg.ClientFoundRows = true
+	return cfg.FormatDSN(), nil
+}
@@ -0,0 +1,25 @@
+package database
+
+import (
+	"fmt"
+	_ "github.com/lib/pq"
+	"go-yubikey-val/internal/config"
+	"strings"
+)
+
+func postgresDsn() string {
+	dsn := fmt.Sprintf("host=%s port=%s dbname=%s user=%s password=%s",
+		quoteDsnValue(config.DB.Host), quoteDsnValue(config.DB.Port), quoteDsnValue(config.DB.Name),
+		quoteDsnValue(config.DB.Username), quoteDsnValue(config.DB.Password))
+	if config.DB.SslMode != "" {
+		dsn += " sslmode=" + quoteDsnValue(config.DB.SslMode)
+	}
+	return dsn
+}
+
+// quoteDsnValue quotes a value of a PostgreSQL connection string, so it may contain spaces and quotes.
+func quoteDsnValue(value string) string {
+	value = strings.Replace(value, `\`, `\\`, -1)
+	value = strings.Replace(value, `'`, `\'`, -1)
+	return "'" + value + "'"
+}
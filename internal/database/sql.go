@@ -0,0 +1,763 @@
+package database
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sqlStorage stores everything in a SQL database, the queries are written with ? placeholders
+// and only use SQL understood by all supported databases.
+type sqlStorage struct {
+	db         *sqlx.DB
+	stmts      sync.Map
+	namedStmts sync.Map
+}
+
+func newSqlStorage(db *sqlx.DB) *sqlStorage {
+	return &sqlStorage{db: db}
+}
+
+// stmt prepares the query once and reuses the statement afterwards.
+func (s *sqlStorage) stmt(query string) (*sqlx.Stmt, error) {
+	if stmt, ok := s.stmts.Load(query); ok {
+		return stmt.(*sqlx.Stmt), nil
+	}
+	stmt, err := s.db.Preparex(s.db.Rebind(query))
+	if err != nil {
+		return nil, err
+	}
+	if actual, loaded := s.stmts.LoadOrStore(query, stmt); loaded {
+		_ = stmt.Close()
+		return actual.(*sqlx.Stmt), nil
+	}
+	return stmt, nil
+}
+
+// namedStmt prepares the named query once and reuses the statement afterwards.
+func (s *sqlStorage) namedStmt(query string) (*sqlx.NamedStmt, error) {
+	if stmt, ok := s.namedStmts.Load(query); ok {
+		return stmt.(*sqlx.NamedStmt), nil
+	}
+	stmt, err := s.db.PrepareNamed(query)
+	if err != nil {
+		return nil, err
+	}
+	if actual, loaded := s.namedStmts.LoadOrStore(query, stmt); loaded {
+		_ = stmt.Close()
+		return actual.(*sqlx.NamedStmt), nil
+	}
+	return stmt, nil
+}
+
+func (s *sqlStorage) get(dest interface{}, query string, args ...interface{}) error {
+	stmt, err := s.stmt(query)
+	if err != nil {
+		return err
+	}
+	return stmt.Get(dest, args...)
+}
+
+func (s *sqlStorage) selectAll(dest interface{}, query string, args ...interface{}) error {
+	stmt, err := s.stmt(query)
+	if err != nil {
+		return err
+	}
+	return stmt.Select(dest, args...)
+}
+
+func (s *sqlStorage) exec(query string, args ...interface{}) (int64, error) {
+	stmt, err := s.stmt(query)
+	if err != nil {
+		return 0, err
+	}
+	res, err := stmt.Exec(args...)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStorage) namedExec(query string, arg interface{}) (int64, error) {
+	stmt, err := s.namedStmt(query)
+	if err != nil {
+		return 0, err
+	}
+	res, err := stmt.Exec(arg)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+func (s *sqlStorage) Close() error {
+	s.stmts.Range(func(key, stmt interface{}) bool {
+		_ = stmt.(*sqlx.Stmt).Close()
+		return true
+	})
+	s.namedStmts.Range(func(key, stmt interface{}) bool {
+		_ = stmt.(*sqlx.NamedStmt).Close()
+		return true
+	})
+	return s.db.Close()
+}
+
+// GetClientData gets an active client, clients of a deactivated organization are not found.
+func (s *sqlStorage) GetClientData(clientId int32) (Client, error) {
+	var client Client
+	err := s.get(&client, `SELECT c.id, c.secret, c.org_id, c.previous_secret, c.previous_secret_expires_at FROM clients c LEFT JOIN organizations o ON o.id=c.org_id WHERE c.active=TRUE AND c.id=? AND (c.org_id=0 OR o.active=TRUE)`, clientId)
+	return client, err
+}
+
+// GetClient gets a client whether it is active or not.
+func (s *sqlStorage) GetClient(clientId int32) (Client, error) {
+	var client Client
+	err := s.get(&client, `SELECT id, active, created_at, secret, email, notes, otp, org_id, previous_secret, previous_secret_expires_at FROM clients WHERE id=?`, clientId)
+	return client, err
+}
+
+func (s *sqlStorage) GetClients(orgId int32) ([]Client, error) {
+	var clients []Client
+	err := s.selectAll(&clients, `SELECT id, active, created_at, secret, email, notes, otp, org_id, previous_secret, previous_secret_expires_at FROM clients WHERE (?<0 OR org_id=?) ORDER BY id`, orgId, orgId)
+	return clients, err
+}
+
+func (s *sqlStorage) GetLastClientId() (int32, error) {
+	var id int32
+	err := s.get(&id, `SELECT id FROM clients ORDER BY id DESC LIMIT 1`)
+	return id, err
+}
+
+func (s *sqlStorage) ClientExists(clientId int32) (bool, error) {
+	var exists bool
+	err := s.get(&exists, `SELECT EXISTS (SELECT 1 FROM clients WHERE id=?)`, clientId)
+	return exists, err
+}
+
+func (s *sqlStorage) InsertClient(client Client) error {
+	_, err := s.namedExec(`INSERT INTO clients (id, active, created_at, secret, email, notes, otp, org_id) VALUES (:id, :active, :created_at, :secret, :email, :notes, :otp, :org_id)`, client)
+	return err
+}
+
+// UpdateClient updates the e-mail, notes and otp fields of a client, the change is recorded in the same
+// transaction unless it is nil.
+func (s *sqlStorage) UpdateClient(client Client, change *AdminChange) (bool, error) {
+	return s.execWithChange(change, `UPDATE clients SET email=?, notes=?, otp=? WHERE id=?`, client.Email, client.Notes, client.Otp, client.Id)
+}
+
+// RotateClientSecret replaces the secret of a client, the replaced secret is kept as the previous
+// secret and accepted until it expires. The change is recorded in the same transaction unless it is nil.
+func (s *sqlStorage) RotateClientSecret(clientId int32, secret string, previousExpiresAt int32, change *AdminChange) (bool, error) {
+	// MySQL assigns from left to right, so previous_secret gets the secret before it is replaced
+	return s.execWithChange(change, `UPDATE clients SET previous_secret=secret, previous_secret_expires_at=?, secret=? WHERE id=?`, previousExpiresAt, secret, clientId)
+}
+
+// ToggleClient enables or disables a client, the change is recorded in the same transaction unless it is nil.
+func (s *sqlStorage) ToggleClient(clientId int32, active bool, change *AdminChange) (bool, error) {
+	return s.execWithChange(change, `UPDATE clients SET active=? WHERE id=?`, active, clientId)
+}
+
+func (s *sqlStorage) GetYubiKey(publicName string) (YubiKey, error) {
+	var yubikey YubiKey
+	err := s.get(&yubikey, `SELECT * FROM yubikeys WHERE public_name=? LIMIT 1`, publicName)
+	return yubikey, err
+}
+
+func (s *sqlStorage) GetYubiKeys(orgId int32) ([]YubiKey, error) {
+	var yubikeys []YubiKey
+	err := s.selectAll(&yubikeys, `SELECT * FROM yubikeys WHERE (?<0 OR org_id=?) ORDER BY public_name`, orgId, orgId)
+	return yubikeys, err
+}
+
+// FindYubiKeys gets the YubiKeys matching the filter, ordered by public name.
+func (s *sqlStorage) FindYubiKeys(filter YubiKeyFilter) ([]YubiKey, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.Active != nil {
+		conditions = append(conditions, "active=?")
+		args = append(args, *filter.Active)
+	}
+	if filter.UsedBefore != 0 {
+		conditions = append(conditions, "modified_at<?")
+		args = append(args, filter.UsedBefore)
+	}
+	if filter.UsedAfter != 0 {
+		conditions = append(conditions, "modified_at>=?")
+		args = append(args, filter.UsedAfter)
+	}
+
+	query := `SELECT * FROM yubikeys`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY public_name"
+
+	var yubikeys []YubiKey
+	err := s.db.Select(&yubikeys, s.db.Rebind(query), args...)
+	return yubikeys, err
+}
+
+func (s *sqlStorage) GetDeactivatedYubiKeys(orgId int32) ([]YubiKey, error) {
+	var yubikeys []YubiKey
+	err := s.selectAll(&yubikeys, `SELECT * FROM yubikeys WHERE active=FALSE AND (?<0 OR org_id=?) ORDER BY public_name`, orgId, orgId)
+	return yubikeys, err
+}
+
+func (s *sqlStorage) GetPublicNamesWithPrefix(prefix string) ([]string, error) {
+	var publicNames []string
+	err := s.selectAll(&publicNames, `SELECT public_name FROM yubikeys WHERE public_name LIKE ?`, prefix+"%")
+	return publicNames, err
+}
+
+func (s *sqlStorage) GetAllActiveYubiKeyPublicNames() ([]string, error) {
+	var publicNames []string
+	err := s.selectAll(&publicNames, `SELECT public_name FROM yubikeys WHERE active=TRUE`)
+	return publicNames, err
+}
+
+func (s *sqlStorage) YubiKeyExists(publicName string) (bool, error) {
+	var exists bool
+	err := s.get(&exists, `SELECT EXISTS (SELECT 1 FROM yubikeys WHERE public_name=?)`, publicName)
+	return exists, err
+}
+
+const insertYubiKeyQuery = `INSERT INTO yubikeys (public_name, active, created_at, modified_at, session_counter, use_counter, timestamp_low, timestamp_high, nonce, notes, secret_key, private_id, org_id) VALUES (:public_name, :active, :created_at, :modified_at, :session_counter, :use_counter, :timestamp_low, :timestamp_high, :nonce, :notes, :secret_key, :private_id, :org_id)`
+
+func (s *sqlStorage) InsertYubiKey(yubikey YubiKey) error {
+	_, err := s.namedExec(insertYubiKeyQuery, yubikey)
+	return err
+}
+
+// InsertYubiKeys inserts all YubiKeys in a single transaction, none of them is inserted if one fails.
+func (s *sqlStorage) InsertYubiKeys(yubikeys []YubiKey) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, yubikey := range yubikeys {
+		_, err = tx.NamedExec(insertYubiKeyQuery, yubikey)
+		if err != nil {
+			return fmt.Errorf("error inserting YubiKey %s: %v", yubikey.PublicName, err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// UpdateYubiKey updates everything but the secrets of a YubiKey, if its counters are higher than the stored ones.
+func (s *sqlStorage) UpdateYubiKey(yubikey YubiKey) (bool, error) {
+	rowsAffected, err := s.namedExec(`UPDATE yubikeys SET active=:active, created_at=:created_at, modified_at=:modified_at, session_counter=:session_counter, use_counter=:use_counter, timestamp_low=:timestamp_low, timestamp_high=:timestamp_high, nonce=:nonce, notes=:notes WHERE public_name=:public_name AND (session_counter<:session_counter OR (session_counter=:session_counter AND use_counter<:use_counter))`, yubikey)
+	return rowsAffected > 0, err
+}
+
+// UpdateYubiKeyCounters updates the counters of a YubiKey, if they are higher than the stored ones.
+func (s *sqlStorage) UpdateYubiKeyCounters(yubikey YubiKey) (bool, error) {
+	rowsAffected, err := s.namedExec(`UPDATE yubikeys SET modified_at=:modified_at, session_counter=:session_counter, use_counter=:use_counter, timestamp_low=:timestamp_low, timestamp_high=:timestamp_high, nonce=:nonce WHERE public_name=:public_name AND (session_counter<:session_counter OR (session_counter=:session_counter AND use_counter<:use_counter))`, yubikey)
+	return rowsAffected > 0, err
+}
+
+// ToggleYubiKey enables or disables a YubiKey, the change is recorded in the same transaction unless it is nil.
+func (s *sqlStorage) ToggleYubiKey(publicName string, active bool, change *AdminChange) (bool, error) {
+	return s.execWithChange(change, `UPDATE yubikeys SET active=? WHERE public_name=?`, active, publicName)
+}
+
+// UpdateYubiKeyNotes sets the notes of a YubiKey, the change is recorded in the same transaction unless it is nil.
+func (s *sqlStorage) UpdateYubiKeyNotes(publicName string, notes string, change *AdminChange) (bool, error) {
+	return s.execWithChange(change, `UPDATE yubikeys SET notes=? WHERE public_name=?`, notes, publicName)
+}
+
+// DeleteYubiKey deletes a YubiKey, its archived secrets in the history are kept. The change is recorded
+// in the same transaction unless it is nil.
+func (s *sqlStorage) DeleteYubiKey(publicName string, change *AdminChange) (bool, error) {
+	return s.execWithChange(change, `DELETE FROM yubikeys WHERE public_name=?`, publicName)
+}
+
+// execWithChange runs the statement and records the change in the same transaction, nothing is
+// recorded if the statement matched no row.
+func (s *sqlStorage) execWithChange(change *AdminChange, query string, args ...interface{}) (bool, error) {
+	if change == nil {
+		rowsAffected, err := s.exec(query, args...)
+		return rowsAffected > 0, err
+	}
+
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(tx.Rebind(query), args...)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil || rowsAffected == 0 {
+		return false, err
+	}
+	err = insertAdminChange(tx, *change)
+	if err != nil {
+		return false, err
+	}
+
+	return true, tx.Commit()
+}
+
+func (s *sqlStorage) GetOrganizations() ([]Organization, error) {
+	var orgs []Organization
+	err := s.selectAll(&orgs, `SELECT id, name, active, created_at, notes FROM organizations ORDER BY id`)
+	return orgs, err
+}
+
+func (s *sqlStorage) GetOrganization(name string) (Organization, error) {
+	var org Organization
+	err := s.get(&org, `SELECT id, name, active, created_at, notes FROM organizations WHERE name=?`, name)
+	return org, err
+}
+
+func (s *sqlStorage) InsertOrganization(org Organization) error {
+	_, err := s.namedExec(`INSERT INTO organizations (name, active, created_at, notes) VALUES (:name, :active, :created_at, :notes)`, org)
+	return err
+}
+
+func (s *sqlStorage) ToggleOrganization(orgId int32, active bool) error {
+	_, err := s.exec(`UPDATE organizations SET active=? WHERE id=?`, active, orgId)
+	return err
+}
+
+func (s *sqlStorage) SetClientOrganization(clientId int32, orgId int32) (bool, error) {
+	rowsAffected, err := s.exec(`UPDATE clients SET org_id=? WHERE id=?`, orgId, clientId)
+	return rowsAffected > 0, err
+}
+
+func (s *sqlStorage) SetYubiKeyOrganization(publicName string, orgId int32) (bool, error) {
+	rowsAffected, err := s.exec(`UPDATE yubikeys SET org_id=? WHERE public_name=?`, orgId, publicName)
+	return rowsAffected > 0, err
+}
+
+// GetYubiKeySecrets gets the secrets of a YubiKey, YubiKeys of a deactivated organization are not found.
+func (s *sqlStorage) GetYubiKeySecrets(publicName string) (string, string, error) {
+	var yubikey YubiKey
+	err := s.get(&yubikey, `SELECT y.secret_key, y.private_id FROM yubikeys y LEFT JOIN organizations o ON o.id=y.org_id WHERE y.public_name=? AND (y.org_id=0 OR o.active=TRUE) LIMIT 1`, publicName)
+	return yubikey.SecretKey, yubikey.PrivateId, err
+}
+
+func (s *sqlStorage) UpdateYubiKeySecrets(publicName string, secretKey string, privateId string) error {
+	_, err := s.exec(`UPDATE yubikeys SET secret_key=?, private_id=? WHERE public_name=?`, secretKey, privateId, publicName)
+	return err
+}
+
+func (s *sqlStorage) UpdateYubiKeySecretKey(publicName string, secretKey string) error {
+	_, err := s.exec(`UPDATE yubikeys SET secret_key=? WHERE public_name=?`, secretKey, publicName)
+	return err
+}
+
+// ReplaceSecretKeys replaces every non-empty YubiKey secret key with the value returned by replace
+// in a single transaction, it returns the number of replaced secret keys.
+func (s *sqlStorage) ReplaceSecretKeys(replace func(publicName string, secretKey string) (string, error)) (int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var keys []YubiKey
+	err = tx.Select(&keys, `SELECT public_name, secret_key FROM yubikeys WHERE secret_key<>'' ORDER BY public_name`)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, key := range keys {
+		secretKey, err := replace(key.PublicName, key.SecretKey)
+		if err != nil {
+			return 0, err
+		}
+		_, err = tx.Exec(tx.Rebind(`UPDATE yubikeys SET secret_key=? WHERE public_name=?`), secretKey, key.PublicName)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(keys), tx.Commit()
+}
+
+// RekeyYubiKey archives the current secret and counters of a YubiKey into its history,
+// and installs the new secret with reset counters in a single transaction. The change is
+// recorded in the same transaction unless it is nil.
+func (s *sqlStorage) RekeyYubiKey(publicName string, secretKey string, privateId string, archivedBy string, reason string, change *AdminChange) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var yubikey YubiKey
+	err = tx.Get(&yubikey, tx.Rebind(`SELECT * FROM yubikeys WHERE public_name=? LIMIT 1`), publicName)
+	if err != nil {
+		return err
+	}
+
+	history := YubiKeyHistory{
+		PublicName:     yubikey.PublicName,
+		SecretKey:      yubikey.SecretKey,
+		PrivateId:      yubikey.PrivateId,
+		ModifiedAt:     yubikey.ModifiedAt,
+		SessionCounter: yubikey.SessionCounter,
+		UseCounter:     yubikey.UseCounter,
+		TimestampLow:   yubikey.TimestampLow,
+		TimestampHigh:  yubikey.TimestampHigh,
+		ArchivedAt:     int32(time.Now().Unix()),
+		ArchivedBy:     archivedBy,
+		Reason:         reason,
+	}
+	_, err = tx.NamedExec(`INSERT INTO yubikeys_history (public_name, secret_key, private_id, modified_at, session_counter, use_counter, timestamp_low, timestamp_high, archived_at, archived_by, reason) VALUES (:public_name, :secret_key, :private_id, :modified_at, :session_counter, :use_counter, :timestamp_low, :timestamp_high, :archived_at, :archived_by, :reason)`, history)
+	if err != nil {
+		return err
+	}
+
+	// only replace the counters which have been archived, a validation may have updated them meanwhile
+	res, err := tx.Exec(tx.Rebind(`UPDATE yubikeys SET secret_key=?, private_id=?, modified_at=?, session_counter=-1, use_counter=-1, timestamp_low=-1, timestamp_high=-1, nonce='0000000000000000' WHERE public_name=? AND session_counter=? AND use_counter=?`),
+		secretKey, privateId, history.ArchivedAt, publicName, yubikey.SessionCounter, yubikey.UseCounter)
+	if err != nil {
+		return err
+	}
+	rowsAffected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrConcurrentUpdate
+	}
+	if change != nil {
+		err = insertAdminChange(tx, *change)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// ResetYubiKeyCounters resets the counters of a YubiKey which has been rekeyed on another server of the
+// pool at rekeyedAt, unless they have been updated since by an OTP of the new secret. The change is
+// recorded in the same transaction unless it is nil.
+func (s *sqlStorage) ResetYubiKeyCounters(publicName string, rekeyedAt int32, change *AdminChange) (bool, error) {
+	return s.execWithChange(change, `UPDATE yubikeys SET modified_at=?, session_counter=-1, use_counter=-1, timestamp_low=-1, timestamp_high=-1, nonce='0000000000000000' WHERE public_name=? AND modified_at<?`,
+		rekeyedAt, publicName, rekeyedAt)
+}
+
+// GetYubiKeyHistory gets the archived secrets and counters of a YubiKey, the latest first.
+func (s *sqlStorage) GetYubiKeyHistory(publicName string) ([]YubiKeyHistory, error) {
+	var history []YubiKeyHistory
+	err := s.selectAll(&history, `SELECT * FROM yubikeys_history WHERE public_name=? ORDER BY id DESC`, publicName)
+	return history, err
+}
+
+func (s *sqlStorage) GetQueueLength() (int32, error) {
+	var length int32
+	err := s.get(&length, `SELECT COUNT(*) FROM queue`)
+	return length, err
+}
+
+func (s *sqlStorage) GetQueueLengthByServer() (map[string]int32, error) {
+	var rows []struct {
+		Server      string `db:"server"`
+		QueueLength int32  `db:"queue_length"`
+	}
+	err := s.selectAll(&rows, `SELECT server, COUNT(server) AS queue_length FROM queue GROUP BY server`)
+	if err != nil {
+		return nil, err
+	}
+
+	lengths := make(map[string]int32, len(rows))
+	for _, row := range rows {
+		lengths[row.Server] = row.QueueLength
+	}
+	return lengths, nil
+}
+
+func (s *sqlStorage) UpdateQueue(serverNonce string) error {
+	_, err := s.exec(`UPDATE queue SET queued_at=NULL WHERE server_nonce=?`, serverNonce)
+	return err
+}
+
+// GetQueuedChanges gets the changes made by operators which have not been sent to their server yet,
+// they are queued without an OTP.
+func (s *sqlStorage) GetQueuedChanges() ([]QueueEntry, error) {
+	var entries []QueueEntry
+	err := s.selectAll(&entries, `SELECT COALESCE(queued_at, 0) AS queued_at, COALESCE(modified_at, 0) AS modified_at, server_nonce, otp, server, info FROM queue WHERE otp='' ORDER BY queued_at, server_nonce`)
+	return entries, err
+}
+
+// DeleteQueueEntry removes an entry which has been sent to its server from the queue.
+func (s *sqlStorage) DeleteQueueEntry(server string, serverNonce string) error {
+	_, err := s.exec(`DELETE FROM queue WHERE server=? AND server_nonce=?`, server, serverNonce)
+	return err
+}
+
+// GetSnapshot reads the organizations, clients, YubiKeys and queue in a single transaction, a
+// queued_at or modified_at of NULL in the queue is returned as 0.
+func (s *sqlStorage) GetSnapshot() (Snapshot, error) {
+	var snapshot Snapshot
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return snapshot, err
+	}
+	defer tx.Rollback()
+
+	err = tx.Select(&snapshot.Organizations, `SELECT id, name, active, created_at, notes FROM organizations ORDER BY id`)
+	if err != nil {
+		return snapshot, err
+	}
+	err = tx.Select(&snapshot.Clients, `SELECT id, active, created_at, secret, email, notes, otp, org_id, previous_secret, previous_secret_expires_at FROM clients ORDER BY id`)
+	if err != nil {
+		return snapshot, err
+	}
+	err = tx.Select(&snapshot.YubiKeys, `SELECT * FROM yubikeys ORDER BY public_name`)
+	if err != nil {
+		return snapshot, err
+	}
+	err = tx.Select(&snapshot.Queue, `SELECT COALESCE(queued_at, 0) AS queued_at, COALESCE(modified_at, 0) AS modified_at, server_nonce, otp, server, info FROM queue ORDER BY queued_at, server_nonce, server`)
+	if err != nil {
+		return snapshot, err
+	}
+
+	return snapshot, tx.Commit()
+}
+
+// Restore replaces the organizations, clients, YubiKeys and queue with the snapshot in a single
+// transaction, the logs and the YubiKey history are kept. YubiKeys which have been used since the
+// snapshot was taken keep their higher counters, so their OTPs are not accepted again, the number
+// of YubiKeys whose counters were kept is returned.
+func (s *sqlStorage) Restore(snapshot Snapshot) (int, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var existing []YubiKey
+	err = tx.Select(&existing, `SELECT * FROM yubikeys`)
+	if err != nil {
+		return 0, err
+	}
+	stored := make(map[string]YubiKey, len(existing))
+	for _, yubikey := range existing {
+		stored[yubikey.PublicName] = yubikey
+	}
+
+	for _, table := range []string{"queue", "yubikeys", "clients", "organizations"} {
+		if _, err = tx.Exec(`DELETE FROM ` + table); err != nil {
+			return 0, err
+		}
+	}
+
+	for _, org := range snapshot.Organizations {
+		_, err = tx.NamedExec(`INSERT INTO organizations (id, name, active, created_at, notes) VALUES (:id, :name, :active, :created_at, :notes)`, org)
+		if err != nil {
+			return 0, err
+		}
+	}
+	if s.db.DriverName() == DRIVER_POSTGRES {
+		// the sequence does not advance when ids are inserted, MySQL and SQLite continue after the highest id
+		_, err = tx.Exec(`SELECT setval(pg_get_serial_sequence('organizations', 'id'), COALESCE(MAX(id), 0) + 1, false) FROM organizations`)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, client := range snapshot.Clients {
+		_, err = tx.NamedExec(`INSERT INTO clients (id, active, created_at, secret, email, notes, otp, org_id, previous_secret, previous_secret_expires_at) VALUES (:id, :active, :created_at, :secret, :email, :notes, :otp, :org_id, :previous_secret, :previous_secret_expires_at)`, client)
+		if err != nil {
+			return 0, err
+		}
+	}
+	kept := 0
+	for _, yubikey := range snapshot.YubiKeys {
+		current, ok := stored[yubikey.PublicName]
+		if ok && (current.SessionCounter > yubikey.SessionCounter ||
+			(current.SessionCounter == yubikey.SessionCounter && current.UseCounter > yubikey.UseCounter)) {
+			yubikey.ModifiedAt = current.ModifiedAt
+			yubikey.SessionCounter, yubikey.UseCounter = current.SessionCounter, current.UseCounter
+			yubikey.TimestampLow, yubikey.TimestampHigh = current.TimestampLow, current.TimestampHigh
+			yubikey.Nonce = current.Nonce
+			kept++
+		}
+		_, err = tx.NamedExec(`INSERT INTO yubikeys (public_name, active, created_at, modified_at, session_counter, use_counter, timestamp_low, timestamp_high, nonce, notes, secret_key, private_id, org_id) VALUES (:public_name, :active, :created_at, :modified_at, :session_counter, :use_counter, :timestamp_low, :timestamp_high, :nonce, :notes, :secret_key, :private_id, :org_id)`, yubikey)
+		if err != nil {
+			return 0, err
+		}
+	}
+	for _, entry := range snapshot.Queue {
+		// GetSnapshot returns NULL as 0
+		_, err = tx.NamedExec(`INSERT INTO queue (queued_at, modified_at, server_nonce, otp, server, info) VALUES (NULLIF(:queued_at, 0), NULLIF(:modified_at, 0), :server_nonce, :otp, :server, :info)`, entry)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return kept, tx.Commit()
+}
+
+// InsertAuthLogs inserts audit log entries in a single transaction.
+func (s *sqlStorage) InsertAuthLogs(entries []AuthLog) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareNamed(`INSERT INTO auth_log (logged_at, client_id, public_name, status, session_counter, use_counter, source_ip, sync_level, signed_with) VALUES (:logged_at, :client_id, :public_name, :status, :session_counter, :use_counter, :source_ip, :sync_level, :signed_with)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, entry := range entries {
+		_, err = stmt.Exec(entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetAuthLogs gets the audit log entries matching the filter, the latest first.
+func (s *sqlStorage) GetAuthLogs(filter AuthLogFilter) ([]AuthLog, error) {
+	var conditions []string
+	var args []interface{}
+	if filter.PublicName != "" {
+		conditions = append(conditions, "public_name=?")
+		args = append(args, filter.PublicName)
+	}
+	if filter.ClientId != 0 {
+		conditions = append(conditions, "client_id=?")
+		args = append(args, filter.ClientId)
+	}
+	if filter.Status != "" {
+		conditions = append(conditions, "status=?")
+		args = append(args, filter.Status)
+	}
+	if filter.Since != 0 {
+		conditions = append(conditions, "logged_at>=?")
+		args = append(args, filter.Since)
+	}
+	if filter.Until != 0 {
+		conditions = append(conditions, "logged_at<?")
+		args = append(args, filter.Until)
+	}
+
+	query := `SELECT id, logged_at, client_id, public_name, status, session_counter, use_counter, source_ip, sync_level, signed_with FROM auth_log`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	var entries []AuthLog
+	err := s.db.Select(&entries, s.db.Rebind(query), args...)
+	return entries, err
+}
+
+// GetSecretUsage counts the validation requests of each client signed with each of its secrets since a time.
+func (s *sqlStorage) GetSecretUsage(since int32) ([]SecretUsage, error) {
+	var usage []SecretUsage
+	err := s.selectAll(&usage, `SELECT client_id, signed_with, COUNT(*) AS requests, MAX(logged_at) AS last_used_at FROM auth_log WHERE logged_at>=? GROUP BY client_id, signed_with ORDER BY client_id, signed_with`, since)
+	return usage, err
+}
+
+// InsertAdminLog records a change made by an operator, and queues it for the servers of the sync pool,
+// in a single transaction.
+func (s *sqlStorage) InsertAdminLog(entry AdminLog, queue []QueueEntry) error {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = insertAdminChange(tx, AdminChange{Log: entry, Queue: queue})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func insertAdminChange(tx *sqlx.Tx, change AdminChange) error {
+	_, err := tx.NamedExec(`INSERT INTO admin_log (logged_at, operator, action, target, details) VALUES (:logged_at, :operator, :action, :target, :details)`, change.Log)
+	if err != nil {
+		return err
+	}
+	for _, q := range change.Queue {
+		_, err = tx.NamedExec(`INSERT INTO queue (queued_at, modified_at, server_nonce, otp, server, info) VALUES (:queued_at, :modified_at, :server_nonce, :otp, :server, :info)`, q)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetAdminLogs gets the changes made by operators to a target, or to everything if it is empty, the latest first.
+func (s *sqlStorage) GetAdminLogs(target string, limit int) ([]AdminLog, error) {
+	query := `SELECT id, logged_at, operator, action, target, details FROM admin_log`
+	var args []interface{}
+	if target != "" {
+		query += " WHERE target=?"
+		args = append(args, target)
+	}
+	query += " ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	var entries []AdminLog
+	err := s.db.Select(&entries, s.db.Rebind(query), args...)
+	return entries, err
+}
+
+// ExpiryConditions are the tables which can be pruned, with the condition selecting the rows older than
+// the time. Changes made by operators are queued without an OTP and removed once they have been sent,
+// they are never pruned so a server of the sync pool which has not received one yet still gets it.
+var ExpiryConditions = map[string]string{
+	"auth_log":         "logged_at<?",
+	"queue":            "modified_at<? AND otp<>''",
+	"yubikeys_history": "archived_at<?",
+}
+
+// CountExpired counts the rows of the table older than the time.
+func (s *sqlStorage) CountExpired(table string, before int32) (int64, error) {
+	condition, ok := ExpiryConditions[table]
+	if !ok {
+		return 0, fmt.Errorf("table %s can not be pruned", table)
+	}
+
+	var count int64
+	err := s.get(&count, `SELECT COUNT(*) FROM `+table+` WHERE `+condition, before)
+	return count, err
+}
+
+// DeleteExpired deletes at most limit rows of the table older than the time, so a single
+// statement does not lock the table for long, it returns the number of deleted rows.
+func (s *sqlStorage) DeleteExpired(table string, before int32, limit int) (int64, error) {
+	condition, ok := ExpiryConditions[table]
+	if !ok {
+		return 0, fmt.Errorf("table %s can not be pruned", table)
+	}
+
+	var query string
+	switch s.db.DriverName() {
+	case DRIVER_MYSQL:
+		query = `DELETE FROM ` + table + ` WHERE ` + condition + ` LIMIT ?`
+	case DRIVER_POSTGRES:
+		query = `DELETE FROM ` + table + ` WHERE ctid IN (SELECT ctid FROM ` + table + ` WHERE ` + condition + ` LIMIT ?)`
+	default:
+		query = `DELETE FROM ` + table + ` WHERE rowid IN (SELECT rowid FROM ` + table + ` WHERE ` + condition + ` LIMIT ?)`
+	}
+	return s.exec(query, before, limit)
+}
@@ -0,0 +1,27 @@
+package database
+
+import (
+	_ "modernc.org/sqlite"
+	"net/url"
+)
+
+// sqliteDsn waits for locks instead of failing right away, and takes the write lock when a
+// transaction begins, so concurrent validations and commands do not run into SQLITE_BUSY.
+func sqliteDsn(path string) string {
+	return "file:" + (&url.URL{Path: path}).EscapedPath() +
+		"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate"
+}
+
+// createSqliteSchema migrates a new database to the latest schema version on first start.
+func createSqliteSchema(store *sqlStorage) error {
+	version, err := store.SchemaVersion()
+	if err != nil || version > 0 {
+		return err
+	}
+	latest, err := LatestVersion(DRIVER_SQLITE)
+	if err != nil {
+		return err
+	}
+	_, err = store.Migrate(latest)
+	return err
+}
@@ -0,0 +1,156 @@
+package database
+
+import (
+	"fmt"
+	"github.com/jmoiron/sqlx"
+	log "github.com/sirupsen/logrus"
+	"go-yubikey-val/internal/config"
+)
+
+const (
+	DRIVER_MYSQL    = "mysql"
+	DRIVER_POSTGRES = "postgres"
+	DRIVER_SQLITE   = "sqlite"
+)
+
+// ALL_ORGANIZATIONS selects the clients and YubiKeys of every organization, and those without one.
+const ALL_ORGANIZATIONS int32 = -1
+
+// Storage is everything the validation server and the commands need from a database.
+type Storage interface {
+	Close() error
+
+	GetClientData(clientId int32) (Client, error)
+	GetClient(clientId int32) (Client, error)
+	GetClients(orgId int32) ([]Client, error)
+	GetLastClientId() (int32, error)
+	ClientExists(clientId int32) (bool, error)
+	InsertClient(client Client) error
+	UpdateClient(client Client, change *AdminChange) (bool, error)
+	RotateClientSecret(clientId int32, secret string, previousExpiresAt int32, change *AdminChange) (bool, error)
+	ToggleClient(clientId int32, active bool, change *AdminChange) (bool, error)
+
+	GetYubiKey(publicName string) (YubiKey, error)
+	GetYubiKeys(orgId int32) ([]YubiKey, error)
+	FindYubiKeys(filter YubiKeyFilter) ([]YubiKey, error)
+	GetDeactivatedYubiKeys(orgId int32) ([]YubiKey, error)
+	GetPublicNamesWithPrefix(prefix string) ([]string, error)
+	GetAllActiveYubiKeyPublicNames() ([]string, error)
+	YubiKeyExists(publicName string) (bool, error)
+	InsertYubiKey(yubikey YubiKey) error
+	InsertYubiKeys(yubikeys []YubiKey) error
+	UpdateYubiKey(yubikey YubiKey) (bool, error)
+	UpdateYubiKeyCounters(yubikey YubiKey) (bool, error)
+	ToggleYubiKey(publicName string, active bool, change *AdminChange) (bool, error)
+	UpdateYubiKeyNotes(publicName string, notes string, change *AdminChange) (bool, error)
+	DeleteYubiKey(publicName string, change *AdminChange) (bool, error)
+	ImportYubiKeys(yubikeys []YubiKey, options ImportOptions) ([]ImportChange, error)
+	ImportClients(clients []Client, options ImportOptions) ([]ImportChange, error)
+
+	GetOrganizations() ([]Organization, error)
+	GetOrganization(name string) (Organization, error)
+	InsertOrganization(org Organization) error
+	ToggleOrganization(orgId int32, active bool) error
+	SetClientOrganization(clientId int32, orgId int32) (bool, error)
+	SetYubiKeyOrganization(publicName string, orgId int32) (bool, error)
+
+	GetYubiKeySecrets(publicName string) (string, string, error)
+	UpdateYubiKeySecrets(publicName string, secretKey string, privateId string) error
+	UpdateYubiKeySecretKey(publicName string, secretKey string) error
+	ReplaceSecretKeys(replace func(publicName string, secretKey string) (string, error)) (int, error)
+	RekeyYubiKey(publicName string, secretKey string, privateId string, archivedBy string, reason string, change *AdminChange) error
+	ResetYubiKeyCounters(publicName string, rekeyedAt int32, change *AdminChange) (bool, error)
+	GetYubiKeyHistory(publicName string) ([]YubiKeyHistory, error)
+
+	GetQueueLength() (int32, error)
+	GetQueueLengthByServer() (map[string]int32, error)
+	UpdateQueue(serverNonce string) error
+	GetQueuedChanges() ([]QueueEntry, error)
+	DeleteQueueEntry(server string, serverNonce string) error
+
+	GetSnapshot() (Snapshot, error)
+	Restore(snapshot Snapshot) (int, error)
+
+	InsertAuthLogs(entries []AuthLog) error
+	GetAuthLogs(filter AuthLogFilter) ([]AuthLog, error)
+	GetSecretUsage(since int32) ([]SecretUsage, error)
+	InsertAdminLog(entry AdminLog, queue []QueueEntry) error
+	GetAdminLogs(target string, limit int) ([]AdminLog, error)
+
+	CountExpired(table string, before int32) (int64, error)
+	DeleteExpired(table string, before int32, limit int) (int64, error)
+
+	AppliedMigrations() (map[int]int32, error)
+	SchemaVersion() (int, error)
+	Migrate(version int) ([]Migration, error)
+}
+
+var Store Storage
+
+// Setup connects to the configured database.
+func Setup() {
+	var err error
+	var dsn string
+	location := fmt.Sprintf("tcp(%s:%s)/%s", config.DB.Host, config.DB.Port, config.DB.Name)
+	switch config.DB.Driver {
+	case DRIVER_POSTGRES:
+		dsn = postgresDsn()
+	case DRIVER_SQLITE:
+		if config.DB.Path == "" {
+			log.Fatal("No database path configured for sqlite")
+		}
+		dsn = sqliteDsn(config.DB.Path)
+		location = config.DB.Path
+	case DRIVER_MYSQL, "":
+		config.DB.Driver = DRIVER_MYSQL
+		dsn = mysqlDsn()
+	default:
+		log.Fatal("Unknown database driver: ", config.DB.Driver)
+	}
+
+	Store, err = Open(config.DB.Driver, dsn)
+	if err != nil {
+		log.Fatal("Could not connect to database: ", err)
+	}
+	log.Infof("Connected to %s database: %s", config.DB.Driver, location)
+}
+
+// Open connects to a database with the driver and returns its storage.
+func Open(driver string, dsn string) (Storage, error) {
+	switch driver {
+	case DRIVER_MYSQL:
+		var err error
+		dsn, err = withClientFoundRows(dsn)
+		if err != nil {
+			return nil, err
+		}
+	case DRIVER_POSTGRES, DRIVER_SQLITE:
+	default:
+		return nil, fmt.Errorf("unknown database driver %s", driver)
+	}
+
+	db, err := sqlx.Connect(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxIdleConns(config.DB.MaxIdleConnections)
+	db.SetMaxOpenConns(config.DB.MaxOpenConnections)
+
+	store := newSqlStorage(db)
+	if driver == DRIVER_SQLITE {
+		err = createSqliteSchema(store)
+		if err != nil {
+			_ = store.Close()
+			return nil, err
+		}
+	}
+
+	return store, nil
+}
+
+// Close closes the connection to the database.
+func Close() {
+	if err := Store.Close(); err != nil {
+		log.Error(err)
+	}
+}
@@ -0,0 +1,630 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// The storage tests need an empty database for each backend, they are skipped if its DSN is not set.
+func TestMysqlStorage(t *testing.T) {
+	testStorageWithDsn(t, DRIVER_MYSQL, os.Getenv("YKVAL_TEST_MYSQL_DSN"))
+}
+
+func TestPostgresStorage(t *testing.T) {
+	testStorageWithDsn(t, DRIVER_POSTGRES, os.Getenv("YKVAL_TEST_POSTGRES_DSN"))
+}
+
+func TestSqliteStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	store, err := Open(DRIVER_SQLITE, sqliteDsn(filepath.Join(dir, "ykval.db")))
+	require.NoError(t, err)
+	defer store.Close()
+	testStorage(t, store)
+}
+
+func TestWithClientFoundRows(t *testing.T) {
+	dsn, err := withClientFoundRows("ykval:secret@tcp(127.0.0.1:3306)/ykval?charset=utf8mb4")
+	require.NoError(t, err)
+	assert.Contains(t, dsn, "clientFoundRows=true")
+	assert.Contains(t, dsn, "charset=utf8mb4")
+	assert.Contains(t, dsn, "ykval:secret@tcp(127.0.0.1:3306)/ykval?")
+
+	_, err = withClientFoundRows("not a dsn")
+	assert.Error(t, err)
+}
+
+func testStorageWithDsn(t *testing.T, driver string, dsn string) {
+	if dsn == "" {
+		t.Skipf("no %s test database configured", driver)
+	}
+
+	store, err := Open(driver, dsn)
+	require.NoError(t, err)
+	defer store.Close()
+	latest, err := LatestVersion(driver)
+	require.NoError(t, err)
+	_, err = store.Migrate(latest)
+	require.NoError(t, err)
+	testStorage(t, store)
+}
+
+// testStorage runs the same checks against every storage implementation.
+func testStorage(t *testing.T, store Storage) {
+	Store = store
+
+	t.Run("clients", func(t *testing.T) {
+		_, err := store.GetLastClientId()
+		assert.Equal(t, sql.ErrNoRows, err)
+
+		for _, id := range []int32{2, 1} {
+			err := store.InsertClient(Client{Id: id, Active: id == 1, CreatedAt: 1600000000, Secret: "c2VjcmV0", Email: "test@example.com"})
+			require.NoError(t, err)
+		}
+
+		lastId, err := store.GetLastClientId()
+		assert.NoError(t, err)
+		assert.Equal(t, int32(2), lastId)
+
+		exists, err := store.ClientExists(1)
+		assert.NoError(t, err)
+		assert.True(t, exists)
+		exists, err = store.ClientExists(3)
+		assert.NoError(t, err)
+		assert.False(t, exists)
+
+		client, err := store.GetClientData(1)
+		assert.NoError(t, err)
+		assert.Equal(t, "c2VjcmV0", client.Secret)
+		_, err = store.GetClientData(2)
+		assert.Equal(t, sql.ErrNoRows, err, "inactive clients have no client data")
+
+		clients, err := store.GetClients(ALL_ORGANIZATIONS)
+		assert.NoError(t, err)
+		require.Len(t, clients, 2)
+		assert.Equal(t, int32(1), clients[0].Id)
+		assert.Equal(t, "test@example.com", clients[1].Email)
+
+		toggled, err := store.ToggleClient(2, true, nil)
+		assert.NoError(t, err)
+		assert.True(t, toggled)
+		updated, err := store.RotateClientSecret(2, "bmV3", 1600086400, nil)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		client, err = store.GetClientData(2)
+		assert.NoError(t, err)
+		assert.Equal(t, "bmV3", client.Secret)
+		assert.Equal(t, "c2VjcmV0", client.PreviousSecret, "the rotated secret is kept")
+		assert.Equal(t, int32(1600086400), client.PreviousSecretExpiresAt)
+
+		updated, err = store.UpdateClient(Client{Id: 2, Email: "other@example.com", Notes: "api"}, nil)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		updated, err = store.UpdateClient(Client{Id: 2, Email: "other@example.com", Notes: "api"}, nil)
+		assert.NoError(t, err)
+		assert.True(t, updated, "setting the same values finds the client")
+		client, err = store.GetClient(2)
+		assert.NoError(t, err)
+		assert.Equal(t, Client{Id: 2, Active: true, CreatedAt: 1600000000, Secret: "bmV3", Email: "other@example.com", Notes: "api",
+			PreviousSecret: "c2VjcmV0", PreviousSecretExpiresAt: 1600086400}, client)
+
+		toggled, err = store.ToggleClient(2, false, nil)
+		assert.NoError(t, err)
+		assert.True(t, toggled)
+		toggled, err = store.ToggleClient(2, false, nil)
+		assert.NoError(t, err)
+		assert.True(t, toggled, "a client which is disabled already is found")
+		toggled, err = store.ToggleClient(3, false, nil)
+		assert.NoError(t, err)
+		assert.False(t, toggled, "unknown clients are not toggled")
+		_, err = store.GetClient(3)
+		assert.Equal(t, sql.ErrNoRows, err)
+	})
+
+	t.Run("yubikeys", func(t *testing.T) {
+		params, err := GetLocalParams("cccccccccccb")
+		require.NoError(t, err, "unknown YubiKeys are added")
+		assert.True(t, params.Active)
+		assert.Equal(t, int32(-1), params.SessionCounter)
+
+		key := YubiKey{
+			Active:         true,
+			CreatedAt:      1600000000,
+			ModifiedAt:     1600000000,
+			PublicName:     "cccccccccccc",
+			SessionCounter: 1,
+			UseCounter:     1,
+			Nonce:          "0000000000000000",
+			SecretKey:      "v1:sealed",
+			PrivateId:      "0123456789ab",
+		}
+		require.NoError(t, store.InsertYubiKey(key))
+
+		exists, err := store.YubiKeyExists("cccccccccccc")
+		assert.NoError(t, err)
+		assert.True(t, exists)
+
+		generated := []YubiKey{{Active: true, PublicName: "ccccccccccce"}, {Active: true, PublicName: "cccccccccccc"}}
+		assert.Error(t, store.InsertYubiKeys(generated), "cccccccccccc already exists")
+		exists, err = store.YubiKeyExists("ccccccccccce")
+		assert.NoError(t, err)
+		assert.False(t, exists, "the YubiKeys are inserted in one transaction")
+
+		publicNames, err := store.GetPublicNamesWithPrefix("cccc")
+		assert.NoError(t, err)
+		assert.ElementsMatch(t, []string{"cccccccccccb", "cccccccccccc"}, publicNames)
+
+		secretKey, privateId, err := GetYubiKeySecrets("cccccccccccc")
+		assert.NoError(t, err)
+		assert.Equal(t, "v1:sealed", secretKey)
+		assert.Equal(t, "0123456789ab", privateId)
+		_, _, err = GetYubiKeySecrets("cccccccccccb")
+		assert.True(t, errors.Is(err, ErrEmptySecretKey))
+
+		key.UseCounter = 2
+		updated, err := store.UpdateYubiKeyCounters(key)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		updated, err = store.UpdateYubiKeyCounters(key)
+		assert.NoError(t, err)
+		assert.False(t, updated, "counters must be higher than the stored ones")
+
+		key.Notes = "replayed import"
+		updated, err = store.UpdateYubiKey(key)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+		key.SessionCounter = 2
+		updated, err = store.UpdateYubiKey(key)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+
+		toggled, err := store.ToggleYubiKey("cccccccccccb", false, nil)
+		require.NoError(t, err)
+		assert.True(t, toggled)
+		toggled, err = store.ToggleYubiKey("cccccccccccb", false, nil)
+		require.NoError(t, err)
+		assert.True(t, toggled, "a YubiKey which is disabled already is found")
+		deactivated, err := store.GetDeactivatedYubiKeys(ALL_ORGANIZATIONS)
+		assert.NoError(t, err)
+		require.Len(t, deactivated, 1)
+		assert.Equal(t, "cccccccccccb", deactivated[0].PublicName)
+		active, err := store.GetAllActiveYubiKeyPublicNames()
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"cccccccccccc"}, active)
+
+		stored, err := store.GetYubiKey("cccccccccccc")
+		assert.NoError(t, err)
+		assert.Equal(t, key, stored)
+
+		keys, err := store.GetYubiKeys(ALL_ORGANIZATIONS)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 2)
+	})
+
+	t.Run("secrets", func(t *testing.T) {
+		require.NoError(t, store.UpdateYubiKeySecretKey("cccccccccccb", "v1:other"))
+		require.NoError(t, store.UpdateYubiKeySecrets("cccccccccccc", "v1:first", "ba9876543210"))
+
+		count, err := store.ReplaceSecretKeys(func(publicName string, secretKey string) (string, error) {
+			return secretKey + "-replaced", nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, count)
+		secretKey, _, err := store.GetYubiKeySecrets("cccccccccccc")
+		assert.NoError(t, err)
+		assert.Equal(t, "v1:first-replaced", secretKey)
+
+		require.NoError(t, store.RekeyYubiKey("cccccccccccc", "v1:second", "000000000000", "admin", "lost", nil))
+		key, err := store.GetYubiKey("cccccccccccc")
+		assert.NoError(t, err)
+		assert.Equal(t, "v1:second", key.SecretKey)
+		assert.Equal(t, int32(-1), key.SessionCounter)
+
+		history, err := store.GetYubiKeyHistory("cccccccccccc")
+		assert.NoError(t, err)
+		require.Len(t, history, 1)
+		assert.Equal(t, "v1:first-replaced", history[0].SecretKey)
+		assert.Equal(t, "ba9876543210", history[0].PrivateId)
+		assert.Equal(t, int32(2), history[0].SessionCounter)
+		assert.Equal(t, "admin", history[0].ArchivedBy)
+
+		key.SessionCounter, key.UseCounter, key.ModifiedAt = 3, 1, 1700000000
+		updated, err := store.UpdateYubiKeyCounters(key)
+		require.NoError(t, err)
+		require.True(t, updated)
+		reset, err := store.ResetYubiKeyCounters("cccccccccccc", 1700000000, nil)
+		assert.NoError(t, err)
+		assert.False(t, reset, "counters updated since the rekey are kept")
+		reset, err = store.ResetYubiKeyCounters("cccccccccccc", 1700000001, nil)
+		assert.NoError(t, err)
+		assert.True(t, reset)
+		key, err = store.GetYubiKey("cccccccccccc")
+		assert.NoError(t, err)
+		assert.Equal(t, int32(-1), key.SessionCounter)
+		assert.Equal(t, int32(-1), key.UseCounter)
+		assert.Equal(t, int32(1700000001), key.ModifiedAt)
+		reset, err = store.ResetYubiKeyCounters("cccccccccccf", 1700000001, nil)
+		assert.NoError(t, err)
+		assert.False(t, reset)
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		length, err := store.GetQueueLength()
+		assert.NoError(t, err)
+		assert.Equal(t, int32(0), length)
+
+		lengths, err := store.GetQueueLengthByServer()
+		assert.NoError(t, err)
+		assert.Empty(t, lengths)
+
+		assert.NoError(t, store.UpdateQueue("nonce"))
+	})
+	t.Run("auth log", func(t *testing.T) {
+		entries := []AuthLog{
+			{LoggedAt: 1600000000, ClientId: 1, PublicName: "cccccccccccc", Status: "OK", SessionCounter: 1, UseCounter: 1, SourceIp: "127.0.0.1", SignedWith: SIGNED_WITH_CURRENT},
+			{LoggedAt: 1600000100, ClientId: 2, PublicName: "cccccccccccc", Status: "REPLAYED_OTP", SessionCounter: 1, UseCounter: 1, SourceIp: "::1", SignedWith: SIGNED_WITH_PREVIOUS},
+			{LoggedAt: 1600000200, ClientId: 1, PublicName: "cccccccccccb", Status: "OK", SessionCounter: -1, UseCounter: -1},
+		}
+		require.NoError(t, store.InsertAuthLogs(entries))
+
+		all, err := store.GetAuthLogs(AuthLogFilter{})
+		assert.NoError(t, err)
+		require.Len(t, all, 3)
+		assert.Equal(t, "cccccccccccb", all[0].PublicName, "the latest entry comes first")
+		all[2].Id = 0
+		assert.Equal(t, entries[0], all[2])
+
+		tests := []struct {
+			filter   AuthLogFilter
+			expected int
+		}{
+			{AuthLogFilter{PublicName: "cccccccccccc"}, 2},
+			{AuthLogFilter{ClientId: 1}, 2},
+			{AuthLogFilter{Status: "OK", PublicName: "cccccccccccc"}, 1},
+			{AuthLogFilter{Since: 1600000100}, 2},
+			{AuthLogFilter{Since: 1600000000, Until: 1600000100}, 1},
+			{AuthLogFilter{Limit: 1}, 1},
+			{AuthLogFilter{Status: "BAD_OTP"}, 0},
+		}
+		for _, test := range tests {
+			found, err := store.GetAuthLogs(test.filter)
+			assert.NoError(t, err)
+			assert.Len(t, found, test.expected, "%+v", test.filter)
+		}
+
+		usage, err := store.GetSecretUsage(1600000000)
+		assert.NoError(t, err)
+		assert.Equal(t, []SecretUsage{
+			{ClientId: 1, SignedWith: "", Requests: 1, LastUsedAt: 1600000200},
+			{ClientId: 1, SignedWith: SIGNED_WITH_CURRENT, Requests: 1, LastUsedAt: 1600000000},
+			{ClientId: 2, SignedWith: SIGNED_WITH_PREVIOUS, Requests: 1, LastUsedAt: 1600000100},
+		}, usage)
+		usage, err = store.GetSecretUsage(1600000100)
+		assert.NoError(t, err)
+		assert.Len(t, usage, 2)
+
+		count, err := store.CountExpired("auth_log", 1600000200)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(2), count)
+		deleted, err := store.DeleteExpired("auth_log", 1600000200, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), deleted, "at most limit rows are deleted")
+		deleted, err = store.DeleteExpired("auth_log", 1600000200, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), deleted)
+		_, err = store.DeleteExpired("clients", 1600000200, 10)
+		assert.Error(t, err)
+	})
+
+	t.Run("organizations", func(t *testing.T) {
+		require.NoError(t, store.InsertOrganization(Organization{Name: "acme", Active: true, CreatedAt: 1600000000}))
+		assert.Error(t, store.InsertOrganization(Organization{Name: "acme", Active: true}), "names are unique")
+		org, err := store.GetOrganization("acme")
+		require.NoError(t, err)
+		assert.True(t, org.Active)
+		_, err = store.GetOrganization("other")
+		assert.Equal(t, sql.ErrNoRows, err)
+
+		require.NoError(t, store.InsertClient(Client{Id: 10, Active: true, Secret: "c2VjcmV0", OrgId: org.Id}))
+		require.NoError(t, store.InsertYubiKey(YubiKey{Active: true, PublicName: "cccccccccccd", SecretKey: "v1:tenant", PrivateId: "0123456789ab", OrgId: org.Id}))
+
+		clients, err := store.GetClients(org.Id)
+		assert.NoError(t, err)
+		require.Len(t, clients, 1)
+		assert.Equal(t, int32(10), clients[0].Id)
+		clients, err = store.GetClients(0)
+		assert.NoError(t, err)
+		assert.Len(t, clients, 2, "clients without an organization")
+		keys, err := store.GetYubiKeys(org.Id)
+		assert.NoError(t, err)
+		require.Len(t, keys, 1)
+		assert.Equal(t, org.Id, keys[0].OrgId)
+
+		client, err := store.GetClientData(10)
+		assert.NoError(t, err)
+		assert.Equal(t, org.Id, client.OrgId)
+
+		moved, err := store.SetYubiKeyOrganization("cccccccccccb", org.Id)
+		assert.NoError(t, err)
+		assert.True(t, moved)
+		moved, err = store.SetClientOrganization(99, org.Id)
+		assert.NoError(t, err)
+		assert.False(t, moved, "unknown clients are not moved")
+		keys, err = store.GetYubiKeys(org.Id)
+		assert.NoError(t, err)
+		assert.Len(t, keys, 2)
+
+		require.NoError(t, store.ToggleOrganization(org.Id, false))
+		_, err = store.GetClientData(10)
+		assert.Equal(t, sql.ErrNoRows, err, "clients of a deactivated organization are disabled")
+		_, _, err = store.GetYubiKeySecrets("cccccccccccd")
+		assert.Equal(t, sql.ErrNoRows, err, "YubiKeys of a deactivated organization are disabled")
+		_, err = store.GetClientData(1)
+		assert.NoError(t, err)
+
+		require.NoError(t, store.ToggleOrganization(org.Id, true))
+		_, err = store.GetClientData(10)
+		assert.NoError(t, err)
+		orgs, err := store.GetOrganizations()
+		assert.NoError(t, err)
+		assert.Len(t, orgs, 1)
+	})
+
+	t.Run("key management", func(t *testing.T) {
+		active, inactive := true, false
+		tests := []struct {
+			filter   YubiKeyFilter
+			expected []string
+		}{
+			{YubiKeyFilter{}, []string{"cccccccccccb", "cccccccccccc", "cccccccccccd"}},
+			{YubiKeyFilter{Active: &active}, []string{"cccccccccccc", "cccccccccccd"}},
+			{YubiKeyFilter{Active: &inactive}, []string{"cccccccccccb"}},
+			{YubiKeyFilter{UsedAfter: 1600000000}, []string{"cccccccccccc"}},
+			{YubiKeyFilter{UsedBefore: 1600000000}, []string{"cccccccccccb", "cccccccccccd"}},
+			{YubiKeyFilter{Active: &inactive, UsedAfter: 1600000000}, nil},
+		}
+		for _, test := range tests {
+			keys, err := store.FindYubiKeys(test.filter)
+			assert.NoError(t, err)
+			var publicNames []string
+			for _, key := range keys {
+				publicNames = append(publicNames, key.PublicName)
+			}
+			assert.Equal(t, test.expected, publicNames, "%+v", test.filter)
+		}
+
+		updated, err := store.UpdateYubiKeyNotes("cccccccccccd", "lost", nil)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		updated, err = store.UpdateYubiKeyNotes("cccccccccccd", "lost", nil)
+		assert.NoError(t, err)
+		assert.True(t, updated, "setting the same notes finds the YubiKey")
+		key, err := store.GetYubiKey("cccccccccccd")
+		assert.NoError(t, err)
+		assert.Equal(t, "lost", key.Notes)
+
+		deleted, err := store.DeleteYubiKey("cccccccccccd", nil)
+		assert.NoError(t, err)
+		assert.True(t, deleted)
+		deleted, err = store.DeleteYubiKey("cccccccccccd", nil)
+		assert.NoError(t, err)
+		assert.False(t, deleted)
+		toggled, err := store.ToggleYubiKey("cccccccccccd", true, nil)
+		assert.NoError(t, err)
+		assert.False(t, toggled, "unknown YubiKeys are not toggled")
+
+		entry := AdminLog{LoggedAt: 1600000000, Operator: "admin", Action: "keys delete", Target: "cccccccccccd"}
+		queue := []QueueEntry{{QueuedAt: 1600000000, ModifiedAt: 1600000000, ServerNonce: "nonce1", Server: "https://peer/wsapi/2.0/sync", Info: "action=delete"}}
+		require.NoError(t, store.InsertAdminLog(entry, queue))
+		require.NoError(t, store.InsertAdminLog(AdminLog{LoggedAt: 1600000100, Operator: "admin", Action: "keys disable", Target: "cccccccccccc"}, nil))
+
+		entries, err := store.GetAdminLogs("", 0)
+		assert.NoError(t, err)
+		require.Len(t, entries, 2)
+		assert.Equal(t, "cccccccccccc", entries[0].Target, "the latest entry comes first")
+		entries, err = store.GetAdminLogs("cccccccccccd", 10)
+		assert.NoError(t, err)
+		require.Len(t, entries, 1)
+		entries[0].Id = 0
+		assert.Equal(t, entry, entries[0])
+
+		lengths, err := store.GetQueueLengthByServer()
+		assert.NoError(t, err)
+		assert.Equal(t, map[string]int32{"https://peer/wsapi/2.0/sync": 1}, lengths)
+
+		change := &AdminChange{
+			Log:   AdminLog{LoggedAt: 1600000200, Operator: "admin", Action: "keys set-notes", Target: "cccccccccccc", Details: "notes=owner"},
+			Queue: []QueueEntry{{QueuedAt: 1600000200, ModifiedAt: 1600000200, ServerNonce: "nonce2", Server: "https://peer/wsapi/2.0/sync", Info: "action=set-notes"}},
+		}
+		updated, err = store.UpdateYubiKeyNotes("cccccccccccd", "owner", change)
+		assert.NoError(t, err)
+		assert.False(t, updated)
+		entries, err = store.GetAdminLogs("", 0)
+		assert.NoError(t, err)
+		assert.Len(t, entries, 2, "the change of an unknown YubiKey is not recorded")
+		updated, err = store.UpdateYubiKeyNotes("cccccccccccc", "owner", change)
+		assert.NoError(t, err)
+		assert.True(t, updated)
+		entries, err = store.GetAdminLogs("cccccccccccc", 1)
+		assert.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "keys set-notes", entries[0].Action)
+
+		queued, err := store.GetQueuedChanges()
+		assert.NoError(t, err)
+		require.Len(t, queued, 2)
+		assert.Equal(t, change.Queue[0], queued[1])
+		require.NoError(t, store.DeleteQueueEntry("https://peer/wsapi/2.0/sync", "nonce2"))
+		queued, err = store.GetQueuedChanges()
+		assert.NoError(t, err)
+		require.Len(t, queued, 1)
+		assert.Equal(t, "nonce1", queued[0].ServerNonce)
+
+		synced := QueueEntry{QueuedAt: 1600000000, ModifiedAt: 1600000000, ServerNonce: "nonce3", Otp: "ccccccccccccbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", Server: "https://peer/wsapi/2.0/sync"}
+		require.NoError(t, store.InsertAdminLog(AdminLog{LoggedAt: 1600000000, Operator: "admin", Action: "test"}, []QueueEntry{synced}))
+		count, err := store.CountExpired("queue", 1700000000)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), count)
+		pruned, err := store.DeleteExpired("queue", 1700000000, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), pruned, "only the OTPs are pruned")
+		queued, err = store.GetQueuedChanges()
+		assert.NoError(t, err)
+		require.Len(t, queued, 1, "changes which have not been sent are kept")
+		assert.Equal(t, "nonce1", queued[0].ServerNonce)
+	})
+
+	t.Run("import", func(t *testing.T) {
+		all := ImportOptions{Mode: IMPORT_INSERT_ONLY, Organization: ALL_ORGANIZATIONS}
+		keys := []YubiKey{
+			{Active: true, PublicName: "ccccccccccce", SessionCounter: 1, UseCounter: 1, Notes: "first"},
+			{Active: true, PublicName: "cccccccccccf", SessionCounter: 2, UseCounter: 0, SecretKey: "v1:secret", PrivateId: "0123456789ab"},
+		}
+
+		dryRun := all
+		dryRun.DryRun = true
+		changes, err := store.ImportYubiKeys(keys, dryRun)
+		assert.NoError(t, err)
+		assert.Equal(t, []ImportChange{{Target: "ccccccccccce", Action: IMPORT_ACTION_INSERT}, {Target: "cccccccccccf", Action: IMPORT_ACTION_INSERT}}, changes)
+		exists, err := store.YubiKeyExists("ccccccccccce")
+		assert.NoError(t, err)
+		assert.False(t, exists, "a dry run writes nothing")
+
+		changes, err = store.ImportYubiKeys(keys, all)
+		assert.NoError(t, err)
+		assert.Len(t, changes, 2)
+		changes, err = store.ImportYubiKeys(keys, all)
+		assert.NoError(t, err)
+		assert.Equal(t, IMPORT_ACTION_SKIP, changes[0].Action, "insert only skips existing YubiKeys")
+
+		keys[0].UseCounter, keys[0].Notes = 5, "second"
+		keys[1].SessionCounter, keys[1].SecretKey, keys[1].PrivateId = 1, "", ""
+		newer := ImportOptions{Mode: IMPORT_UPDATE_IF_NEWER, Organization: ALL_ORGANIZATIONS}
+		changes, err = store.ImportYubiKeys(keys, newer)
+		assert.NoError(t, err)
+		assert.Equal(t, []ImportChange{
+			{Target: "ccccccccccce", Action: IMPORT_ACTION_UPDATE, Changes: []string{"use_counter 1 -> 5", `notes "first" -> "second"`}},
+			{Target: "cccccccccccf", Action: IMPORT_ACTION_SKIP, Reason: "counters are not higher than the stored ones"},
+		}, changes)
+
+		overwrite := ImportOptions{Mode: IMPORT_OVERWRITE, Organization: ALL_ORGANIZATIONS}
+		changes, err = store.ImportYubiKeys(keys, overwrite)
+		assert.NoError(t, err)
+		assert.Equal(t, IMPORT_ACTION_SKIP, changes[0].Action, "unchanged YubiKeys are skipped")
+		assert.Equal(t, []string{"session_counter 2 -> 1"}, changes[1].Changes)
+		key, err := store.GetYubiKey("cccccccccccf")
+		assert.NoError(t, err)
+		assert.Equal(t, int32(1), key.SessionCounter)
+		assert.Equal(t, "v1:secret", key.SecretKey, "secrets are kept if none are imported")
+
+		secrets := []YubiKey{
+			{Active: true, PublicName: "ccccccccccce", SessionCounter: -1, UseCounter: -1, SecretKey: "v1:first", PrivateId: "000000000001"},
+			{Active: true, PublicName: "cccccccccccf", SessionCounter: -1, UseCounter: -1, SecretKey: "v1:other", PrivateId: "000000000002"},
+		}
+		changes, err = store.ImportYubiKeys(secrets, ImportOptions{Mode: IMPORT_UPDATE_IF_NEWER, Organization: ALL_ORGANIZATIONS, SecretsOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []ImportChange{
+			{Target: "ccccccccccce", Action: IMPORT_ACTION_UPDATE, Changes: []string{"secret_key changed", "private_id changed"}},
+			{Target: "cccccccccccf", Action: IMPORT_ACTION_SKIP, Reason: "already has a secret"},
+		}, changes)
+		changes, err = store.ImportYubiKeys(secrets, ImportOptions{Mode: IMPORT_OVERWRITE, Organization: ALL_ORGANIZATIONS, SecretsOnly: true})
+		assert.NoError(t, err)
+		assert.Equal(t, []string{"secret_key changed", "private_id changed"}, changes[1].Changes)
+		key, err = store.GetYubiKey("cccccccccccf")
+		assert.NoError(t, err)
+		assert.Equal(t, int32(1), key.SessionCounter, "counters are kept when only secrets are imported")
+		assert.Equal(t, "v1:other", key.SecretKey)
+
+		org, err := store.GetOrganization("acme")
+		require.NoError(t, err)
+		batches := []YubiKey{{PublicName: "cccccccccccg"}, {PublicName: "ccccccccccch"}, {PublicName: "ccccccccccce"}}
+		_, err = store.ImportYubiKeys(batches, ImportOptions{Mode: IMPORT_OVERWRITE, Organization: org.Id})
+		var importErr *ImportError
+		require.True(t, errors.As(err, &importErr), "YubiKeys of another organization are not changed")
+		assert.Equal(t, 2, importErr.Index)
+		assert.Equal(t, 0, importErr.Committed)
+		exists, err = store.YubiKeyExists("cccccccccccg")
+		assert.NoError(t, err)
+		assert.False(t, exists, "the transaction is rolled back")
+
+		changes, err = store.ImportYubiKeys(batches, ImportOptions{Mode: IMPORT_OVERWRITE, Organization: org.Id, BatchSize: 2})
+		require.True(t, errors.As(err, &importErr))
+		assert.Equal(t, 2, importErr.Committed)
+		assert.Len(t, changes, 2)
+		exists, err = store.YubiKeyExists("cccccccccccg")
+		assert.NoError(t, err)
+		assert.True(t, exists, "the batches before the error are committed")
+
+		_, err = store.ImportClients(nil, newer)
+		assert.Error(t, err, "clients have no counters")
+		_, err = store.RotateClientSecret(2, "bmV3", 1600000000, nil)
+		require.NoError(t, err)
+		existing, err := store.GetClient(2)
+		require.NoError(t, err)
+		existing.Active, existing.Secret = !existing.Active, "b3RoZXI="
+		clients := []Client{existing, {Id: 20, Secret: "c2VjcmV0"}}
+		changes, err = store.ImportClients(clients, all)
+		assert.NoError(t, err)
+		assert.Equal(t, []ImportChange{{Target: "2", Action: IMPORT_ACTION_SKIP, Reason: "already exists"}, {Target: "20", Action: IMPORT_ACTION_INSERT}}, changes)
+		changes, err = store.ImportClients(clients, overwrite)
+		assert.NoError(t, err)
+		assert.Equal(t, []string{fmt.Sprintf("active %v -> %v", !existing.Active, existing.Active), "secret changed", "previous_secret changed"}, changes[0].Changes)
+		client, err := store.GetClient(2)
+		assert.NoError(t, err)
+		assert.Equal(t, "b3RoZXI=", client.Secret)
+		assert.Equal(t, "", client.PreviousSecret, "an overwritten secret ends the rotation")
+	})
+
+	t.Run("restore", func(t *testing.T) {
+		require.NoError(t, store.UpdateQueue("nonce1"))
+		snapshot, err := store.GetSnapshot()
+		require.NoError(t, err)
+		assert.Len(t, snapshot.Organizations, 1)
+		assert.Len(t, snapshot.Clients, 4)
+		assert.Len(t, snapshot.YubiKeys, 6)
+		require.Len(t, snapshot.Queue, 1)
+		assert.Equal(t, int32(0), snapshot.Queue[0].QueuedAt, "NULL is returned as 0")
+
+		used := snapshot.YubiKeys[0]
+		used.ModifiedAt, used.SessionCounter, used.UseCounter, used.Nonce = 1700000000, used.SessionCounter+1, 0, "0123456789abcdef"
+		updated, err := store.UpdateYubiKeyCounters(used)
+		require.NoError(t, err)
+		require.True(t, updated)
+		kept, err := store.Restore(snapshot)
+		require.NoError(t, err)
+		assert.Equal(t, 1, kept)
+		key, err := store.GetYubiKey(used.PublicName)
+		assert.NoError(t, err)
+		assert.Equal(t, used, key, "the counters of a YubiKey used since the backup are not lowered")
+		key, err = store.GetYubiKey(snapshot.YubiKeys[1].PublicName)
+		assert.NoError(t, err)
+		assert.Equal(t, snapshot.YubiKeys[1], key)
+
+		kept, err = store.Restore(Snapshot{})
+		require.NoError(t, err)
+		assert.Equal(t, 0, kept)
+		clients, err := store.GetClients(ALL_ORGANIZATIONS)
+		assert.NoError(t, err)
+		assert.Empty(t, clients)
+
+		_, err = store.Restore(snapshot)
+		require.NoError(t, err)
+		restored, err := store.GetSnapshot()
+		assert.NoError(t, err)
+		assert.Equal(t, snapshot, restored)
+
+		require.NoError(t, store.InsertOrganization(Organization{Name: "later", Active: true}))
+		org, err := store.GetOrganization("later")
+		assert.NoError(t, err)
+		assert.True(t, org.Id > snapshot.Organizations[len(snapshot.Organizations)-1].Id, "ids continue after the restored ones")
+	})
+}
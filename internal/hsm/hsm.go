@@ -0,0 +1,229 @@
+//go:build cgo
+// +build cgo
+
+package hsm
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"github.com/miekg/pkcs11"
+	log "github.com/sirupsen/logrus"
+	"go-yubikey-val/internal/config"
+	"strings"
+)
+
+var (
+	ctx         *pkcs11.Ctx
+	sessions    chan pkcs11.SessionHandle
+	wrappingKey pkcs11.ObjectHandle
+)
+
+// Setup loads the PKCS#11 module, logs in to the configured token and looks up the wrapping key.
+func Setup() {
+	err := setup()
+	if err != nil {
+		log.Fatal("Could not set up PKCS#11 token: ", err)
+	}
+	log.Infof("Using PKCS#11 token %s with module %s",
+		config.Ksm.Pkcs11.TokenLabel, config.Ksm.Pkcs11.Module)
+	if wrappingKey == 0 {
+		log.Warn(ErrNoWrappingKey)
+	}
+}
+
+func setup() error {
+	conf := config.Ksm.Pkcs11
+	ctx = pkcs11.New(conf.Module)
+	if ctx == nil {
+		return fmt.Errorf("could not load PKCS#11 module %s", conf.Module)
+	}
+	if err := ctx.Initialize(); err != nil {
+		return err
+	}
+
+	slots, err := ctx.GetSlotList(true)
+	if err != nil {
+		return err
+	}
+	slot, found := uint(0), false
+	for _, s := range slots {
+		info, err := ctx.GetTokenInfo(s)
+		if err == nil && strings.TrimSpace(info.Label) == conf.TokenLabel {
+			slot, found = s, true
+			break
+		}
+	}
+	if !found {
+		return ErrNoToken
+	}
+
+	numSessions := conf.Sessions
+	if numSessions <= 0 {
+		numSessions = 1
+	}
+	sessions = make(chan pkcs11.SessionHandle, numSessions)
+	for i := 0; i < numSessions; i++ {
+		sh, err := ctx.OpenSession(slot, pkcs11.CKF_SERIAL_SESSION|pkcs11.CKF_RW_SESSION)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			// login state is shared by all sessions of the application
+			err = ctx.Login(sh, pkcs11.CKU_USER, conf.Pin)
+			if err != nil && err != pkcs11.Error(pkcs11.CKR_USER_ALREADY_LOGGED_IN) {
+				return err
+			}
+		}
+		sessions <- sh
+	}
+
+	return withSession(func(sh pkcs11.SessionHandle) error {
+		wrappingKey, err = findWrappingKey(sh)
+		return err
+	})
+}
+
+// Close logs out of the token and unloads the PKCS#11 module.
+func Close() {
+	if ctx == nil {
+		return
+	}
+	for i := len(sessions); i > 0; i-- {
+		sh := <-sessions
+		if i == 1 {
+			_ = ctx.Logout(sh)
+		}
+		_ = ctx.CloseSession(sh)
+	}
+	_ = ctx.Finalize()
+	ctx.Destroy()
+	ctx = nil
+	wrappingKey = 0
+}
+
+// GenerateWrappingKey generates a non-extractable AES-256 wrapping key inside the token.
+func GenerateWrappingKey() error {
+	if wrappingKey != 0 {
+		return ErrWrappingKeyExists
+	}
+	return withSession(func(sh pkcs11.SessionHandle) error {
+		var err error
+		wrappingKey, err = ctx.GenerateKey(sh,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_GEN, nil)},
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+				pkcs11.NewAttribute(pkcs11.CKA_VALUE_LEN, 32),
+				pkcs11.NewAttribute(pkcs11.CKA_LABEL, config.Ksm.Pkcs11.WrappingKeyLabel),
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, true),
+				pkcs11.NewAttribute(pkcs11.CKA_PRIVATE, true),
+				pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+				pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+				pkcs11.NewAttribute(pkcs11.CKA_WRAP, true),
+				pkcs11.NewAttribute(pkcs11.CKA_UNWRAP, true),
+			})
+		return err
+	})
+}
+
+// Wrap wraps the hex encoded secret key of a YubiKey with the wrapping key of the token.
+func Wrap(secretKey string) (string, error) {
+	if wrappingKey == 0 {
+		return "", ErrNoWrappingKey
+	}
+	keyBytes, err := hex.DecodeString(secretKey)
+	if err != nil || len(keyBytes) != 16 {
+		return "", fmt.Errorf("secret key must be 16 bytes encoded in hex")
+	}
+
+	var wrapped []byte
+	err = withSession(func(sh pkcs11.SessionHandle) error {
+		key, err := ctx.CreateObject(sh, []*pkcs11.Attribute{
+			pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+			pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+			pkcs11.NewAttribute(pkcs11.CKA_VALUE, keyBytes),
+			pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+			pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, true),
+		})
+		if err != nil {
+			return err
+		}
+		defer ctx.DestroyObject(sh, key)
+
+		wrapped, err = ctx.WrapKey(sh,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP, nil)}, wrappingKey, key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return wrappedPrefix + base64.StdEncoding.EncodeToString(wrapped), nil
+}
+
+// Decrypt unwraps the stored secret key inside the token and decrypts a single AES block with it,
+// the secret key never leaves the token.
+func Decrypt(stored string, block []byte) ([]byte, error) {
+	if wrappingKey == 0 {
+		return nil, ErrNoWrappingKey
+	}
+	if !IsWrapped(stored) {
+		return nil, fmt.Errorf("secret key is not wrapped by the PKCS#11 token")
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, wrappedPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("error decoding wrapped secret key: %v", err)
+	}
+
+	var plaintext []byte
+	err = withSession(func(sh pkcs11.SessionHandle) error {
+		key, err := ctx.UnwrapKey(sh,
+			[]*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_KEY_WRAP, nil)}, wrappingKey, wrapped,
+			[]*pkcs11.Attribute{
+				pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+				pkcs11.NewAttribute(pkcs11.CKA_KEY_TYPE, pkcs11.CKK_AES),
+				pkcs11.NewAttribute(pkcs11.CKA_TOKEN, false),
+				pkcs11.NewAttribute(pkcs11.CKA_SENSITIVE, true),
+				pkcs11.NewAttribute(pkcs11.CKA_EXTRACTABLE, false),
+				pkcs11.NewAttribute(pkcs11.CKA_DECRYPT, true),
+			})
+		if err != nil {
+			return err
+		}
+		defer ctx.DestroyObject(sh, key)
+
+		err = ctx.DecryptInit(sh, []*pkcs11.Mechanism{pkcs11.NewMechanism(pkcs11.CKM_AES_ECB, nil)}, key)
+		if err != nil {
+			return err
+		}
+		plaintext, err = ctx.Decrypt(sh, block)
+		return err
+	})
+
+	return plaintext, err
+}
+
+func findWrappingKey(sh pkcs11.SessionHandle) (pkcs11.ObjectHandle, error) {
+	err := ctx.FindObjectsInit(sh, []*pkcs11.Attribute{
+		pkcs11.NewAttribute(pkcs11.CKA_CLASS, pkcs11.CKO_SECRET_KEY),
+		pkcs11.NewAttribute(pkcs11.CKA_LABEL, config.Ksm.Pkcs11.WrappingKeyLabel),
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer ctx.FindObjectsFinal(sh)
+
+	objects, _, err := ctx.FindObjects(sh, 1)
+	if err != nil || len(objects) == 0 {
+		return 0, err
+	}
+	return objects[0], nil
+}
+
+// withSession runs f with a session taken from the pool, a session must not be used concurrently.
+func withSession(f func(sh pkcs11.SessionHandle) error) error {
+	sh := <-sessions
+	defer func() { sessions <- sh }()
+	return f(sh)
+}
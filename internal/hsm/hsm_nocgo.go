@@ -0,0 +1,27 @@
+//go:build !cgo
+// +build !cgo
+
+package hsm
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// Setup fails as PKCS#11 modules can only be loaded with cgo.
+func Setup() {
+	log.Fatal("Could not set up PKCS#11 token: ", ErrNoCgo)
+}
+
+func Close() {}
+
+func GenerateWrappingKey() error {
+	return ErrNoCgo
+}
+
+func Wrap(secretKey string) (string, error) {
+	return "", ErrNoCgo
+}
+
+func Decrypt(stored string, block []byte) ([]byte, error) {
+	return nil, ErrNoCgo
+}
@@ -0,0 +1,57 @@
+//go:build cgo
+// +build cgo
+
+package hsm
+
+import (
+	"crypto/aes"
+	"encoding/hex"
+	"github.com/stretchr/testify/assert"
+	"go-yubikey-val/internal/config"
+	"os"
+	"testing"
+)
+
+// TestWrapDecrypt runs against a SoftHSM token, which can be created with:
+//
+//	softhsm2-util --init-token --free --label ykval-test --pin 1234 --so-pin 5678
+//	YKVAL_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so YKVAL_PKCS11_PIN=1234 go test ./internal/hsm/
+func TestWrapDecrypt(t *testing.T) {
+	module := os.Getenv("YKVAL_PKCS11_MODULE")
+	if module == "" {
+		t.Skip("YKVAL_PKCS11_MODULE is not set")
+	}
+	config.Ksm.Pkcs11.Module = module
+	config.Ksm.Pkcs11.TokenLabel = "ykval-test"
+	config.Ksm.Pkcs11.Pin = os.Getenv("YKVAL_PKCS11_PIN")
+	config.Ksm.Pkcs11.WrappingKeyLabel = "ykval-test-wrapping-key"
+	config.Ksm.Pkcs11.Sessions = 2
+
+	err := setup()
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer Close()
+	if wrappingKey == 0 {
+		assert.NoError(t, GenerateWrappingKey())
+	}
+	assert.Equal(t, ErrWrappingKeyExists, GenerateWrappingKey())
+
+	secretKey := "ecde18dbe76fbd0c33330f1c354871db"
+	wrapped, err := Wrap(secretKey)
+	assert.NoError(t, err)
+	assert.True(t, IsWrapped(wrapped))
+
+	keyBytes, _ := hex.DecodeString(secretKey)
+	block, _ := aes.NewCipher(keyBytes)
+	plaintext := []byte("0123456789abcdef")
+	ciphertext := make([]byte, len(plaintext))
+	block.Encrypt(ciphertext, plaintext)
+
+	actual, err := Decrypt(wrapped, ciphertext)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, actual)
+
+	_, err = Decrypt(secretKey, ciphertext)
+	assert.Error(t, err)
+}
@@ -0,0 +1,20 @@
+package hsm
+
+import (
+	"errors"
+	"strings"
+)
+
+const wrappedPrefix = "p11:"
+
+var (
+	ErrNoCgo             = errors.New("PKCS#11 support requires a build with cgo enabled")
+	ErrNoToken           = errors.New("no PKCS#11 token found with the configured label")
+	ErrNoWrappingKey     = errors.New("no wrapping key found in the PKCS#11 token")
+	ErrWrappingKeyExists = errors.New("a wrapping key with the configured label already exists in the PKCS#11 token")
+)
+
+// IsWrapped checks whether a stored secret key is wrapped by the PKCS#11 token.
+func IsWrapped(stored string) bool {
+	return strings.HasPrefix(stored, wrappedPrefix)
+}
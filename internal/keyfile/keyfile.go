@@ -0,0 +1,194 @@
+package keyfile
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	FORMAT_YKMAN         = "ykman"
+	FORMAT_YKPERSONALIZE = "ykpersonalize"
+	FORMAT_YKKSM         = "ykksm"
+
+	// MAX_PUBLIC_ID_LENGTH is the length in modhex characters of the public name of a YubiKey in the database.
+	MAX_PUBLIC_ID_LENGTH = 16
+
+	modhexAlphabet = "cbdefghijklnrtuv"
+)
+
+var (
+	modhexPattern    = regexp.MustCompile(`^[cbdefghijklnrtuv]+$`)
+	privateIdPattern = regexp.MustCompile(`^[0-9a-f]{12}$`)
+	secretKeyPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+)
+
+// Record is the configuration of a YubiKey OTP slot, as logged by the programming tools.
+type Record struct {
+	Line      int
+	Serial    string
+	PublicId  string // modhex encoded
+	PrivateId string // hex encoded
+	SecretKey string // hex encoded AES-128 key
+	Created   time.Time
+	Active    bool
+}
+
+// Parse reads the records of a YubiKey Manager or ykpersonalize log, or of a ykksm-export file,
+// it returns all invalid lines as errors with their line numbers.
+func Parse(format string, reader io.Reader) ([]Record, []error) {
+	var records []Record
+	var errs []error
+
+	// records of these formats never span multiple lines, so every line is parsed on its own
+	scanner := bufio.NewScanner(reader)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+
+		csvReader := csv.NewReader(strings.NewReader(text))
+		csvReader.TrimLeadingSpace = true
+		fields, err := csvReader.Read()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+
+		record, ok, err := parseFields(format, fields)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		if !ok {
+			continue
+		}
+		record.Line = line
+		if err := record.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		records = append(records, record)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return records, errs
+}
+
+// parseFields converts the fields of a line to a record, it returns false for lines which
+// don't contain a Yubico OTP configuration.
+func parseFields(format string, fields []string) (Record, bool, error) {
+	record := Record{Active: true}
+	switch format {
+	case FORMAT_YKMAN:
+		// serial, public id, private id, secret key, access code, timestamp
+		if len(fields) < 4 {
+			return record, false, fmt.Errorf("expected at least 4 fields, got %d", len(fields))
+		}
+		record.Serial = fields[0]
+		record.PublicId, record.PrivateId, record.SecretKey = fields[1], fields[2], fields[3]
+		if len(fields) > 5 {
+			record.Created, _ = time.Parse("2006-01-02T15:04:05", fields[5])
+		}
+	case FORMAT_YKPERSONALIZE:
+		// type, timestamp, slot, public id, private id, secret key, access codes and flags
+		if fields[0] != "Yubico OTP" {
+			return record, false, nil
+		}
+		if len(fields) < 6 {
+			return record, false, fmt.Errorf("expected at least 6 fields, got %d", len(fields))
+		}
+		record.Created, _ = time.Parse("01/02/06 15:04", fields[1])
+		record.PublicId, record.PrivateId, record.SecretKey = fields[3], fields[4], fields[5]
+	case FORMAT_YKKSM:
+		// serialnr, publicname, created, internalname, aeskey, lockcode, creator, active, hardware
+		if len(fields) < 8 {
+			return record, false, fmt.Errorf("expected at least 8 fields, got %d", len(fields))
+		}
+		record.Serial = fields[0]
+		record.PublicId, record.PrivateId, record.SecretKey = fields[1], fields[3], fields[4]
+		record.Created, _ = time.Parse("2006-01-02T15:04:05", fields[2])
+		record.Active = fields[7] == "1" || fields[7] == "t" || strings.EqualFold(fields[7], "true")
+	default:
+		return record, false, fmt.Errorf("unknown format %s", format)
+	}
+
+	record.PublicId = strings.ToLower(strings.TrimSpace(record.PublicId))
+	record.PrivateId = strings.ToLower(strings.TrimSpace(record.PrivateId))
+	record.SecretKey = strings.ToLower(strings.TrimSpace(record.SecretKey))
+	return record, true, nil
+}
+
+// Format converts the record to the CSV fields of a YubiKey Manager or ykpersonalize log line, or
+// of a ykksm-export line without an access code.
+func Format(format string, r Record) ([]string, error) {
+	switch format {
+	case FORMAT_YKMAN:
+		// serial, public id, private id, secret key, access code, timestamp
+		return []string{r.Serial, r.PublicId, r.PrivateId, r.SecretKey, "",
+			r.Created.Format("2006-01-02T15:04:05"), ""}, nil
+	case FORMAT_YKPERSONALIZE:
+		// type, timestamp, slot, public id, private id, secret key, access codes and flags
+		return []string{"Yubico OTP", r.Created.Format("01/02/06 15:04"), "1",
+			r.PublicId, r.PrivateId, r.SecretKey, "", "", "0", "0", "0", "0", "0", "0", "0", "0", "0", "0"}, nil
+	case FORMAT_YKKSM:
+		// serialnr, publicname, created, internalname, aeskey, lockcode, creator, active, hardware
+		serial, active := r.Serial, "0"
+		if serial == "" {
+			serial = "0"
+		}
+		if r.Active {
+			active = "1"
+		}
+		return []string{serial, r.PublicId, r.Created.Format("2006-01-02T15:04:05"), r.PrivateId, r.SecretKey,
+			"000000000000", "", active, "1"}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+}
+
+// Validate checks the encoding and length of the record's fields.
+func (r Record) Validate() error {
+	if len(r.PublicId) < 2 || len(r.PublicId) > MAX_PUBLIC_ID_LENGTH || !modhexPattern.MatchString(r.PublicId) {
+		return fmt.Errorf("invalid public id %q: must be 2 to %d modhex characters", r.PublicId, MAX_PUBLIC_ID_LENGTH)
+	}
+	if !privateIdPattern.MatchString(r.PrivateId) {
+		return fmt.Errorf("invalid private id %q: must be 12 hex characters", r.PrivateId)
+	}
+	if !secretKeyPattern.MatchString(r.SecretKey) {
+		return fmt.Errorf("invalid secret key for %s: must be 32 hex characters", r.PublicId)
+	}
+	return nil
+}
+
+// IsModhex checks whether the string only contains modhex characters.
+func IsModhex(str string) bool {
+	return modhexPattern.MatchString(str)
+}
+
+// ModhexIncrement returns the modhex string incremented by one,
+// it returns false if the string overflows.
+func ModhexIncrement(str string) (string, bool) {
+	digits := []byte(str)
+	for i := len(digits) - 1; i >= 0; i-- {
+		value := strings.IndexByte(modhexAlphabet, digits[i])
+		if value < 0 {
+			return str, false
+		}
+		if value < len(modhexAlphabet)-1 {
+			digits[i] = modhexAlphabet[value+1]
+			return string(digits), true
+		}
+		digits[i] = modhexAlphabet[0]
+	}
+	return string(digits), false
+}
@@ -0,0 +1,109 @@
+package keyfile
+
+import (
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat(t *testing.T) {
+	record := Record{
+		PublicId:  "vvcccccccccb",
+		PrivateId: "a1b2c3d4e5f6",
+		SecretKey: "ecde18dbe76fbd0c33330f1c354871db",
+		Created:   time.Date(2020, 3, 20, 10, 23, 45, 0, time.UTC),
+	}
+	var tests = []struct {
+		format   string
+		expected []string
+	}{
+		{FORMAT_YKMAN,
+			[]string{"", "vvcccccccccb", "a1b2c3d4e5f6", "ecde18dbe76fbd0c33330f1c354871db", "", "2020-03-20T10:23:45", ""}},
+		{FORMAT_YKPERSONALIZE,
+			[]string{"Yubico OTP", "03/20/20 10:23", "1", "vvcccccccccb", "a1b2c3d4e5f6", "ecde18dbe76fbd0c33330f1c354871db",
+				"", "", "0", "0", "0", "0", "0", "0", "0", "0", "0", "0"}},
+		{FORMAT_YKKSM,
+			[]string{"0", "vvcccccccccb", "2020-03-20T10:23:45", "a1b2c3d4e5f6", "ecde18dbe76fbd0c33330f1c354871db",
+				"000000000000", "", "0", "1"}},
+	}
+
+	for _, test := range tests {
+		actual, err := Format(test.format, record)
+		assert.NoError(t, err)
+		assert.Equal(t, test.expected, actual)
+	}
+
+	_, err := Format("unknown", record)
+	assert.Error(t, err)
+}
+
+func TestModhexIncrement(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected string
+		ok       bool
+	}{
+		{"cccc", "cccb", true},
+		{"cccv", "ccbc", true},
+		{"vvcccccvvvvv", "vvccccbccccc", true},
+		{"vvvv", "cccc", false},
+		{"ccca", "ccca", false},
+	}
+
+	for _, test := range tests {
+		actual, ok := ModhexIncrement(test.in)
+		assert.Equal(t, test.expected, actual)
+		assert.Equal(t, test.ok, ok)
+	}
+}
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		format   string
+		in       string
+		expected []Record
+		errors   int
+	}{
+		{FORMAT_YKMAN,
+			"5439181,vvcccccccccb,a1b2c3d4e5f6,ECDE18DBE76FBD0C33330F1C354871DB,,2020-03-20T10:23:45,\n" +
+				"\n" +
+				",vvcccccccccd,a1b2c3d4e5f7,ecde18dbe76fbd0c33330f1c354871dc\n",
+			[]Record{
+				{1, "5439181", "vvcccccccccb", "a1b2c3d4e5f6", "ecde18dbe76fbd0c33330f1c354871db",
+					time.Date(2020, 3, 20, 10, 23, 45, 0, time.UTC), true},
+				{3, "", "vvcccccccccd", "a1b2c3d4e5f7", "ecde18dbe76fbd0c33330f1c354871dc", time.Time{}, true},
+			}, 0},
+		{FORMAT_YKPERSONALIZE,
+			"LOGGING START,03/20/20 10:20\n" +
+				"Yubico OTP,03/20/20 10:23,1,vvcccccccccb,a1b2c3d4e5f6,ecde18dbe76fbd0c33330f1c354871db,,,0,0,0,0,0,0,0,0,0,0\n" +
+				"Static Password,03/20/20 10:24,2,,,ecde18dbe76fbd0c33330f1c354871db,,,0,0,0,0,0,0,0,0,0,0\n",
+			[]Record{
+				{2, "", "vvcccccccccb", "a1b2c3d4e5f6", "ecde18dbe76fbd0c33330f1c354871db",
+					time.Date(2020, 3, 20, 10, 23, 0, 0, time.UTC), true},
+			}, 0},
+		{FORMAT_YKKSM,
+			"# ykksm 1\n" +
+				"1,vvcccccccccb,2020-03-20T10:23:45,a1b2c3d4e5f6,ecde18dbe76fbd0c33330f1c354871db,000000000000,,0,1\n",
+			[]Record{
+				{2, "1", "vvcccccccccb", "a1b2c3d4e5f6", "ecde18dbe76fbd0c33330f1c354871db",
+					time.Date(2020, 3, 20, 10, 23, 45, 0, time.UTC), false},
+			}, 0},
+		{FORMAT_YKMAN,
+			",vvcccccccccx,a1b2c3d4e5f6,ecde18dbe76fbd0c33330f1c354871db\n" +
+				",vvcccccccccb,a1b2c3d4e5,ecde18dbe76fbd0c33330f1c354871db\n" +
+				",vvcccccccccb,a1b2c3d4e5f6,ecde18dbe76fbd0c\n" +
+				",vvcccccccccb\n" +
+				",vvccccccccccccccb,a1b2c3d4e5f6,ecde18dbe76fbd0c33330f1c354871db\n" +
+				",vvcccccccccc,a1b2c3d4e5f6,ecde18dbe76fbd0c33330f1c354871db\n",
+			[]Record{
+				{6, "", "vvcccccccccc", "a1b2c3d4e5f6", "ecde18dbe76fbd0c33330f1c354871db", time.Time{}, true},
+			}, 5},
+	}
+
+	for _, test := range tests {
+		actual, errs := Parse(test.format, strings.NewReader(test.in))
+		assert.Equal(t, test.expected, actual)
+		assert.Len(t, errs, test.errors)
+	}
+}
@@ -0,0 +1,246 @@
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// FANOUT is the number of children of each inner node, a node is addressed by the hex digits of
+	// the path leading to it, so the root is "" and the buckets are "00" to "ff".
+	FANOUT = 16
+	DEPTH  = 2
+
+	hexDigits = "0123456789abcdef"
+)
+
+// Field is a compared column of a row, the value of a Secret field is a fingerprint which is
+// never printed.
+type Field struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Secret bool   `json:"secret,omitempty"`
+}
+
+// Entry is a row of a table, identified by its Key.
+type Entry struct {
+	Key    string  `json:"key"`
+	Fields []Field `json:"fields"`
+}
+
+// Node is a node of a tree as exchanged with a peer, an inner node has the hashes of its children
+// and a bucket has its entries.
+type Node struct {
+	Path     string   `json:"path"`
+	Hash     string   `json:"hash"`
+	Children []string `json:"children,omitempty"`
+	Entries  []Entry  `json:"entries,omitempty"`
+}
+
+// Difference is a row which differs between two trees, Local or Peer is nil if it only exists on
+// the other side.
+type Difference struct {
+	Key   string
+	Local *Entry
+	Peer  *Entry
+}
+
+// Tree is a hash tree of a table, its rows are spread over FANOUT^DEPTH buckets by the hash of
+// their keys, so two trees can be compared by only descending into the nodes which differ.
+type Tree struct {
+	buckets [][]Entry
+	hashes  map[string]string
+}
+
+// Build creates the tree of the entries, their keys have to be unique.
+func Build(entries []Entry) *Tree {
+	t := &Tree{
+		buckets: make([][]Entry, bucketCount()),
+		hashes:  make(map[string]string),
+	}
+	for _, entry := range entries {
+		i := bucketIndex(entry.Key)
+		t.buckets[i] = append(t.buckets[i], entry)
+	}
+	for _, bucket := range t.buckets {
+		sort.Slice(bucket, func(i, j int) bool { return bucket[i].Key < bucket[j].Key })
+	}
+	t.hash("")
+	return t
+}
+
+// Node returns the node at the path, with the hashes of its children or the entries of its bucket.
+func (t *Tree) Node(path string) (Node, error) {
+	hash, ok := t.hashes[path]
+	if !ok {
+		return Node{}, fmt.Errorf("invalid node %q", path)
+	}
+	node := Node{Path: path, Hash: hash}
+	if len(path) == DEPTH {
+		node.Entries = t.buckets[bucketOfPath(path)]
+		if node.Entries == nil {
+			node.Entries = []Entry{}
+		}
+		return node, nil
+	}
+	for i := 0; i < FANOUT; i++ {
+		node.Children = append(node.Children, t.hashes[path+hexDigits[i:i+1]])
+	}
+	return node, nil
+}
+
+// Root returns the hash of the whole tree.
+func (t *Tree) Root() string {
+	return t.hashes[""]
+}
+
+// Compare finds the rows which differ from the tree of a peer, whose nodes are requested with
+// fetch. Only the nodes whose hashes differ are requested, the differences are sorted by key.
+func Compare(local *Tree, fetch func(path string) (Node, error)) ([]Difference, error) {
+	var differences []Difference
+	var compare func(path string) error
+	compare = func(path string) error {
+		peer, err := fetch(path)
+		if err != nil {
+			return err
+		}
+		if peer.Path != path {
+			return fmt.Errorf("peer answered node %q for node %q", peer.Path, path)
+		}
+		if peer.Hash == local.hashes[path] {
+			return nil
+		}
+
+		if len(path) == DEPTH {
+			differences = append(differences, diffBucket(local.buckets[bucketOfPath(path)], peer.Entries)...)
+			return nil
+		}
+		if len(peer.Children) != FANOUT {
+			return fmt.Errorf("peer answered %d children for node %q, expected %d", len(peer.Children), path, FANOUT)
+		}
+		for i, hash := range peer.Children {
+			child := path + hexDigits[i:i+1]
+			if hash == local.hashes[child] {
+				continue
+			}
+			if err := compare(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := compare(""); err != nil {
+		return nil, err
+	}
+	sort.Slice(differences, func(i, j int) bool { return differences[i].Key < differences[j].Key })
+	return differences, nil
+}
+
+// Changes describes how the fields of a difference changed from the local to the peer's value,
+// Secret fields are only reported as changed.
+func (d Difference) Changes() []string {
+	if d.Local == nil || d.Peer == nil {
+		return nil
+	}
+	peerFields := make(map[string]Field)
+	for _, field := range d.Peer.Fields {
+		peerFields[field.Name] = field
+	}
+
+	var changes []string
+	for _, field := range d.Local.Fields {
+		peer, ok := peerFields[field.Name]
+		delete(peerFields, field.Name)
+		switch {
+		case !ok:
+			changes = append(changes, field.Name+" missing on peer")
+		case peer.Value == field.Value:
+		case field.Secret || peer.Secret:
+			changes = append(changes, field.Name+" differs")
+		default:
+			changes = append(changes, fmt.Sprintf("%s %s -> %s", field.Name, field.Value, peer.Value))
+		}
+	}
+	for _, field := range d.Peer.Fields {
+		if _, ok := peerFields[field.Name]; ok {
+			changes = append(changes, field.Name+" only on peer")
+		}
+	}
+	return changes
+}
+
+// hash computes the hashes of the node at the path and of all nodes below it.
+func (t *Tree) hash(path string) string {
+	h := sha256.New()
+	if len(path) == DEPTH {
+		for _, entry := range t.buckets[bucketOfPath(path)] {
+			h.Write([]byte(entryHash(entry)))
+		}
+	} else {
+		for i := 0; i < FANOUT; i++ {
+			h.Write([]byte(t.hash(path + hexDigits[i:i+1])))
+		}
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	t.hashes[path] = hash
+	return hash
+}
+
+func entryHash(entry Entry) string {
+	var b strings.Builder
+	b.WriteString(entry.Key)
+	for _, field := range entry.Fields {
+		b.WriteString("\t" + field.Name + "=" + field.Value)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
+
+func diffBucket(local []Entry, peer []Entry) []Difference {
+	peerEntries := make(map[string]*Entry)
+	for i := range peer {
+		peerEntries[peer[i].Key] = &peer[i]
+	}
+
+	var differences []Difference
+	for i := range local {
+		entry := &local[i]
+		other, ok := peerEntries[entry.Key]
+		delete(peerEntries, entry.Key)
+		if !ok {
+			differences = append(differences, Difference{Key: entry.Key, Local: entry})
+		} else if entryHash(*entry) != entryHash(*other) {
+			differences = append(differences, Difference{Key: entry.Key, Local: entry, Peer: other})
+		}
+	}
+	for key, entry := range peerEntries {
+		differences = append(differences, Difference{Key: key, Peer: entry})
+	}
+	return differences
+}
+
+func bucketCount() int {
+	count := 1
+	for i := 0; i < DEPTH; i++ {
+		count *= FANOUT
+	}
+	return count
+}
+
+// bucketIndex spreads the keys evenly over the buckets by the first hex digits of their hash.
+func bucketIndex(key string) int {
+	sum := sha256.Sum256([]byte(key))
+	return bucketOfPath(hex.EncodeToString(sum[:])[:DEPTH])
+}
+
+func bucketOfPath(path string) int {
+	index := 0
+	for _, digit := range path {
+		index = index*FANOUT + strings.IndexRune(hexDigits, digit)
+	}
+	return index
+}
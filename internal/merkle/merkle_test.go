@@ -0,0 +1,83 @@
+package merkle
+
+import (
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func entries(count int) []Entry {
+	var result []Entry
+	for i := 0; i < count; i++ {
+		result = append(result, Entry{Key: fmt.Sprintf("key%d", i), Fields: []Field{
+			{Name: "counter", Value: fmt.Sprint(i)},
+			{Name: "secret", Value: "fingerprint", Secret: true},
+		}})
+	}
+	return result
+}
+
+// counting fetches the nodes of the peer tree and counts the requests
+func counting(peer *Tree, requests *int) func(path string) (Node, error) {
+	return func(path string) (Node, error) {
+		*requests++
+		return peer.Node(path)
+	}
+}
+
+func TestBuild(t *testing.T) {
+	a, b := entries(100), entries(100)
+	b[0], b[99] = b[99], b[0]
+	assert.Equal(t, Build(a).Root(), Build(b).Root(), "the order of the entries does not matter")
+	assert.NotEqual(t, Build(a).Root(), Build(a[1:]).Root())
+
+	root, err := Build(a).Node("")
+	require.NoError(t, err)
+	assert.Len(t, root.Children, FANOUT)
+	bucket, err := Build(nil).Node("0f")
+	require.NoError(t, err)
+	assert.Equal(t, []Entry{}, bucket.Entries)
+	_, err = Build(a).Node("0g")
+	assert.EqualError(t, err, `invalid node "0g"`)
+}
+
+func TestCompare(t *testing.T) {
+	local, peer := entries(1000), entries(1000)
+	requests := 0
+	differences, err := Compare(Build(local), counting(Build(peer), &requests))
+	require.NoError(t, err)
+	assert.Empty(t, differences)
+	assert.Equal(t, 1, requests, "equal trees only need the root")
+
+	peer[10].Fields[0].Value = "11"
+	peer[20].Fields[1].Value = "other"
+	peer = append(peer[:30], peer[31:]...)
+	local = local[1:]
+	requests = 0
+	differences, err = Compare(Build(local), counting(Build(peer), &requests))
+	require.NoError(t, err)
+	assert.True(t, requests <= 1+4*2, "only differing nodes are requested")
+
+	require.Len(t, differences, 4)
+	assert.Equal(t, "key0", differences[0].Key)
+	assert.Nil(t, differences[0].Local)
+	assert.Equal(t, "key10", differences[1].Key)
+	assert.Equal(t, []string{"counter 10 -> 11"}, differences[1].Changes())
+	assert.Equal(t, "key20", differences[2].Key)
+	assert.Equal(t, []string{"secret differs"}, differences[2].Changes())
+	assert.Equal(t, "key30", differences[3].Key)
+	assert.Nil(t, differences[3].Peer)
+}
+
+func TestCompareInvalidPeer(t *testing.T) {
+	_, err := Compare(Build(entries(10)), func(path string) (Node, error) {
+		return Node{Path: path, Hash: "other", Children: []string{"a"}}, nil
+	})
+	assert.EqualError(t, err, `peer answered 1 children for node "", expected 16`)
+
+	_, err = Compare(Build(entries(10)), func(path string) (Node, error) {
+		return Node{Path: "ab"}, nil
+	})
+	assert.EqualError(t, err, `peer answered node "ab" for node ""`)
+}
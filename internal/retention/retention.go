@@ -0,0 +1,129 @@
+package retention
+
+import (
+	log "github.com/sirupsen/logrus"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"time"
+)
+
+const DEFAULT_BATCH_SIZE = 1000
+
+// Policy keeps the rows of a table for a number of days.
+type Policy struct {
+	Table string
+	Days  int
+}
+
+// Result is the number of rows of a table older than a time, which have been (or would be) deleted.
+type Result struct {
+	Table  string
+	Before time.Time
+	Rows   int64
+}
+
+var stop, done chan struct{}
+
+// Policies gets the configured retention of each table, tables kept forever are left out.
+func Policies() []Policy {
+	var policies []Policy
+	for _, p := range []Policy{
+		{"auth_log", config.Retention.AuthLog},
+		{"queue", config.Retention.Queue},
+		{"yubikeys_history", config.Retention.YubiKeysHistory},
+	} {
+		if p.Days > 0 {
+			policies = append(policies, p)
+		}
+	}
+	return policies
+}
+
+// BatchSize gets the configured number of rows deleted by each statement.
+func BatchSize() int {
+	if config.Retention.BatchSize <= 0 {
+		return DEFAULT_BATCH_SIZE
+	}
+	return config.Retention.BatchSize
+}
+
+// Prune deletes the rows older than the retention of their table in batches, or only counts them
+// on a dry run. The results of the tables pruned before an error are returned with it.
+func Prune(store database.Storage, policies []Policy, now time.Time, batchSize int, dryRun bool) ([]Result, error) {
+	var results []Result
+	for _, p := range policies {
+		result := Result{Table: p.Table, Before: now.AddDate(0, 0, -p.Days)}
+		before := int32(result.Before.Unix())
+
+		if dryRun {
+			rows, err := store.CountExpired(p.Table, before)
+			if err != nil {
+				return results, err
+			}
+			result.Rows = rows
+		} else {
+			for {
+				rows, err := store.DeleteExpired(p.Table, before, batchSize)
+				if err != nil {
+					return results, err
+				}
+				result.Rows += rows
+				if rows < int64(batchSize) {
+					break
+				}
+			}
+		}
+
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// LogResults logs a summary of pruning.
+func LogResults(results []Result, dryRun bool) {
+	for _, r := range results {
+		log.WithFields(log.Fields{
+			"table":   r.Table,
+			"before":  r.Before.Format("2006-01-02 15:04:05"),
+			"rows":    r.Rows,
+			"dry_run": dryRun,
+		}).Info("Pruned expired rows")
+	}
+}
+
+// Start prunes in the background of the server every configured interval, if it is set.
+func Start() {
+	if config.Retention.Interval <= 0 || len(Policies()) == 0 {
+		return
+	}
+	interval := time.Duration(config.Retention.Interval) * time.Hour
+	stop, done = make(chan struct{}), make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				results, err := Prune(database.Store, Policies(), time.Now(), BatchSize(), false)
+				LogResults(results, false)
+				if err != nil {
+					log.Error("Pruning failed: ", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(stop, done)
+	log.Infof("Pruning expired rows every %s", interval)
+}
+
+// Stop stops pruning in the background, and waits until a running prune has finished.
+func Stop() {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	stop, done = nil, nil
+}
@@ -0,0 +1,60 @@
+package retention
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPolicies(t *testing.T) {
+	config.Retention.AuthLog = 90
+	config.Retention.YubiKeysHistory = 365
+	defer func() { config.Retention.AuthLog, config.Retention.YubiKeysHistory = 0, 0 }()
+
+	assert.Equal(t, []Policy{{"auth_log", 90}, {"yubikeys_history", 365}}, Policies())
+	assert.Equal(t, DEFAULT_BATCH_SIZE, BatchSize())
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := database.Open(database.DRIVER_SQLITE, "file:"+filepath.Join(dir, "ykval.db"))
+	require.NoError(t, err)
+	defer store.Close()
+
+	now := time.Date(2020, 10, 1, 12, 0, 0, 0, time.UTC)
+	var entries []database.AuthLog
+	for days := 0; days < 25; days++ {
+		entries = append(entries, database.AuthLog{LoggedAt: int32(now.AddDate(0, 0, -days).Unix()), Status: "OK"})
+	}
+	require.NoError(t, store.InsertAuthLogs(entries))
+	policies := []Policy{{"auth_log", 10}, {"queue", 1}}
+
+	results, err := Prune(store, policies, now, 4, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []Result{
+		{"auth_log", now.AddDate(0, 0, -10), 14},
+		{"queue", now.AddDate(0, 0, -1), 0},
+	}, results)
+	remaining, err := store.GetAuthLogs(database.AuthLogFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, remaining, 25, "nothing is deleted on a dry run")
+
+	results, err = Prune(store, policies, now, 4, false)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(14), results[0].Rows)
+	remaining, err = store.GetAuthLogs(database.AuthLogFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, remaining, 11)
+	assert.Equal(t, int32(now.AddDate(0, 0, -10).Unix()), remaining[0].LoggedAt)
+
+	_, err = Prune(store, []Policy{{"yubikeys", 1}}, now, 4, false)
+	assert.Error(t, err, "only the expiring tables can be pruned")
+}
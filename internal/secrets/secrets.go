@@ -0,0 +1,147 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"go-yubikey-val/internal/config"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+)
+
+const (
+	// MasterKeyEnv is the environment variable the master key is read from, it takes precedence over the key file.
+	MasterKeyEnv = "YKVAL_MASTER_KEY"
+
+	masterKeySize = 32
+	sealedPrefix  = "v1:"
+)
+
+var (
+	ErrNoMasterKey      = errors.New("no master key configured")
+	ErrInvalidMasterKey = errors.New("master key must be 32 bytes encoded in hex or base64")
+	ErrInvalidSecretKey = errors.New("secret key must be 16 bytes encoded in hex")
+
+	MasterKey []byte
+
+	secretKeyPattern = regexp.MustCompile(`^[0-9a-fA-F]{32}$`)
+)
+
+// Setup loads the master key from the environment variable or the configured key file.
+// Secrets can still be read but not written if neither of them is set.
+func Setup() {
+	var err error
+	MasterKey, err = LoadMasterKey(os.Getenv(MasterKeyEnv), config.Ksm.MasterKeyFile)
+	if err != nil && err != ErrNoMasterKey {
+		log.Fatal("Could not load master key: ", err)
+	}
+	if MasterKey == nil {
+		log.Warn("No master key configured, YubiKey secrets can not be encrypted")
+	}
+}
+
+// LoadMasterKey parses the master key from the encoded value, or from the file if the value is empty.
+func LoadMasterKey(encoded string, file string) ([]byte, error) {
+	if encoded == "" {
+		if file == "" {
+			return nil, ErrNoMasterKey
+		}
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(content)
+	}
+	return ParseMasterKey(encoded)
+}
+
+// ParseMasterKey decodes a hex or base64 encoded master key.
+func ParseMasterKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != masterKeySize {
+		return nil, ErrInvalidMasterKey
+	}
+	return key, nil
+}
+
+// IsSealed checks whether a stored secret key is encrypted.
+func IsSealed(stored string) bool {
+	return strings.HasPrefix(stored, sealedPrefix)
+}
+
+// ValidSecretKey checks whether a plaintext secret key is a hex encoded AES-128 key.
+func ValidSecretKey(secretKey string) bool {
+	return secretKeyPattern.MatchString(secretKey)
+}
+
+// Seal encrypts the hex encoded secret key of a YubiKey with AES-GCM under the master key,
+// the public name is authenticated as well so a sealed secret can not be moved to another YubiKey.
+func Seal(masterKey []byte, publicName string, secretKey string) (string, error) {
+	if masterKey == nil {
+		return "", ErrNoMasterKey
+	}
+	if !ValidSecretKey(secretKey) {
+		return "", ErrInvalidSecretKey
+	}
+	plaintext, _ := hex.DecodeString(secretKey)
+
+	aead, err := newAead(masterKey)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plaintext, []byte(publicName))
+
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a stored secret key and returns it hex encoded,
+// secret keys stored in plaintext are returned unchanged.
+func Open(masterKey []byte, publicName string, stored string) (string, error) {
+	if !IsSealed(stored) {
+		return stored, nil
+	}
+	if masterKey == nil {
+		return "", ErrNoMasterKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(stored, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("error decoding sealed secret key: %v", err)
+	}
+	aead, err := newAead(masterKey)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("sealed secret key is too short")
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(publicName))
+	if err != nil {
+		return "", fmt.Errorf("error decrypting secret key of %s: %v", publicName, err)
+	}
+
+	return hex.EncodeToString(plaintext), nil
+}
+
+func newAead(masterKey []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,65 @@
+package secrets
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+var testMasterKey = []byte("0123456789abcdef0123456789abcdef")
+
+func TestSealOpen(t *testing.T) {
+	secretKey := "ecde18dbe76fbd0c33330f1c354871db"
+
+	sealed, err := Seal(testMasterKey, "interncccccc", secretKey)
+	assert.NoError(t, err)
+	assert.True(t, IsSealed(sealed))
+	assert.NotContains(t, sealed, secretKey)
+
+	actual, err := Open(testMasterKey, "interncccccc", sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, secretKey, actual)
+
+	// a sealed secret is bound to its YubiKey
+	_, err = Open(testMasterKey, "internccccce", sealed)
+	assert.Error(t, err)
+
+	_, err = Open([]byte("fedcba9876543210fedcba9876543210"), "interncccccc", sealed)
+	assert.Error(t, err)
+
+	_, err = Open(nil, "interncccccc", sealed)
+	assert.Equal(t, ErrNoMasterKey, err)
+}
+
+func TestOpenPlaintext(t *testing.T) {
+	actual, err := Open(nil, "interncccccc", "ecde18dbe76fbd0c33330f1c354871db")
+	assert.NoError(t, err)
+	assert.Equal(t, "ecde18dbe76fbd0c33330f1c354871db", actual)
+}
+
+func TestSealInvalid(t *testing.T) {
+	_, err := Seal(nil, "interncccccc", "ecde18dbe76fbd0c33330f1c354871db")
+	assert.Equal(t, ErrNoMasterKey, err)
+
+	_, err = Seal(testMasterKey, "interncccccc", "ecde18dbe76fbd0c")
+	assert.Equal(t, ErrInvalidSecretKey, err)
+}
+
+func TestParseMasterKey(t *testing.T) {
+	var tests = []struct {
+		in       string
+		expected []byte
+	}{
+		{"3031323334353637383961626364656630313233343536373839616263646566\n", testMasterKey},
+		{"MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=", testMasterKey},
+		{"303132333435363738396162636465663031323334353637", nil},
+		{"not a key", nil},
+	}
+
+	for _, test := range tests {
+		actual, err := ParseMasterKey(test.in)
+		assert.Equal(t, test.expected, actual)
+		if test.expected == nil {
+			assert.Equal(t, ErrInvalidMasterKey, err)
+		}
+	}
+}
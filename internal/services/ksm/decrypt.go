@@ -0,0 +1,92 @@
+package ksm
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"github.com/conformal/yubikey"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/utils"
+	"regexp"
+)
+
+const (
+	ERR_NO_OTP        = "ERR No OTP provided"
+	ERR_INVALID_OTP   = "ERR Invalid OTP format"
+	ERR_UNKNOWN_KEY   = "ERR Unknown yubikey"
+	ERR_CORRUPT_OTP   = "ERR Corrupt OTP"
+	ERR_DATABASE      = "ERR Database error"
+	ERR_ACCESS_DENIED = "ERR Access denied"
+)
+
+var otpPattern = regexp.MustCompile(`^[cbdefghijklnrtuv]{32,48}$`)
+
+// ValidOtp checks whether the OTP is a public id of up to 16 modhex characters followed by the
+// 32 modhex characters of the token.
+func ValidOtp(otp string) bool {
+	return otpPattern.MatchString(otp)
+}
+
+// Decrypt handles a YK-KSM compatible decryption request, it answers with the same format as
+// the one expected by KsmDecryptOtp, so this server can act as a YK-KSM for other validation servers.
+func Decrypt(ctx *fasthttp.RequestCtx) {
+	remoteIp := ctx.RemoteIP().String()
+	if !isAllowedIp(remoteIp) {
+		log.Info("YK-KSM request from not allowed IP address ", remoteIp)
+		ctx.SetStatusCode(fasthttp.StatusForbidden)
+		sendKsmResp(ctx, ERR_ACCESS_DENIED)
+		return
+	}
+
+	otp := string(ctx.QueryArgs().Peek("otp"))
+	if otp == "" {
+		sendKsmResp(ctx, ERR_NO_OTP)
+		return
+	}
+	if !ValidOtp(otp) {
+		log.Info("Invalid OTP format: ", otp)
+		sendKsmResp(ctx, ERR_INVALID_OTP)
+		return
+	}
+
+	otpInfo, err := LocalDecryptOtp(otp)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows), errors.Is(err, database.ErrEmptySecretKey):
+			sendKsmResp(ctx, ERR_UNKNOWN_KEY)
+		case errors.Is(err, yubikey.ErrCrcFailure), errors.Is(err, ErrPrivateIdMismatch):
+			sendKsmResp(ctx, ERR_CORRUPT_OTP)
+		case errors.Is(err, yubikey.ErrInvalidOTPString), errors.Is(err, yubikey.ErrInvalidPubIdLen):
+			sendKsmResp(ctx, ERR_INVALID_OTP)
+		default:
+			sendKsmResp(ctx, ERR_DATABASE)
+		}
+		return
+	}
+
+	log.Debug("Decrypted OTP for YK-KSM request: ", otpInfo)
+	sendKsmResp(ctx, FormatOtpInfo(otpInfo))
+}
+
+// FormatOtpInfo formats decrypted OTP info the way YK-KSM does.
+func FormatOtpInfo(otpInfo OtpInfo) string {
+	return fmt.Sprintf("OK counter=%04x low=%04x high=%02x use=%02x",
+		otpInfo.SessionCounter, otpInfo.TimestampLow, otpInfo.TimestampHigh, otpInfo.UseCounter)
+}
+
+// isAllowedIp checks whether the IP address may use the YK-KSM endpoint,
+// only loopback requests are allowed if no addresses are configured.
+func isAllowedIp(ip string) bool {
+	if len(config.Ksm.Server.AllowedIpAddresses) == 0 {
+		return ip == "127.0.0.1" || ip == "::1"
+	}
+	return utils.InArray(ip, config.Ksm.Server.AllowedIpAddresses)
+}
+
+func sendKsmResp(ctx *fasthttp.RequestCtx, body string) {
+	ctx.SetContentType("text/plain")
+	_, _ = fmt.Fprint(ctx, body+"\n")
+}
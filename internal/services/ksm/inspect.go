@@ -0,0 +1,103 @@
+package ksm
+
+import (
+	"crypto/aes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/conformal/yubikey"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+	"go-yubikey-val/internal/secrets"
+	"strings"
+)
+
+// Inspection is the decrypted content of an OTP, it is decoded even if the CRC is wrong so that
+// a corrupted OTP or a wrong secret can be told apart.
+type Inspection struct {
+	PublicId         string
+	PrivateId        string // hex encoded
+	PrivateIdMatches bool
+	OtpInfo
+	Random   uint16
+	CrcValid bool
+}
+
+// Timestamp returns the 24 bit timestamp of the YubiKey, it counts at 8Hz since the YubiKey was powered up.
+func (o OtpInfo) Timestamp() int32 {
+	return (o.TimestampHigh << 16) + o.TimestampLow
+}
+
+// InspectOtp decrypts the OTP with the secret stored in the local database, like LocalDecryptOtp,
+// but returns all fields of the OTP instead of failing on a CRC or private id mismatch.
+func InspectOtp(otpString string) (Inspection, error) {
+	var inspection Inspection
+
+	publicName, otp, err := yubikey.ParseOTPString(otpString)
+	if err != nil {
+		return inspection, err
+	}
+	inspection.PublicId = string(publicName)
+
+	storedKey, privateId, err := database.GetYubiKeySecrets(inspection.PublicId)
+	if err != nil {
+		return inspection, err
+	}
+
+	block := yubikey.ModHexDecode(otp.Bytes())
+	if hsm.IsWrapped(storedKey) {
+		block, err = hsm.Decrypt(storedKey, block)
+		if err != nil {
+			return inspection, err
+		}
+	} else {
+		secretKey, err := secrets.Open(secrets.MasterKey, inspection.PublicId, storedKey)
+		if err != nil {
+			return inspection, err
+		}
+		keyBytes, err := hex.DecodeString(secretKey)
+		if err != nil {
+			return inspection, err
+		}
+		cipher, err := aes.NewCipher(keyBytes)
+		if err != nil {
+			return inspection, err
+		}
+		cipher.Decrypt(block, block)
+	}
+	if len(block) != 16 {
+		return inspection, fmt.Errorf("decrypted OTP has %d bytes, expected 16", len(block))
+	}
+
+	// the layout of yubikey.NewTokenFromBytes, which rejects blocks with a wrong CRC
+	inspection.PrivateId = hex.EncodeToString(block[:6])
+	inspection.PrivateIdMatches = privateId == "" || strings.EqualFold(inspection.PrivateId, privateId)
+	inspection.SessionCounter = int32(binary.LittleEndian.Uint16(block[6:]))
+	inspection.TimestampLow = int32(binary.LittleEndian.Uint16(block[8:]))
+	inspection.TimestampHigh = int32(block[10])
+	inspection.UseCounter = int32(block[11])
+	inspection.Random = binary.LittleEndian.Uint16(block[12:])
+	inspection.CrcValid = yubikey.Crc16BufOkP(block)
+	return inspection, nil
+}
+
+// CompareCounters explains how the counters of an OTP compare with the stored ones, the way the
+// validation decides whether an OTP is replayed.
+func CompareCounters(stored database.YubiKey, otp OtpInfo) string {
+	switch {
+	case stored.SessionCounter < 0:
+		return "first use, the YubiKey has no stored counters"
+	case otp.SessionCounter == stored.SessionCounter && otp.UseCounter == stored.UseCounter:
+		return "replayed, this is the last OTP which has been validated"
+	case otp.SessionCounter < stored.SessionCounter ||
+		(otp.SessionCounter == stored.SessionCounter && otp.UseCounter < stored.UseCounter):
+		return "replayed, the counters are lower than the stored ones"
+	case otp.SessionCounter == stored.SessionCounter:
+		return fmt.Sprintf("ahead by %d uses in the same session", otp.UseCounter-stored.UseCounter)
+	case otp.SessionCounter == stored.SessionCounter+1:
+		return "ahead, a new session: the YubiKey has been plugged in again"
+	default:
+		return fmt.Sprintf("session jump, %d sessions ahead: OTPs have been generated without being validated here",
+			otp.SessionCounter-stored.SessionCounter)
+	}
+}
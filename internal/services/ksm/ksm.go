@@ -2,14 +2,28 @@ package ksm
 
 import (
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"github.com/conformal/yubikey"
 	log "github.com/sirupsen/logrus"
 	"go-yubikey-val/internal/asynchttp"
 	"go-yubikey-val/internal/config"
 	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+	"go-yubikey-val/internal/secrets"
+	"strings"
 )
 
+const (
+	STRATEGY_RACE     = "race"
+	STRATEGY_FAILOVER = "failover"
+	STRATEGY_QUORUM   = "quorum"
+
+	DEFAULT_KSM_TIMEOUT int32 = 10
+)
+
+var ErrPrivateIdMismatch = errors.New("private id mismatch")
+
 type OtpInfo struct {
 	SessionCounter int32
 	TimestampLow   int32
@@ -19,18 +33,28 @@ type OtpInfo struct {
 
 // DecryptOtp decrypts OTP.
 func DecryptOtp(otpString string, clientId int32) (OtpInfo, error) {
-	if config.Ksm.UseBuiltin {
-		return BuiltInDecryptOtp(otpString)
+	route := MatchRoute(otpString, clientId)
+	if route.Builtin {
+		return LocalDecryptOtp(otpString)
 	}
 
-	ksmUrls := Otp2KsmUrls(otpString, clientId)
+	ksmUrls := route.KsmUrls(otpString)
 	if ksmUrls == nil {
-		log.Error("Otp2KsmUrls returned an empty result, please check the config")
+		log.Error("The KSM route of the OTP has no URLs, please check the config")
 		return OtpInfo{}, fmt.Errorf("Empty KSM URLs")
 	}
 	return KsmDecryptOtp(ksmUrls)
 }
 
+// LocalDecryptOtp decrypts OTP with the secrets stored in the local database,
+// inside the PKCS#11 token if it's enabled or with Built-in KSM otherwise.
+func LocalDecryptOtp(otpString string) (OtpInfo, error) {
+	if config.Ksm.UsePkcs11 {
+		return Pkcs11DecryptOtp(otpString)
+	}
+	return BuiltInDecryptOtp(otpString)
+}
+
 // BuiltInDecryptOtp decrypts OTP with Built-in KSM.
 func BuiltInDecryptOtp(otpString string) (OtpInfo, error) {
 	var otpInfo OtpInfo
@@ -41,11 +65,20 @@ func BuiltInDecryptOtp(otpString string) (OtpInfo, error) {
 		return otpInfo, err
 	}
 
-	secretKeyString, err := database.GetSecretKey(string(yubikeyPublicName))
+	secretKeyString, privateId, err := database.GetYubiKeySecrets(string(yubikeyPublicName))
 	if err != nil {
 		log.Error("error getting secret key for yubikey: ", err)
 		return otpInfo, err
 	}
+	if hsm.IsWrapped(secretKeyString) {
+		log.Error("secret key for yubikey is wrapped by the PKCS#11 token, please enable use_pkcs11")
+		return otpInfo, hsm.ErrNoWrappingKey
+	}
+	secretKeyString, err = secrets.Open(secrets.MasterKey, string(yubikeyPublicName), secretKeyString)
+	if err != nil {
+		log.Error("error decrypting secret key for yubikey: ", err)
+		return otpInfo, err
+	}
 
 	keyBytes, err := hex.DecodeString(secretKeyString)
 	if err != nil {
@@ -58,45 +91,92 @@ func BuiltInDecryptOtp(otpString string) (OtpInfo, error) {
 		log.Error("yubikey.Parse error: ", err)
 		return otpInfo, err
 	}
+	if !privateIdMatches(token, privateId) {
+		log.Info("private id mismatch for yubikey ", string(yubikeyPublicName))
+		return otpInfo, ErrPrivateIdMismatch
+	}
 
-	otpInfo = OtpInfo{
+	return newOtpInfo(token), nil
+}
+
+// privateIdMatches checks the decrypted private id against the stored one, if there is any.
+func privateIdMatches(token *yubikey.Token, privateId string) bool {
+	return privateId == "" || strings.EqualFold(hex.EncodeToString(token.Uid[:]), privateId)
+}
+
+func newOtpInfo(token *yubikey.Token) OtpInfo {
+	return OtpInfo{
 		SessionCounter: int32(token.Ctr),
 		TimestampLow:   int32(token.Tstpl),
 		TimestampHigh:  int32(token.Tstph),
 		UseCounter:     int32(token.Use),
 	}
-
-	return otpInfo, nil
 }
 
 // Otp2KsmUrls converts an OTP array to an array of YK-KSM URLs for decrypting OTP for client.
 // The URLs must be fully qualified, i.e., containing the OTP itself.
+// It returns nil if the OTP should be decrypted by the built-in KSM.
 func Otp2KsmUrls(otp string, clientId int32) []string {
-	//if clientId == 42 {
-	//	return []string{"https://another-ykksm.example.com/wsapi/decrypt?otp=" + otp}
-	//}
-	//
-	//if match, _ := regexp.Match(`^dteffujehknh`, []byte(otp)); match {
-	//	return []string{"https://different-ykksm.example.com/wsapi/decrypt?otp=" + otp}
-	//}
-	var ksmUrls []string
-	for _, url := range config.Ksm.Urls {
-		ksmUrls = append(ksmUrls, url+"?otp="+otp)
-	}
-
-	return ksmUrls
+	return MatchRoute(otp, clientId).KsmUrls(otp)
 }
 
-// KsmDecryptOtp decrypts OTP with YK-KSM.
+// KsmDecryptOtp decrypts OTP with YK-KSM, using the configured strategy:
+// race takes the first answer of all URLs requested at once, failover requests the URLs one
+// after another until one answers, and quorum requires several identical answers.
 func KsmDecryptOtp(urls []string) (OtpInfo, error) {
-	var otpInfo OtpInfo
+	timeout := config.Ksm.Timeout
+	if timeout <= 0 {
+		timeout = DEFAULT_KSM_TIMEOUT
+	}
 
-	responses := asynchttp.RetrieveUrlAsync("YK-KSM", urls, 1, "^OK", false, 10)
-	if responses == nil {
-		return otpInfo, fmt.Errorf("YK-KSM response is empty")
+	switch config.Ksm.Strategy {
+	case STRATEGY_FAILOVER:
+		for _, url := range urls {
+			responses := asynchttp.RetrieveUrlAsync("YK-KSM", []string{url}, 1, "^OK", false, timeout)
+			if responses == nil {
+				log.Info("YK-KSM failed to answer, failing over to the next one: ", url)
+				continue
+			}
+			return parseKsmResponse(responses[0])
+		}
+		return OtpInfo{}, fmt.Errorf("YK-KSM response is empty")
+
+	case STRATEGY_QUORUM:
+		quorum := config.Ksm.Quorum
+		if quorum <= 0 || int(quorum) > len(urls) {
+			quorum = int32(len(urls))
+		}
+		responses := asynchttp.RetrieveUrlAsync("YK-KSM", urls, quorum, "^OK", false, timeout)
+		if responses == nil {
+			return OtpInfo{}, fmt.Errorf("not enough YK-KSM responses for a quorum of %d", quorum)
+		}
+		otpInfo, err := parseKsmResponse(responses[0])
+		if err != nil {
+			return otpInfo, err
+		}
+		for _, response := range responses[1:] {
+			other, err := parseKsmResponse(response)
+			if err != nil {
+				return OtpInfo{}, err
+			}
+			if other != otpInfo {
+				log.Error("YK-KSM responses disagree: ", responses)
+				return OtpInfo{}, fmt.Errorf("YK-KSM responses disagree")
+			}
+		}
+		return otpInfo, nil
+
+	default:
+		responses := asynchttp.RetrieveUrlAsync("YK-KSM", urls, 1, "^OK", false, timeout)
+		if responses == nil {
+			return OtpInfo{}, fmt.Errorf("YK-KSM response is empty")
+		}
+		return parseKsmResponse(responses[0])
 	}
-	// TODO: array_shift()?
-	response := responses[0]
+}
+
+func parseKsmResponse(response string) (OtpInfo, error) {
+	var otpInfo OtpInfo
 	log.Debug("YK-KSM response: ", response)
 
 	count, err := fmt.Sscanf(response, "OK counter=%04x low=%04x high=%02x use=%02x",
@@ -1,10 +1,19 @@
 package ksm
 
 import (
+	"database/sql"
+	"fmt"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
 	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
 	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -23,6 +32,73 @@ func TestOtp2KsmUrls(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
+func TestOtp2KsmUrlsRoutes(t *testing.T) {
+	config.Ksm.Urls = []string{"http://127.0.0.1:8002/wsapi/decrypt"}
+	config.Ksm.Routes = []config.KsmRoute{
+		{ClientIds: []int32{42}, Urls: []string{"https://another-ykksm.example.com/wsapi/decrypt?otp={otp}&client=42"}},
+		{PublicIdPrefix: "dteffujehknh", Urls: []string{"https://different-ykksm.example.com/wsapi/decrypt"}},
+		{ClientIds: []int32{7, 8}, PublicIdRegex: `^internccccc[bc]$`, Builtin: true},
+		{PublicIdRegex: `^vv`, Urls: []string{"https://a.example.com/wsapi/decrypt", "https://b.example.com/wsapi/decrypt?otp={otp}"}},
+	}
+	require.NoError(t, config.CompileKsmRoutes(config.Ksm.Routes))
+	defer func() { config.Ksm.Routes = nil }()
+
+	type in struct {
+		otp      string
+		clientId int32
+	}
+	var tests = []struct {
+		in       in
+		expected []string
+	}{
+		{in{"interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu", 42},
+			[]string{"https://another-ykksm.example.com/wsapi/decrypt?otp=interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu&client=42"}},
+		{in{"dteffujehknhcbevjvdifndbljhrlljurbfgglnfjcfu", 1},
+			[]string{"https://different-ykksm.example.com/wsapi/decrypt?otp=dteffujehknhcbevjvdifndbljhrlljurbfgglnfjcfu"}},
+		{in{"dteffujehknhcbevjvdifndbljhrlljurbfgglnfjcfu", 42},
+			[]string{"https://another-ykksm.example.com/wsapi/decrypt?otp=dteffujehknhcbevjvdifndbljhrlljurbfgglnfjcfu&client=42"}},
+		{in{"interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu", 8},
+			nil},
+		{in{"interncccccdcbevjvdifndbljhrlljurbfgglnfjcfu", 8},
+			[]string{"http://127.0.0.1:8002/wsapi/decrypt?otp=interncccccdcbevjvdifndbljhrlljurbfgglnfjcfu"}},
+		{in{"vvcccccccccccbevjvdifndbljhrlljurbfgglnfjcfu", 1},
+			[]string{"https://a.example.com/wsapi/decrypt?otp=vvcccccccccccbevjvdifndbljhrlljurbfgglnfjcfu",
+				"https://b.example.com/wsapi/decrypt?otp=vvcccccccccccbevjvdifndbljhrlljurbfgglnfjcfu"}},
+		{in{"interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu", 1},
+			[]string{"http://127.0.0.1:8002/wsapi/decrypt?otp=interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu"}},
+	}
+
+	for _, test := range tests {
+		actual := Otp2KsmUrls(test.in.otp, test.in.clientId)
+		assert.Equal(t, test.expected, actual)
+	}
+}
+
+func TestCompileKsmRoutes(t *testing.T) {
+	err := config.CompileKsmRoutes([]config.KsmRoute{{PublicIdRegex: `^vv`, Builtin: true}, {PublicIdRegex: `^vv(`, Builtin: true}})
+	assert.EqualError(t, err, "invalid public_id_regex of KSM route 2: error parsing regexp: missing closing ): `^vv(`")
+
+	err = config.CompileKsmRoutes([]config.KsmRoute{{PublicIdPrefix: "vv"}})
+	assert.EqualError(t, err, "KSM route 1 has neither urls nor builtin set")
+}
+
+func TestMatchRouteDefault(t *testing.T) {
+	config.Ksm.UseBuiltin = true
+	defer func() { config.Ksm.UseBuiltin = false }()
+
+	route := MatchRoute("interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu", 1)
+	assert.True(t, route.Builtin)
+	assert.Nil(t, route.KsmUrls("interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu"))
+}
+
+func TestUsesBuiltin(t *testing.T) {
+	assert.False(t, UsesBuiltin())
+
+	config.Ksm.Routes = []config.KsmRoute{{PublicIdPrefix: "vv", Builtin: true}}
+	defer func() { config.Ksm.Routes = nil }()
+	assert.True(t, UsesBuiltin(), "a route can use the built-in KSM when it's not the default")
+}
+
 func TestKsmDecryptOtp(t *testing.T) {
 	expected := OtpInfo{
 		SessionCounter: 1,
@@ -44,17 +120,166 @@ func TestKsmDecryptOtp(t *testing.T) {
 	assert.Equal(t, expected, actual)
 }
 
-func startMockYkKsmServer() *http.Server {
-	srv := &http.Server{Addr: ":8112"}
-	http.HandleFunc("/wsapi/decrypt", func(w http.ResponseWriter, r *http.Request) {
-		_, _ = io.WriteString(w, "OK counter=0001 low=86bf high=83 use=04\n")
+func TestKsmDecryptOtpStrategies(t *testing.T) {
+	for addr, body := range map[string]string{
+		":8121": "ERR Unknown yubikey\n",
+		":8122": "OK counter=0001 low=86bf high=83 use=04\n",
+		":8123": "OK counter=0001 low=86bf high=83 use=04\n",
+		":8124": "OK counter=0002 low=86bf high=83 use=01\n",
+	} {
+		srv := startMockServer(addr, body)
+		defer srv.Close()
+	}
+	defer func() { config.Ksm.Strategy, config.Ksm.Quorum = "", 0 }()
+	expected := OtpInfo{
+		SessionCounter: 1,
+		TimestampLow:   34495,
+		TimestampHigh:  131,
+		UseCounter:     4,
+	}
+	url := "http://127.0.0.1:%d/wsapi/decrypt?otp=interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu"
+
+	config.Ksm.Strategy = STRATEGY_FAILOVER
+	actual, err := KsmDecryptOtp([]string{fmt.Sprintf(url, 8120), fmt.Sprintf(url, 8121), fmt.Sprintf(url, 8122)})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	config.Ksm.Strategy = STRATEGY_QUORUM
+	config.Ksm.Quorum = 2
+	actual, err = KsmDecryptOtp([]string{fmt.Sprintf(url, 8121), fmt.Sprintf(url, 8122), fmt.Sprintf(url, 8123)})
+	assert.NoError(t, err)
+	assert.Equal(t, expected, actual)
+
+	_, err = KsmDecryptOtp([]string{fmt.Sprintf(url, 8122), fmt.Sprintf(url, 8124)})
+	assert.Error(t, err)
+
+	_, err = KsmDecryptOtp([]string{fmt.Sprintf(url, 8121), fmt.Sprintf(url, 8122)})
+	assert.Error(t, err)
+}
+
+func TestFormatOtpInfo(t *testing.T) {
+	otpInfo := OtpInfo{
+		SessionCounter: 1,
+		TimestampLow:   34495,
+		TimestampHigh:  131,
+		UseCounter:     4,
+	}
+
+	actual := FormatOtpInfo(otpInfo)
+	assert.Equal(t, "OK counter=0001 low=86bf high=83 use=04", actual)
+
+	var parsed OtpInfo
+	_, err := fmt.Sscanf(actual, "OK counter=%04x low=%04x high=%02x use=%02x",
+		&parsed.SessionCounter, &parsed.TimestampLow, &parsed.TimestampHigh, &parsed.UseCounter)
+	assert.NoError(t, err)
+	assert.Equal(t, otpInfo, parsed)
+}
+
+func TestDecrypt(t *testing.T) {
+	config.Ksm.Server.AllowedIpAddresses = []string{"192.168.1.2"}
+	var tests = []struct {
+		remoteIp string
+		otp      string
+		expected string
+	}{
+		{"192.168.1.3", "interncccccbcbevjvdifndbljhrlljurbfgglnfjcfu", ERR_ACCESS_DENIED + "\n"},
+		{"192.168.1.2", "", ERR_NO_OTP + "\n"},
+		{"192.168.1.2", "interncccccbcbevjvdifndbljhrlljurbfgglnfjcfx", ERR_INVALID_OTP + "\n"},
+		{"192.168.1.2", "cccc", ERR_INVALID_OTP + "\n"},
+	}
+
+	for _, test := range tests {
+		var req fasthttp.Request
+		req.SetRequestURI("/wsapi/decrypt?otp=" + test.otp)
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP(test.remoteIp)}, nil)
+
+		Decrypt(&ctx)
+		assert.Equal(t, test.expected, string(ctx.Response.Body()))
+	}
+}
+
+func startMockServer(addr string, body string) *http.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/wsapi/decrypt", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, body)
 	})
+	srv := &http.Server{Addr: addr, Handler: mux}
 
+	ln, err := net.Listen("tcp", srv.Addr)
+	if err != nil {
+		panic(err)
+	}
 	go func() {
-		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
 			panic(err)
 		}
 	}()
 
 	return srv
 }
+
+func startMockYkKsmServer() *http.Server {
+	return startMockServer(":8112", "OK counter=0001 low=86bf high=83 use=04\n")
+}
+
+func TestCompareCounters(t *testing.T) {
+	stored := database.YubiKey{SessionCounter: 5, UseCounter: 3}
+	var tests = []struct {
+		stored   database.YubiKey
+		otp      OtpInfo
+		expected string
+	}{
+		{database.YubiKey{SessionCounter: -1, UseCounter: -1}, OtpInfo{SessionCounter: 1}, "first use, the YubiKey has no stored counters"},
+		{stored, OtpInfo{SessionCounter: 5, UseCounter: 3}, "replayed, this is the last OTP which has been validated"},
+		{stored, OtpInfo{SessionCounter: 5, UseCounter: 2}, "replayed, the counters are lower than the stored ones"},
+		{stored, OtpInfo{SessionCounter: 4, UseCounter: 9}, "replayed, the counters are lower than the stored ones"},
+		{stored, OtpInfo{SessionCounter: 5, UseCounter: 5}, "ahead by 2 uses in the same session"},
+		{stored, OtpInfo{SessionCounter: 6, UseCounter: 0}, "ahead, a new session: the YubiKey has been plugged in again"},
+		{stored, OtpInfo{SessionCounter: 9, UseCounter: 0}, "session jump, 4 sessions ahead: OTPs have been generated without being validated here"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, CompareCounters(test.stored, test.otp))
+	}
+	assert.Equal(t, int32(0x8386bf), OtpInfo{TimestampLow: 0x86bf, TimestampHigh: 0x83}.Timestamp())
+}
+
+func TestInspectOtp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := database.Open(database.DRIVER_SQLITE, "file:"+filepath.Join(dir, "ykval.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	database.Store = store
+	// the test vector of the yubikey library, from the Yubico test vectors
+	require.NoError(t, store.InsertYubiKey(database.YubiKey{Active: true, PublicName: "cccccccccccb",
+		SecretKey: "ecde18dbe76fbd0c33330f1c354871db", PrivateId: "8792ebfe26cc"}))
+	require.NoError(t, store.InsertYubiKey(database.YubiKey{Active: true, PublicName: "cccccccccccd",
+		SecretKey: "ecde18dbe76fbd0c33330f1c354871db", PrivateId: "0a0b0c0d0e0f"}))
+
+	inspection, err := InspectOtp("cccccccccccbhknhfjbrjnlnldnhcujvddbikngjrtgh")
+	require.NoError(t, err)
+	assert.Equal(t, Inspection{
+		PublicId:         "cccccccccccb",
+		PrivateId:        "8792ebfe26cc",
+		PrivateIdMatches: true,
+		OtpInfo:          OtpInfo{SessionCounter: 19, TimestampLow: 49712, TimestampHigh: 0, UseCounter: 17},
+		Random:           40904,
+		CrcValid:         true,
+	}, inspection)
+
+	inspection, err = InspectOtp("cccccccccccbhknhfjbrjnlnldnhcujvddbikngjrtgc")
+	require.NoError(t, err)
+	assert.False(t, inspection.CrcValid, "a corrupted OTP decrypts to garbage")
+
+	inspection, err = InspectOtp("cccccccccccdhknhfjbrjnlnldnhcujvddbikngjrtgh")
+	require.NoError(t, err)
+	assert.True(t, inspection.CrcValid)
+	assert.Equal(t, "8792ebfe26cc", inspection.PrivateId)
+	assert.False(t, inspection.PrivateIdMatches)
+
+	_, err = InspectOtp("ccccccccccchhknhfjbrjnlnldnhcujvddbikngjrtgh")
+	assert.Equal(t, sql.ErrNoRows, err)
+}
@@ -0,0 +1,48 @@
+package ksm
+
+import (
+	"fmt"
+	"github.com/conformal/yubikey"
+	log "github.com/sirupsen/logrus"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+)
+
+// Pkcs11DecryptOtp decrypts OTP inside the PKCS#11 token, the secret key of the YubiKey
+// is stored wrapped by the token and never unwrapped into process memory.
+func Pkcs11DecryptOtp(otpString string) (OtpInfo, error) {
+	var otpInfo OtpInfo
+
+	yubikeyPublicName, otp, err := yubikey.ParseOTPString(otpString)
+	if err != nil {
+		log.Info("error parsing OTP string: ", err)
+		return otpInfo, err
+	}
+
+	wrappedKey, privateId, err := database.GetYubiKeySecrets(string(yubikeyPublicName))
+	if err != nil {
+		log.Error("error getting secret key for yubikey: ", err)
+		return otpInfo, err
+	}
+	if !hsm.IsWrapped(wrappedKey) {
+		log.Error("secret key for yubikey ", string(yubikeyPublicName), " is not wrapped by the PKCS#11 token")
+		return otpInfo, fmt.Errorf("secret key is not wrapped by the PKCS#11 token")
+	}
+
+	buf, err := hsm.Decrypt(wrappedKey, yubikey.ModHexDecode(otp.Bytes()))
+	if err != nil {
+		log.Error("error decrypting OTP with PKCS#11 token: ", err)
+		return otpInfo, err
+	}
+	token, err := yubikey.NewTokenFromBytes(buf)
+	if err != nil {
+		log.Error("yubikey.Parse error: ", err)
+		return otpInfo, err
+	}
+	if !privateIdMatches(token, privateId) {
+		log.Info("private id mismatch for yubikey ", string(yubikeyPublicName))
+		return otpInfo, ErrPrivateIdMismatch
+	}
+
+	return newOtpInfo(token), nil
+}
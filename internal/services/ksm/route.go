@@ -0,0 +1,80 @@
+package ksm
+
+import (
+	"github.com/conformal/yubikey"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/utils"
+	"strings"
+)
+
+// Route is where an OTP should be decrypted, either by YK-KSMs or by the built-in KSM.
+type Route struct {
+	Builtin bool
+	Urls    []string
+}
+
+// MatchRoute finds the first configured route matching the OTP and the client,
+// OTPs matching no route are decrypted by the built-in KSM if it's enabled or by the default YK-KSMs.
+func MatchRoute(otp string, clientId int32) Route {
+	publicId := otp
+	if len(otp) > yubikey.OTPSize {
+		publicId = otp[:len(otp)-yubikey.OTPSize]
+	}
+
+	for _, route := range config.Ksm.Routes {
+		if routeMatches(route, publicId, clientId) {
+			return Route{Builtin: route.Builtin, Urls: route.Urls}
+		}
+	}
+
+	return Route{
+		Builtin: config.Ksm.UseBuiltin || config.Ksm.UsePkcs11,
+		Urls:    config.Ksm.Urls,
+	}
+}
+
+// UsesBuiltin checks whether the built-in KSM decrypts some of the OTPs, as the default or in a route,
+// its secrets have to be set up then.
+func UsesBuiltin() bool {
+	if config.Ksm.UseBuiltin {
+		return true
+	}
+	for _, route := range config.Ksm.Routes {
+		if route.Builtin {
+			return true
+		}
+	}
+	return false
+}
+
+// KsmUrls fills the OTP into the URLs of the route, it's appended as the otp
+// query parameter if the URL doesn't contain the {otp} placeholder.
+func (r Route) KsmUrls(otp string) []string {
+	if r.Builtin {
+		return nil
+	}
+
+	var ksmUrls []string
+	for _, url := range r.Urls {
+		if strings.Contains(url, "{otp}") {
+			ksmUrls = append(ksmUrls, strings.Replace(url, "{otp}", otp, -1))
+		} else {
+			ksmUrls = append(ksmUrls, url+"?otp="+otp)
+		}
+	}
+
+	return ksmUrls
+}
+
+func routeMatches(route config.KsmRoute, publicId string, clientId int32) bool {
+	if len(route.ClientIds) > 0 && !utils.InArray(clientId, route.ClientIds) {
+		return false
+	}
+	if route.PublicIdPrefix != "" && !strings.HasPrefix(publicId, route.PublicIdPrefix) {
+		return false
+	}
+	if route.PublicIdPattern != nil && !route.PublicIdPattern.MatchString(publicId) {
+		return false
+	}
+	return true
+}
@@ -0,0 +1,257 @@
+package state
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/merkle"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TABLE_YUBIKEYS = "yubikeys"
+	TABLE_CLIENTS  = "clients"
+
+	// PATH is the route of the state endpoint, relative to the URL of a server.
+	PATH = "/wsapi/state"
+
+	// requests older or newer than this many seconds are rejected
+	TIMESTAMP_TOLERANCE = 60
+	REQUEST_TIMEOUT     = 10 * time.Second
+
+	// SNAPSHOT_TTL is how long an unused tree is kept for the node requests of a compare.
+	SNAPSHOT_TTL = 5 * time.Minute
+
+	signatureHeader = "X-Ykval-Signature"
+)
+
+// ErrTableChanged is answered when the tree a compare was started on is gone and the table changed since.
+var ErrTableChanged = errors.New("the table changed during the compare, compare again")
+
+type snapshot struct {
+	tree     *merkle.Tree
+	lastUsed time.Time
+}
+
+var (
+	// snapshots are the trees of the compares in progress, by table and root hash
+	snapshots      = make(map[string]*snapshot)
+	snapshotsMutex sync.Mutex
+)
+
+// YubiKeyEntries converts the YubiKeys to the entries of a tree. The secrets are encrypted differently
+// on each server, so only whether a YubiKey has a secret is compared.
+func YubiKeyEntries(keys []database.YubiKey) []merkle.Entry {
+	entries := make([]merkle.Entry, 0, len(keys))
+	for _, key := range keys {
+		hasSecret := "no"
+		if key.SecretKey != "" {
+			hasSecret = "yes"
+		}
+		entries = append(entries, merkle.Entry{Key: key.PublicName, Fields: []merkle.Field{
+			{Name: "active", Value: strconv.FormatBool(key.Active)},
+			{Name: "org_id", Value: strconv.Itoa(int(key.OrgId))},
+			{Name: "session_counter", Value: strconv.Itoa(int(key.SessionCounter))},
+			{Name: "use_counter", Value: strconv.Itoa(int(key.UseCounter))},
+			{Name: "timestamp_low", Value: strconv.Itoa(int(key.TimestampLow))},
+			{Name: "timestamp_high", Value: strconv.Itoa(int(key.TimestampHigh))},
+			{Name: "nonce", Value: key.Nonce},
+			{Name: "has_secret", Value: hasSecret},
+		}})
+	}
+	return entries
+}
+
+// ClientEntries converts the clients to the entries of a tree, their secrets are compared by a
+// fingerprint keyed with the state key so they are never sent to a peer.
+func ClientEntries(clients []database.Client) []merkle.Entry {
+	entries := make([]merkle.Entry, 0, len(clients))
+	for _, client := range clients {
+		entries = append(entries, merkle.Entry{Key: strconv.Itoa(int(client.Id)), Fields: []merkle.Field{
+			{Name: "active", Value: strconv.FormatBool(client.Active)},
+			{Name: "org_id", Value: strconv.Itoa(int(client.OrgId))},
+			{Name: "secret", Value: fingerprint(client.Secret), Secret: true},
+		}})
+	}
+	return entries
+}
+
+// LoadTree builds the tree of all rows of the table, yubikeys or clients.
+func LoadTree(table string) (*merkle.Tree, error) {
+	switch table {
+	case TABLE_YUBIKEYS:
+		keys, err := database.Store.GetYubiKeys(database.ALL_ORGANIZATIONS)
+		if err != nil {
+			return nil, err
+		}
+		return merkle.Build(YubiKeyEntries(keys)), nil
+	case TABLE_CLIENTS:
+		clients, err := database.Store.GetClients(database.ALL_ORGANIZATIONS)
+		if err != nil {
+			return nil, err
+		}
+		return merkle.Build(ClientEntries(clients)), nil
+	default:
+		return nil, fmt.Errorf("unknown table %s", table)
+	}
+}
+
+// snapshotTree returns the tree to answer a node request from. A compare starts with the root node
+// without a root hash, which builds a new tree of the table. The following requests name the root
+// hash of that answer and are answered from the same tree, so the table is loaded once per compare
+// and all nodes come from the same state of it.
+func snapshotTree(table string, root string) (*merkle.Tree, error) {
+	snapshotsMutex.Lock()
+	defer snapshotsMutex.Unlock()
+
+	now := time.Now()
+	for key, s := range snapshots {
+		if now.Sub(s.lastUsed) > SNAPSHOT_TTL {
+			delete(snapshots, key)
+		}
+	}
+	if s, ok := snapshots[table+"/"+root]; ok && root != "" {
+		s.lastUsed = now
+		return s.tree, nil
+	}
+
+	tree, err := LoadTree(table)
+	if err != nil {
+		return nil, err
+	}
+	if root != "" && tree.Root() != root {
+		return nil, ErrTableChanged
+	}
+	snapshots[table+"/"+tree.Root()] = &snapshot{tree: tree, lastUsed: now}
+	return tree, nil
+}
+
+// State handles a request of a pool member for a node of the tree of a table. Requests are signed with
+// the state key shared by the pool, the response is signed together with the request. All nodes of a
+// compare are answered from the tree of its root request, see snapshotTree.
+func State(ctx *fasthttp.RequestCtx) {
+	args := ctx.QueryArgs()
+	table, node, root := string(args.Peek("table")), string(args.Peek("node")), string(args.Peek("root"))
+	timestamp, _ := strconv.ParseInt(string(args.Peek("t")), 10, 64)
+	query := signedQuery(table, node, root, timestamp)
+
+	if !signatureMatches("request", query, nil, string(args.Peek("h"))) {
+		log.Info("State request with a bad signature from ", ctx.RemoteIP().String())
+		ctx.Error("ERR Access denied", fasthttp.StatusForbidden)
+		return
+	}
+	if age := time.Now().Unix() - timestamp; age > TIMESTAMP_TOLERANCE || age < -TIMESTAMP_TOLERANCE {
+		log.Info("State request with an expired timestamp from ", ctx.RemoteIP().String())
+		ctx.Error("ERR Expired request", fasthttp.StatusForbidden)
+		return
+	}
+
+	tree, err := snapshotTree(table, root)
+	if err == ErrTableChanged {
+		log.Info("State request of ", ctx.RemoteIP().String(), " for a tree of ", table, " which changed since")
+		ctx.Error("ERR "+err.Error(), fasthttp.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		ctx.Error("ERR "+err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	answer, err := tree.Node(node)
+	if err != nil {
+		ctx.Error("ERR "+err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	body, err := json.Marshal(answer)
+	if err != nil {
+		log.Error(err)
+		ctx.Error("ERR Backend error", fasthttp.StatusInternalServerError)
+		return
+	}
+
+	ctx.SetContentType("application/json")
+	ctx.Response.Header.Set(signatureHeader, sign(config.Sync.StateKey, "response", query, body))
+	ctx.SetBody(body)
+}
+
+// Fetch returns a function requesting the nodes of the table's tree from the server at the peer URL.
+// The root node has to be requested first, the other nodes are requested from the tree it came from.
+func Fetch(peerUrl string, table string) func(path string) (merkle.Node, error) {
+	client := &http.Client{Timeout: REQUEST_TIMEOUT}
+	endpoint := strings.TrimRight(peerUrl, "/") + PATH
+	var root string
+
+	return func(path string) (merkle.Node, error) {
+		var node merkle.Node
+		if path == "" {
+			root = ""
+		}
+		query := signedQuery(table, path, root, time.Now().Unix())
+		resp, err := client.Get(endpoint + "?" + query + "&h=" + url.QueryEscape(sign(config.Sync.StateKey, "request", query, nil)))
+		if err != nil {
+			return node, err
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return node, err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return node, fmt.Errorf("peer answered %s: %s", resp.Status, strings.TrimSpace(string(body)))
+		}
+		if !signatureMatches("response", query, body, resp.Header.Get(signatureHeader)) {
+			return node, fmt.Errorf("peer answered with a bad signature, is the state key the same?")
+		}
+		if err = json.Unmarshal(body, &node); err != nil {
+			return node, err
+		}
+		if path == "" {
+			root = node.Hash
+		}
+		return node, nil
+	}
+}
+
+func signedQuery(table string, node string, root string, timestamp int64) string {
+	return url.Values{
+		"table": {table},
+		"node":  {node},
+		"root":  {root},
+		"t":     {strconv.FormatInt(timestamp, 10)},
+	}.Encode()
+}
+
+// sign returns the HMAC-SHA256 of a request or a response with the state key, a response is signed
+// together with the query of its request.
+func sign(key string, kind string, query string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write([]byte(kind + "\n" + query + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func signatureMatches(kind string, query string, body []byte, signature string) bool {
+	if config.Sync.StateKey == "" {
+		return false
+	}
+	return hmac.Equal([]byte(sign(config.Sync.StateKey, kind, query, body)), []byte(signature))
+}
+
+func fingerprint(secret string) string {
+	h := hmac.New(sha256.New, []byte(config.Sync.StateKey))
+	h.Write([]byte("secret\n" + secret))
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
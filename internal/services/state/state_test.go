@@ -0,0 +1,155 @@
+package state
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/merkle"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStateRejected(t *testing.T) {
+	config.Sync.StateKey = "pool key"
+	defer func() { config.Sync.StateKey = "" }()
+
+	now := time.Now().Unix()
+	query := signedQuery(TABLE_YUBIKEYS, "", "", now)
+	expired := signedQuery(TABLE_YUBIKEYS, "", "", now-TIMESTAMP_TOLERANCE-1)
+	var tests = []struct {
+		uri      string
+		expected string
+	}{
+		{PATH + "?" + query, "ERR Access denied"},
+		{PATH + "?" + query + "&h=" + sign("pool key", "response", query, nil), "ERR Access denied"},
+		{PATH + "?" + signedQuery(TABLE_CLIENTS, "", "", now) + "&h=" + sign("pool key", "request", query, nil), "ERR Access denied"},
+		{PATH + "?" + expired + "&h=" + sign("pool key", "request", expired, nil), "ERR Expired request"},
+	}
+
+	for _, test := range tests {
+		var req fasthttp.Request
+		req.SetRequestURI(test.uri)
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("192.168.1.2")}, nil)
+
+		State(&ctx)
+		assert.Equal(t, fasthttp.StatusForbidden, ctx.Response.StatusCode())
+		assert.Equal(t, test.expected, string(ctx.Response.Body()))
+	}
+}
+
+func TestFetch(t *testing.T) {
+	config.Sync.StateKey = "pool key"
+	defer func() { config.Sync.StateKey = "" }()
+
+	local := []database.YubiKey{
+		{Active: true, PublicName: "cccccccccccb", SessionCounter: 1, UseCounter: 2, SecretKey: "v1:a"},
+		{Active: true, PublicName: "cccccccccccd", SessionCounter: 3, UseCounter: 4},
+	}
+	peer := []database.YubiKey{
+		{Active: true, PublicName: "cccccccccccb", SessionCounter: 1, UseCounter: 5, SecretKey: "v1:b"},
+		{Active: false, PublicName: "ccccccccccce"},
+	}
+	peerTree := merkle.Build(YubiKeyEntries(peer))
+	peerKey := "pool key"
+	roots := make(map[string]int)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp, _ := strconv.ParseInt(r.URL.Query().Get("t"), 10, 64)
+		query := signedQuery(r.URL.Query().Get("table"), r.URL.Query().Get("node"), r.URL.Query().Get("root"), timestamp)
+		if r.URL.Path != PATH || r.URL.Query().Get("h") != sign("pool key", "request", query, nil) {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, "ERR Access denied\n")
+			return
+		}
+		roots[r.URL.Query().Get("root")]++
+		node, _ := peerTree.Node(r.URL.Query().Get("node"))
+		body, _ := json.Marshal(node)
+		w.Header().Set(signatureHeader, sign(peerKey, "response", query, body))
+		_, _ = w.Write(body)
+	}))
+	defer server.Close()
+
+	differences, err := merkle.Compare(merkle.Build(YubiKeyEntries(local)), Fetch(server.URL+"/", TABLE_YUBIKEYS))
+	require.NoError(t, err)
+	require.Len(t, differences, 3)
+	assert.Equal(t, []string{"use_counter 2 -> 5"}, differences[0].Changes(), "the secrets are not compared")
+	assert.Nil(t, differences[1].Peer)
+	assert.Nil(t, differences[2].Local)
+	assert.Equal(t, 1, roots[""], "only the root node is requested without a root hash")
+	assert.NotZero(t, roots[peerTree.Root()], "the other nodes name the root hash of the first answer")
+
+	peerKey = "other key"
+	_, err = merkle.Compare(merkle.Build(YubiKeyEntries(local)), Fetch(server.URL, TABLE_YUBIKEYS))
+	assert.EqualError(t, err, "peer answered with a bad signature, is the state key the same?")
+
+	config.Sync.StateKey = "wrong key"
+	_, err = merkle.Compare(merkle.Build(YubiKeyEntries(local)), Fetch(server.URL, TABLE_YUBIKEYS))
+	assert.EqualError(t, err, "peer answered 403 Forbidden: ERR Access denied")
+}
+
+func TestStateSnapshot(t *testing.T) {
+	config.Sync.StateKey = "pool key"
+	defer func() { config.Sync.StateKey = "" }()
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	store, err := database.Open(database.DRIVER_SQLITE, "file:"+filepath.Join(dir, "ykval.db"))
+	require.NoError(t, err)
+	defer store.Close()
+	database.Store = store
+	require.NoError(t, store.InsertYubiKey(database.YubiKey{Active: true, PublicName: "cccccccccccb"}))
+
+	request := func(node string, root string) *fasthttp.RequestCtx {
+		query := signedQuery(TABLE_YUBIKEYS, node, root, time.Now().Unix())
+		var req fasthttp.Request
+		req.SetRequestURI(PATH + "?" + query + "&h=" + sign("pool key", "request", query, nil))
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("192.168.1.2")}, nil)
+		State(&ctx)
+		return &ctx
+	}
+
+	ctx := request("", "")
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	var rootNode merkle.Node
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &rootNode))
+
+	require.NoError(t, store.InsertYubiKey(database.YubiKey{Active: true, PublicName: "cccccccccccd"}))
+	ctx = request("0", rootNode.Hash)
+	require.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	var node merkle.Node
+	require.NoError(t, json.Unmarshal(ctx.Response.Body(), &node))
+	assert.Equal(t, rootNode.Children[0], node.Hash, "the nodes of a compare are answered from the tree of its root request")
+
+	snapshotsMutex.Lock()
+	for key := range snapshots {
+		delete(snapshots, key)
+	}
+	snapshotsMutex.Unlock()
+	ctx = request("0", rootNode.Hash)
+	assert.Equal(t, fasthttp.StatusConflict, ctx.Response.StatusCode())
+	assert.Equal(t, "ERR the table changed during the compare, compare again", string(ctx.Response.Body()))
+}
+
+func TestClientEntries(t *testing.T) {
+	config.Sync.StateKey = "pool key"
+	defer func() { config.Sync.StateKey = "" }()
+
+	entries := ClientEntries([]database.Client{{Id: 1, Active: true, Secret: "c2VjcmV0"}})
+	require.Len(t, entries, 1)
+	assert.Equal(t, "1", entries[0].Key)
+	assert.NotContains(t, entries[0].Fields[2].Value, "c2VjcmV0")
+	assert.True(t, entries[0].Fields[2].Secret)
+}
@@ -0,0 +1,243 @@
+package sync
+
+import (
+	"fmt"
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/utils"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ACTION_ENABLE    = "enable"
+	ACTION_DISABLE   = "disable"
+	ACTION_DELETE    = "delete"
+	ACTION_SET_NOTES = "set-notes"
+	// ACTION_REKEY only resets the counters on the other servers, the new secret is not sent
+	ACTION_REKEY = "rekey"
+
+	// PATH is the route receiving the changes of the pool, the path of the sync URLs of the pool.
+	PATH = "/wsapi/2.0/sync"
+
+	SEND_TIMEOUT = 5 * time.Second
+)
+
+var stop, done chan struct{}
+
+// QueueChange builds the queue entries sending a change of a YubiKey made by an operator to each server
+// of the sync pool, the change is encoded in the info column with the time it was made. There are none
+// without a sync pool. A change which does not fit in the info column is refused.
+func QueueChange(action string, publicName string, operator string, details url.Values, now time.Time) ([]database.QueueEntry, error) {
+	info := url.Values{}
+	for key, values := range details {
+		info[key] = values
+	}
+	info.Set("action", action)
+	info.Set("yk_publicname", publicName)
+	info.Set("operator", operator)
+	info.Set("changed_at", strconv.FormatInt(now.UnixNano(), 10))
+	encoded := info.Encode()
+	if len(encoded) > database.MAX_INFO_LENGTH {
+		return nil, fmt.Errorf("the change of YubiKey %s is %d characters long encoded, the queue holds at most %d",
+			publicName, len(encoded), database.MAX_INFO_LENGTH)
+	}
+
+	var entries []database.QueueEntry
+	for _, server := range config.Sync.Pool {
+		entries = append(entries, database.QueueEntry{
+			QueuedAt:    int32(now.Unix()),
+			ModifiedAt:  int32(now.Unix()),
+			ServerNonce: utils.GenerateNonce(),
+			Server:      server,
+			Info:        encoded,
+		})
+	}
+	return entries, nil
+}
+
+// SendChanges sends the queued changes to their servers in the order they were made, a change is removed
+// from the queue once its server has applied it. The changes of a server which fails are kept, with the
+// later ones, until the next try. It returns the number of changes sent and still queued.
+func SendChanges(store database.Storage) (int, int, error) {
+	entries, err := store.GetQueuedChanges()
+	if err != nil {
+		return 0, 0, err
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return changedAt(entries[i]) < changedAt(entries[j])
+	})
+
+	client := &http.Client{Timeout: SEND_TIMEOUT}
+	failed := map[string]bool{}
+	sent := 0
+	for _, entry := range entries {
+		if failed[entry.Server] {
+			continue
+		}
+		err = sendChange(client, entry)
+		if err != nil {
+			log.Warnf("Failed to send change to %s, it stays queued: %v", entry.Server, err)
+			failed[entry.Server] = true
+			continue
+		}
+		err = store.DeleteQueueEntry(entry.Server, entry.ServerNonce)
+		if err != nil {
+			return sent, len(entries) - sent, err
+		}
+		sent++
+	}
+	return sent, len(entries) - sent, nil
+}
+
+func sendChange(client *http.Client, entry database.QueueEntry) error {
+	resp, err := client.Get(entry.Server + "?" + entry.Info)
+	if err != nil {
+		if urlErr, ok := err.(*url.Error); ok {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	answer := strings.TrimSpace(string(body))
+	if resp.StatusCode != http.StatusOK || answer != "OK" {
+		return fmt.Errorf("server answered %s: %s", resp.Status, answer)
+	}
+	return nil
+}
+
+// changedAt gets the time a queued change was made in nanoseconds, the queue only has seconds.
+func changedAt(entry database.QueueEntry) int64 {
+	info, _ := url.ParseQuery(entry.Info)
+	nanos, err := strconv.ParseInt(info.Get("changed_at"), 10, 64)
+	if err != nil {
+		return int64(entry.QueuedAt) * int64(time.Second)
+	}
+	return nanos
+}
+
+// Sync handles a change of a YubiKey sent by a server of the sync pool, only the addresses of the allowed
+// sync pool may send changes. A change which does not apply is acknowledged and ignored.
+func Sync(ctx *fasthttp.RequestCtx) {
+	remoteIp := ctx.RemoteIP().String()
+	if !utils.InArray(remoteIp, config.Sync.AllowedSyncPool) {
+		log.Info("Sync request from not allowed IP address ", remoteIp)
+		ctx.Error("ERR Access denied", fasthttp.StatusForbidden)
+		return
+	}
+
+	info, err := url.ParseQuery(string(ctx.QueryArgs().QueryString()))
+	if err != nil {
+		ctx.Error("ERR Invalid request", fasthttp.StatusBadRequest)
+		return
+	}
+	applied, err := ApplyChange(database.Store, info, remoteIp)
+	if err != nil {
+		log.Error("Failed to apply change from ", remoteIp, ": ", err)
+		ctx.Error("ERR "+err.Error(), fasthttp.StatusBadRequest)
+		return
+	}
+	if !applied {
+		log.Infof("Ignored change of YubiKey %s from %s, it is unknown or has been used since", info.Get("yk_publicname"), remoteIp)
+	}
+
+	ctx.SetContentType("text/plain")
+	_, _ = fmt.Fprint(ctx, "OK\n")
+}
+
+// ApplyChange applies a change of a YubiKey received from a server of the pool and records it in the
+// admin log, it is not queued again. It returns false if the YubiKey is not known, or if it has been
+// rekeyed and used with its new secret since.
+func ApplyChange(store database.Storage, info url.Values, from string) (bool, error) {
+	action, publicName := info.Get("action"), info.Get("yk_publicname")
+	if publicName == "" {
+		return false, fmt.Errorf("missing yk_publicname")
+	}
+
+	details := url.Values{"synced_from": {from}}
+	for _, key := range []string{"notes", "reason"} {
+		if value, ok := info[key]; ok {
+			details[key] = value
+		}
+	}
+	change := &database.AdminChange{Log: database.AdminLog{
+		LoggedAt: int32(time.Now().Unix()),
+		Operator: info.Get("operator"),
+		Action:   "keys " + action,
+		Target:   publicName,
+		Details:  details.Encode(),
+	}}
+
+	switch action {
+	case ACTION_ENABLE, ACTION_DISABLE:
+		return store.ToggleYubiKey(publicName, action == ACTION_ENABLE, change)
+	case ACTION_DELETE:
+		return store.DeleteYubiKey(publicName, change)
+	case ACTION_SET_NOTES:
+		if _, ok := info["notes"]; !ok {
+			return false, fmt.Errorf("missing notes")
+		}
+		return store.UpdateYubiKeyNotes(publicName, info.Get("notes"), change)
+	case ACTION_REKEY:
+		changedAt, err := strconv.ParseInt(info.Get("changed_at"), 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("missing changed_at")
+		}
+		return store.ResetYubiKeyCounters(publicName, int32(changedAt/int64(time.Second)), change)
+	case "":
+		return false, fmt.Errorf("missing action, only changes made by operators are synchronized")
+	default:
+		return false, fmt.Errorf("unknown action %s", action)
+	}
+}
+
+// Start sends the queued changes in the background of the server every configured interval, if there
+// is a sync pool.
+func Start() {
+	if config.Sync.Interval <= 0 || len(config.Sync.Pool) == 0 {
+		return
+	}
+	interval := time.Duration(config.Sync.Interval) * time.Second
+	stop, done = make(chan struct{}), make(chan struct{})
+	go func(stop <-chan struct{}, done chan<- struct{}) {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				sent, _, err := SendChanges(database.Store)
+				if err != nil {
+					log.Error("Sending queued changes failed: ", err)
+				}
+				if sent > 0 {
+					log.Infof("Sent %d queued changes to the sync pool", sent)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}(stop, done)
+	log.Infof("Sending queued changes to the sync pool every %s", interval)
+}
+
+// Stop stops sending changes in the background, and waits until a running send has finished.
+func Stop() {
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+	stop, done = nil, nil
+}
@@ -0,0 +1,221 @@
+package sync
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestStore creates a SQLite database with the YubiKeys.
+func openTestStore(t *testing.T, publicNames ...string) (database.Storage, func()) {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	store, err := database.Open(database.DRIVER_SQLITE, "file:"+filepath.Join(dir, "ykval.db")+"?_pragma=busy_timeout(5000)&_txlock=immediate")
+	require.NoError(t, err)
+	for _, publicName := range publicNames {
+		require.NoError(t, store.InsertYubiKey(database.YubiKey{Active: true, PublicName: publicName, SessionCounter: -1, UseCounter: -1}))
+	}
+
+	return store, func() {
+		_ = store.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+// startPeer serves the sync route of a peer on a local port and returns its sync URL.
+func startPeer(t *testing.T) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	go func() {
+		_ = fasthttp.Serve(ln, Sync)
+	}()
+	return "http://" + ln.Addr().String() + PATH, func() {
+		_ = ln.Close()
+	}
+}
+
+// change makes a change the way the keys commands do, with its admin log entry and queue entries.
+func change(t *testing.T, store database.Storage, action string, publicName string, details url.Values, now time.Time) {
+	queue, err := QueueChange(action, publicName, "admin", details, now)
+	require.NoError(t, err)
+	change := &database.AdminChange{
+		Log:   database.AdminLog{LoggedAt: int32(now.Unix()), Operator: "admin", Action: "keys " + action, Target: publicName, Details: details.Encode()},
+		Queue: queue,
+	}
+	var changed bool
+	switch action {
+	case ACTION_ENABLE, ACTION_DISABLE:
+		changed, err = store.ToggleYubiKey(publicName, action == ACTION_ENABLE, change)
+	case ACTION_DELETE:
+		changed, err = store.DeleteYubiKey(publicName, change)
+	case ACTION_SET_NOTES:
+		changed, err = store.UpdateYubiKeyNotes(publicName, details.Get("notes"), change)
+	}
+	require.NoError(t, err)
+	require.True(t, changed)
+}
+
+func TestQueueChange(t *testing.T) {
+	config.Sync.Pool = []string{"https://peer/wsapi/2.0/sync"}
+	defer func() { config.Sync.Pool = nil }()
+
+	now := time.Unix(1600000000, 0)
+	entries, err := QueueChange(ACTION_SET_NOTES, "cccccccccccc", "admin", url.Values{"notes": {strings.Repeat("n", 100)}}, now)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.True(t, len(entries[0].Info) <= database.MAX_INFO_LENGTH)
+
+	_, err = QueueChange(ACTION_SET_NOTES, "cccccccccccc", "admin", url.Values{"notes": {strings.Repeat("ä", 100)}}, now)
+	assert.Error(t, err, "escaped notes which do not fit in the queue are refused")
+}
+
+func TestSendChanges(t *testing.T) {
+	local, closeLocal := openTestStore(t, "cccccccccccb", "cccccccccccc", "cccccccccccd")
+	defer closeLocal()
+	peer, closePeer := openTestStore(t, "cccccccccccb", "cccccccccccc")
+	defer closePeer()
+	peerUrl, stopPeer := startPeer(t)
+	defer stopPeer()
+	database.Store = peer
+	config.Sync.AllowedSyncPool = []string{"127.0.0.1"}
+	config.Sync.Pool = []string{peerUrl}
+	defer func() {
+		config.Sync.AllowedSyncPool, config.Sync.Pool = nil, nil
+	}()
+
+	// made within the same second, they are sent in the order they were made
+	now := time.Unix(1600000000, 0)
+	change(t, local, ACTION_DISABLE, "cccccccccccb", url.Values{"reason": {"lost"}}, now)
+	change(t, local, ACTION_ENABLE, "cccccccccccb", url.Values{}, now.Add(time.Millisecond))
+	change(t, local, ACTION_DISABLE, "cccccccccccb", url.Values{}, now.Add(2*time.Millisecond))
+	change(t, local, ACTION_SET_NOTES, "cccccccccccc", url.Values{"notes": {"owner & co"}}, now.Add(3*time.Millisecond))
+	change(t, local, ACTION_DELETE, "cccccccccccc", url.Values{}, now.Add(4*time.Millisecond))
+	change(t, local, ACTION_DISABLE, "cccccccccccd", url.Values{}, now.Add(5*time.Millisecond))
+
+	sent, queued, err := SendChanges(local)
+	require.NoError(t, err)
+	assert.Equal(t, 6, sent)
+	assert.Equal(t, 0, queued)
+
+	key, err := peer.GetYubiKey("cccccccccccb")
+	require.NoError(t, err)
+	assert.False(t, key.Active)
+	exists, err := peer.YubiKeyExists("cccccccccccc")
+	require.NoError(t, err)
+	assert.False(t, exists)
+	exists, err = peer.YubiKeyExists("cccccccccccd")
+	require.NoError(t, err)
+	assert.False(t, exists, "changes of unknown YubiKeys are ignored")
+
+	entries, err := peer.GetAdminLogs("", 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 5)
+	assert.Equal(t, "keys delete", entries[0].Action)
+	assert.Equal(t, "notes=owner+%26+co&synced_from=127.0.0.1", entries[1].Details)
+	assert.Equal(t, "admin", entries[4].Operator)
+	assert.Equal(t, "reason=lost&synced_from=127.0.0.1", entries[4].Details)
+	length, err := peer.GetQueueLength()
+	require.NoError(t, err)
+	assert.Zero(t, length, "received changes are not queued again")
+	length, err = local.GetQueueLength()
+	require.NoError(t, err)
+	assert.Zero(t, length)
+}
+
+func TestSendChangesFailure(t *testing.T) {
+	local, closeLocal := openTestStore(t, "cccccccccccb")
+	defer closeLocal()
+	peer, closePeer := openTestStore(t, "cccccccccccb")
+	defer closePeer()
+	peerUrl, stopPeer := startPeer(t)
+	defer stopPeer()
+	database.Store = peer
+	config.Sync.Pool = []string{peerUrl, "http://127.0.0.1:1" + PATH}
+	defer func() {
+		config.Sync.AllowedSyncPool, config.Sync.Pool = nil, nil
+	}()
+
+	now := time.Now()
+	change(t, local, ACTION_DISABLE, "cccccccccccb", url.Values{}, now)
+	change(t, local, ACTION_ENABLE, "cccccccccccb", url.Values{}, now.Add(time.Millisecond))
+
+	// the peer does not allow this server yet, the other server is not reachable
+	sent, queued, err := SendChanges(local)
+	require.NoError(t, err)
+	assert.Equal(t, 0, sent)
+	assert.Equal(t, 4, queued)
+	key, err := peer.GetYubiKey("cccccccccccb")
+	require.NoError(t, err)
+	assert.True(t, key.Active)
+
+	config.Sync.AllowedSyncPool = []string{"127.0.0.1"}
+	sent, queued, err = SendChanges(local)
+	require.NoError(t, err)
+	assert.Equal(t, 2, sent)
+	assert.Equal(t, 2, queued)
+	lengths, err := local.GetQueueLengthByServer()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int32{"http://127.0.0.1:1" + PATH: 2}, lengths)
+	entries, err := peer.GetAdminLogs("cccccccccccb", 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "keys enable", entries[0].Action)
+}
+
+func TestApplyChange(t *testing.T) {
+	store, closeStore := openTestStore(t, "cccccccccccb")
+	defer closeStore()
+
+	var tests = []struct {
+		info     url.Values
+		expected string
+	}{
+		{url.Values{"action": {"disable"}}, "missing yk_publicname"},
+		{url.Values{"yk_publicname": {"cccccccccccb"}}, "missing action, only changes made by operators are synchronized"},
+		{url.Values{"action": {"rewrap"}, "yk_publicname": {"cccccccccccb"}}, "unknown action rewrap"},
+		{url.Values{"action": {"set-notes"}, "yk_publicname": {"cccccccccccb"}}, "missing notes"},
+		{url.Values{"action": {"rekey"}, "yk_publicname": {"cccccccccccb"}}, "missing changed_at"},
+	}
+	for _, test := range tests {
+		_, err := ApplyChange(store, test.info, "127.0.0.1")
+		assert.EqualError(t, err, test.expected)
+	}
+
+	applied, err := ApplyChange(store, url.Values{"action": {"set-notes"}, "yk_publicname": {"cccccccccccb"}, "notes": {""}}, "127.0.0.1")
+	assert.NoError(t, err)
+	assert.True(t, applied, "notes can be cleared")
+
+	rekeyedAt := time.Unix(1700000000, 500)
+	updated, err := store.UpdateYubiKeyCounters(database.YubiKey{PublicName: "cccccccccccb", ModifiedAt: 1700000000, SessionCounter: 7, UseCounter: 3})
+	require.NoError(t, err)
+	require.True(t, updated)
+	rekey := url.Values{"action": {"rekey"}, "yk_publicname": {"cccccccccccb"}, "reason": {"lost"},
+		"changed_at": {strconv.FormatInt(rekeyedAt.UnixNano(), 10)}}
+	applied, err = ApplyChange(store, rekey, "127.0.0.1")
+	assert.NoError(t, err)
+	assert.False(t, applied, "counters updated in the second of the rekey may be from the new secret")
+	rekey.Set("changed_at", strconv.FormatInt(rekeyedAt.Add(time.Second).UnixNano(), 10))
+	applied, err = ApplyChange(store, rekey, "127.0.0.1")
+	assert.NoError(t, err)
+	assert.True(t, applied)
+	key, err := store.GetYubiKey("cccccccccccb")
+	require.NoError(t, err)
+	assert.Equal(t, int32(-1), key.SessionCounter, "a rekey resets the counters of the other servers")
+	assert.Equal(t, int32(-1), key.UseCounter)
+	entries, err := store.GetAdminLogs("cccccccccccb", 0)
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "keys rekey", entries[0].Action)
+	assert.Equal(t, "reason=lost&synced_from=127.0.0.1", entries[0].Details)
+}
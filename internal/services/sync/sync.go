@@ -1,6 +1,9 @@
 package sync
 
-import "go-yubikey-val/internal/database"
+import (
+	"errors"
+	"go-yubikey-val/internal/database"
+)
 
 func CountersEqual(p1, p2 database.Params) bool {
 	return (p1.SessionCounter == p2.SessionCounter && p1.UseCounter == p2.UseCounter)
@@ -26,9 +29,10 @@ func CountersHigherThanOrEqual(p1, p2 database.Params) bool {
 	return false
 }
 
-func UpdateDbCounters(params database.Params) bool {
+// UpdateDbCounters stores the counters of the OTP, it returns false if they are not higher than the stored ones.
+func UpdateDbCounters(params database.Params) (bool, error) {
 	if params.PublicName == "" {
-		return false
+		return false, errors.New("missing public name")
 	}
 	return database.UpdateDbCounters(params.YubiKey)
 }
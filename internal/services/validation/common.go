@@ -1,7 +1,10 @@
 package validation
 
 import (
+	"crypto/subtle"
+	"encoding/base64"
 	"fmt"
+	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
 	"go-yubikey-val/internal/utils"
 	"strconv"
@@ -27,6 +30,9 @@ const (
 
 	TOKEN_LEN   = 32
 	OTP_MAX_LEN = 48
+
+	// statusUserValue keeps the response status of a request for the audit log
+	statusUserValue = "status"
 )
 
 // getHttpVal extracts specific HTTP request parameter value by its key, prefers value from the POST request.
@@ -54,6 +60,8 @@ func getAllHttpVal(ctx *fasthttp.RequestCtx) []string {
 }
 
 func sendResp(ctx *fasthttp.RequestCtx, status string, apiKey string, extra []string) {
+	ctx.SetUserValue(statusUserValue, status)
+
 	var a []string
 
 	a = append(a, "status="+status)
@@ -80,3 +88,19 @@ func sendResp(ctx *fasthttp.RequestCtx, status string, apiKey string, extra []st
 
 	_, _ = fmt.Fprint(ctx, body)
 }
+
+// decodeApiKey decodes the base64 encoded API key of a client.
+func decodeApiKey(secret string) string {
+	bytes, err := base64.StdEncoding.DecodeString(secret)
+	if err != nil {
+		log.Error("Error decoding client's API Key", err)
+	}
+	return string(bytes)
+}
+
+// signatureMatches checks the signature of the request parameters, without the signature itself.
+func signatureMatches(params []string, apiKey string, signature string) bool {
+	h := utils.Sign(params, apiKey)
+	// subtle.ConstantTimeCompare() works like the hash_equals() function in php
+	return subtle.ConstantTimeCompare([]byte(h), []byte(signature)) == 1
+}
@@ -1,12 +1,11 @@
 package validation
 
 import (
-	"crypto/subtle"
 	"database/sql"
-	"encoding/base64"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/audit"
 	"go-yubikey-val/internal/config"
 	"go-yubikey-val/internal/database"
 	"go-yubikey-val/internal/services/ksm"
@@ -21,6 +20,17 @@ import (
 
 // Verify handles a validation request.
 func Verify(ctx *fasthttp.RequestCtx) {
+	authLog := database.AuthLog{
+		LoggedAt:       int32(time.Now().Unix()),
+		SessionCounter: -1,
+		UseCounter:     -1,
+		SourceIp:       ctx.RemoteIP().String(),
+	}
+	defer func() {
+		authLog.Status, _ = ctx.UserValue(statusUserValue).(string)
+		audit.Log(authLog)
+	}()
+
 	paramSignature := getHttpVal(ctx, "h", "")
 	paramClientId := getHttpVal(ctx, "id", "")
 	paramTimestamp := getHttpVal(ctx, "timestamp", "")
@@ -111,6 +121,7 @@ func Verify(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	otp = paramOtp
+	authLog.PublicName = otp[0 : len(otp)-TOKEN_LEN]
 
 	var clientId int32
 	if paramClientId == "" {
@@ -129,6 +140,7 @@ func Verify(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	clientId = int32(tempInt64)
+	authLog.ClientId = clientId
 
 	var nonce string
 	if paramNonce != "" {
@@ -145,7 +157,7 @@ func Verify(ctx *fasthttp.RequestCtx) {
 	}
 	nonce = paramNonce
 
-	client, err := database.GetClientData(clientId)
+	client, err := database.Store.GetClientData(clientId)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			log.Info("Invalid client id: ", clientId)
@@ -160,32 +172,48 @@ func Verify(ctx *fasthttp.RequestCtx) {
 	log.Debug("Client data: ", client)
 
 	/**
-	 * Check client signature
+	 * Check client signature, the previous API key is accepted as well until it expires
+	 * and the response is signed with the API key the request was signed with
 	 */
-	bytes, err := base64.StdEncoding.DecodeString(client.Secret)
-	if err != nil {
-		log.Error("Error decoding client's API Key", err)
-	}
-	apiKey := string(bytes)
+	apiKey := decodeApiKey(client.Secret)
 	if paramSignature != "" {
-		// Create the signature using the API key
 		allParams := getAllHttpVal(ctx)
-		temp := make([]string, 0, len(allParams)-1)
+		params := make([]string, 0, len(allParams)-1)
 		for _, v := range allParams {
 			if !strings.HasPrefix(v, "h=") {
-				temp = append(temp, v)
+				params = append(params, v)
 			}
 		}
 
-		h := utils.Sign(allParams, apiKey)
-		// subtle.ConstantTimeCompare() works like the hash_equals() function in php
-		if subtle.ConstantTimeCompare([]byte(h), []byte(paramSignature)) == 0 {
-			log.Debug("client h=" + paramSignature + ", server h=" + h)
+		if signatureMatches(params, apiKey, paramSignature) {
+			authLog.SignedWith = database.SIGNED_WITH_CURRENT
+		} else if client.PreviousSecret != "" && client.PreviousSecretExpiresAt > int32(time.Now().Unix()) &&
+			signatureMatches(params, decodeApiKey(client.PreviousSecret), paramSignature) {
+			log.Info("Request of client ", clientId, " signed with its previous API key")
+			apiKey = decodeApiKey(client.PreviousSecret)
+			authLog.SignedWith = database.SIGNED_WITH_PREVIOUS
+		} else {
+			log.Debug("client h=" + paramSignature + ", server h=" + utils.Sign(params, apiKey))
 			sendResp(ctx, S_BAD_SIGNATURE, apiKey, nil)
 			return
 		}
 	}
 
+	// YubiKeys of an organization can only be validated by its clients, YubiKeys without one by every client.
+	// This is checked before the OTP is decrypted, so the answer does not tell whether the OTP is genuine.
+	publicId := otp[0 : len(otp)-TOKEN_LEN]
+	keyOrgId, err := yubiKeyOrganization(publicId)
+	if err != nil {
+		log.Error(err)
+		sendResp(ctx, S_BACKEND_ERROR, apiKey, nil)
+		return
+	}
+	if keyOrgId != 0 && keyOrgId != client.OrgId {
+		log.Info("Yubikey ", publicId, " of organization ", keyOrgId, " is not validated for client of organization ", client.OrgId)
+		sendResp(ctx, S_OPERATION_NOT_ALLOWED, apiKey, nil)
+		return
+	}
+
 	otpInfo, err := ksm.DecryptOtp(otp, clientId)
 	if err != nil {
 		/**
@@ -198,9 +226,10 @@ func Verify(ctx *fasthttp.RequestCtx) {
 		return
 	}
 	log.Debug("Decrypted OTP:", otpInfo)
+	authLog.SessionCounter = otpInfo.SessionCounter
+	authLog.UseCounter = otpInfo.UseCounter
 
 	// get YubiKey data from database
-	publicId := otp[0 : len(otp)-TOKEN_LEN]
 	localParams, err := database.GetLocalParams(publicId)
 	if err != nil {
 		log.Info("Invalid Yubikey", publicId)
@@ -245,12 +274,19 @@ func Verify(ctx *fasthttp.RequestCtx) {
 		return
 	}
 
-	/* Valid OTP, update database. */
-	if sync.UpdateDbCounters(otpParams) == false {
+	/* Valid OTP, update database. The update only succeeds if the counters are still higher than the
+	 * stored ones, so only one of several concurrent requests with the same OTP can succeed. */
+	updated, err := sync.UpdateDbCounters(otpParams)
+	if err != nil {
 		log.Error("Failed to update yubikey counters in database")
 		sendResp(ctx, S_BACKEND_ERROR, apiKey, nil)
 		return
 	}
+	if !updated {
+		log.Info("replayed OTP: counters have been updated by a concurrent request")
+		sendResp(ctx, S_REPLAYED_OTP, apiKey, extra)
+		return
+	}
 
 	if otpParams.SessionCounter == localParams.SessionCounter &&
 		otpParams.UseCounter > localParams.UseCounter {
@@ -276,7 +312,7 @@ func Verify(ctx *fasthttp.RequestCtx) {
 			"this":  ts,
 			"delta": tsDiff,
 			"secs":  tsDelta,
-			"accessed": fmt.Sprintf("%s (%s)",
+			"accessed": fmt.Sprintf("%d (%s)",
 				localParams.ModifiedAt,
 				time.Unix(int64(localParams.ModifiedAt), 0).
 					Format("2006-01-02 15:04:05")),
@@ -299,7 +335,9 @@ func Verify(ctx *fasthttp.RequestCtx) {
 	/**
 	 * Fill up with more response parameters
 	 */
-	extra = append(extra, fmt.Sprintf("sl=%v", 0)) // TODO: implement sync
+	var syncLevelAchieved int32 // TODO: implement sync
+	extra = append(extra, fmt.Sprintf("sl=%v", syncLevelAchieved))
+	authLog.SyncLevel = syncLevelAchieved
 
 	if paramTimestamp == "1" {
 		extra = append(extra, fmt.Sprintf("timestamp=%v", (otpParams.TimestampHigh<<16)+otpParams.TimestampLow))
@@ -310,3 +348,12 @@ func Verify(ctx *fasthttp.RequestCtx) {
 	sendResp(ctx, S_OK, apiKey, extra)
 	return
 }
+
+// yubiKeyOrganization gets the organization of a YubiKey, YubiKeys which are not known yet have none.
+func yubiKeyOrganization(publicId string) (int32, error) {
+	yubikey, err := database.Store.GetYubiKey(publicId)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return yubikey.OrgId, err
+}
@@ -0,0 +1,222 @@
+package validation
+
+import (
+	"encoding/hex"
+	"github.com/conformal/yubikey"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/valyala/fasthttp"
+	"go-yubikey-val/internal/config"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/utils"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testPublicName = "cccccccccccb"
+	testSecretKey  = "000102030405060708090a0b0c0d0e0f"
+	testPrivateId  = "0a0b0c0d0e0f"
+)
+
+// setupTestStore creates a SQLite database with a client and a YubiKey known to the built-in KSM.
+func setupTestStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "ykval")
+	require.NoError(t, err)
+	config.DB.MaxOpenConnections = 10
+	store, err := database.Open(database.DRIVER_SQLITE, "file:"+filepath.Join(dir, "ykval.db")+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_txlock=immediate")
+	require.NoError(t, err)
+	database.Store = store
+	config.Ksm.UseBuiltin = true
+
+	require.NoError(t, store.InsertClient(database.Client{Id: 1, Active: true, Secret: "c2VjcmV0"}))
+	require.NoError(t, store.InsertYubiKey(database.YubiKey{
+		Active:         true,
+		PublicName:     testPublicName,
+		ModifiedAt:     -1,
+		SessionCounter: -1,
+		UseCounter:     -1,
+		TimestampLow:   -1,
+		TimestampHigh:  -1,
+		Nonce:          "0000000000000000",
+		SecretKey:      testSecretKey,
+		PrivateId:      testPrivateId,
+	}))
+
+	return func() {
+		config.Ksm.UseBuiltin = false
+		_ = store.Close()
+		_ = os.RemoveAll(dir)
+	}
+}
+
+func generateOtp(counter uint16, use uint8) string {
+	uid, _ := hex.DecodeString(testPrivateId)
+	key, _ := hex.DecodeString(testSecretKey)
+	token := yubikey.NewToken(yubikey.NewUid(uid), counter, 0x1234, 0x56, use, 0x7890)
+	otp := token.Generate(yubikey.NewKey(key))
+	return testPublicName + string(otp[:])
+}
+
+func verify(otp string, nonce string) string {
+	return verifyAs(1, otp, nonce)
+}
+
+func verifyAs(clientId int, otp string, nonce string) string {
+	return verifySigned(clientId, otp, nonce, "")["status"]
+}
+
+// verifySigned sends a validation request signed with the API key unless it is empty, and returns the response fields.
+func verifySigned(clientId int, otp string, nonce string, apiKey string) map[string]string {
+	params := []string{"id=" + strconv.Itoa(clientId), "otp=" + otp, "nonce=" + nonce}
+	query := strings.Join(params, "&")
+	if apiKey != "" {
+		query += "&h=" + url.QueryEscape(utils.Sign(params, apiKey))
+	}
+	var req fasthttp.Request
+	req.SetRequestURI("/wsapi/2.0/verify?" + query)
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, &net.TCPAddr{IP: net.ParseIP("127.0.0.1")}, nil)
+
+	Verify(&ctx)
+	fields := make(map[string]string)
+	for _, line := range strings.Split(string(ctx.Response.Body()), "\r\n") {
+		if i := strings.Index(line, "="); i > 0 {
+			fields[line[:i]] = line[i+1:]
+		}
+	}
+	return fields
+}
+
+// responseSignedWith checks the signature of the response fields.
+func responseSignedWith(fields map[string]string, apiKey string) bool {
+	var params []string
+	for key, value := range fields {
+		if key != "h" {
+			params = append(params, key+"="+value)
+		}
+	}
+	return utils.Sign(params, apiKey) == fields["h"]
+}
+
+func TestVerify(t *testing.T) {
+	defer setupTestStore(t)()
+
+	otp := generateOtp(1, 1)
+	assert.Equal(t, S_OK, verify(otp, "aaaaaaaaaaaaaaaaaaaa"))
+	assert.Equal(t, S_REPLAYED_REQUEST, verify(otp, "aaaaaaaaaaaaaaaaaaaa"))
+	assert.Equal(t, S_REPLAYED_OTP, verify(otp, "bbbbbbbbbbbbbbbbbbbb"))
+	assert.Equal(t, S_OK, verify(generateOtp(1, 2), "cccccccccccccccccccc"))
+	assert.Equal(t, S_REPLAYED_OTP, verify(generateOtp(1, 1), "dddddddddddddddddddd"))
+	assert.Equal(t, S_BAD_OTP, verify(otp[:len(otp)-1]+"c", "eeeeeeeeeeeeeeeeeeee"))
+}
+
+func TestVerifyConcurrentDuplicateOtp(t *testing.T) {
+	defer setupTestStore(t)()
+
+	for use := uint8(1); use <= 10; use++ {
+		otp := generateOtp(1, use)
+		statuses := make(chan string, 20)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(statuses); i++ {
+			wg.Add(1)
+			go func(nonce string) {
+				defer wg.Done()
+				statuses <- verify(otp, nonce)
+			}(strings.Repeat(string(rune('a'+i)), 20))
+		}
+		wg.Wait()
+		close(statuses)
+
+		var ok int
+		for status := range statuses {
+			if status == S_OK {
+				ok++
+			} else {
+				assert.Equal(t, S_REPLAYED_OTP, status)
+			}
+		}
+		assert.Equal(t, 1, ok, "exactly one request with the same OTP succeeds")
+	}
+}
+
+func TestVerifyOrganizations(t *testing.T) {
+	defer setupTestStore(t)()
+	store := database.Store
+
+	for _, name := range []string{"acme", "other"} {
+		require.NoError(t, store.InsertOrganization(database.Organization{Name: name, Active: true}))
+	}
+	acme, err := store.GetOrganization("acme")
+	require.NoError(t, err)
+	other, err := store.GetOrganization("other")
+	require.NoError(t, err)
+	require.NoError(t, store.InsertClient(database.Client{Id: 2, Active: true, Secret: "c2VjcmV0", OrgId: acme.Id}))
+	require.NoError(t, store.InsertClient(database.Client{Id: 3, Active: true, Secret: "c2VjcmV0", OrgId: other.Id}))
+
+	assert.Equal(t, S_OK, verifyAs(3, generateOtp(1, 1), "aaaaaaaaaaaaaaaaaaaa"), "YubiKeys without an organization are shared")
+
+	_, err = store.SetYubiKeyOrganization(testPublicName, acme.Id)
+	require.NoError(t, err)
+	assert.Equal(t, S_OPERATION_NOT_ALLOWED, verifyAs(3, generateOtp(1, 2), "bbbbbbbbbbbbbbbbbbbb"), "cross-tenant validations are refused")
+	assert.Equal(t, S_OPERATION_NOT_ALLOWED, verifyAs(1, generateOtp(1, 2), "cccccccccccccccccccc"), "clients without an organization cannot validate YubiKeys of one")
+	corrupted := []byte(generateOtp(1, 2))
+	corrupted[len(corrupted)-1] = 'c'
+	assert.Equal(t, S_OPERATION_NOT_ALLOWED, verifyAs(3, string(corrupted), "bbbbbbbbbbbbbbbbbbbc"), "invalid OTPs get the same answer")
+	assert.Equal(t, S_BAD_OTP, verifyAs(2, string(corrupted), "bbbbbbbbbbbbbbbbbbbd"))
+	assert.Equal(t, S_OK, verifyAs(2, generateOtp(1, 2), "dddddddddddddddddddd"))
+
+	require.NoError(t, store.ToggleOrganization(acme.Id, false))
+	assert.Equal(t, S_NO_SUCH_CLIENT, verifyAs(2, generateOtp(1, 3), "eeeeeeeeeeeeeeeeeeee"))
+	require.NoError(t, store.ToggleOrganization(acme.Id, true))
+	assert.Equal(t, S_OK, verifyAs(2, generateOtp(1, 3), "ffffffffffffffffffff"))
+}
+
+func TestVerifySignature(t *testing.T) {
+	defer setupTestStore(t)()
+
+	// "secret" is the API key of client 1, requests are signed without their h parameter
+	resp := verifySigned(1, generateOtp(1, 1), "aaaaaaaaaaaaaaaaaaaa", "secret")
+	assert.Equal(t, S_OK, resp["status"])
+	assert.True(t, responseSignedWith(resp, "secret"))
+
+	resp = verifySigned(1, generateOtp(1, 2), "bbbbbbbbbbbbbbbbbbbb", "other")
+	assert.Equal(t, S_BAD_SIGNATURE, resp["status"])
+	assert.True(t, responseSignedWith(resp, "secret"))
+}
+
+func TestVerifySecretRotation(t *testing.T) {
+	defer setupTestStore(t)()
+	store := database.Store
+
+	// "secret" is the API key of client 1, "rotated" the new one
+	expiresAt := int32(time.Now().Add(time.Hour).Unix())
+	_, err := store.RotateClientSecret(1, "cm90YXRlZA==", expiresAt, nil)
+	require.NoError(t, err)
+
+	resp := verifySigned(1, generateOtp(1, 1), "aaaaaaaaaaaaaaaaaaaa", "rotated")
+	assert.Equal(t, S_OK, resp["status"])
+	assert.True(t, responseSignedWith(resp, "rotated"))
+
+	resp = verifySigned(1, generateOtp(1, 2), "bbbbbbbbbbbbbbbbbbbb", "secret")
+	assert.Equal(t, S_OK, resp["status"], "the previous API key is accepted during the grace period")
+	assert.True(t, responseSignedWith(resp, "secret"), "the response is signed with the API key of the request")
+
+	resp = verifySigned(1, generateOtp(1, 3), "cccccccccccccccccccc", "other")
+	assert.Equal(t, S_BAD_SIGNATURE, resp["status"])
+	assert.True(t, responseSignedWith(resp, "rotated"))
+
+	_, err = store.RotateClientSecret(1, "bmV3", int32(time.Now().Add(-time.Second).Unix()), nil)
+	require.NoError(t, err)
+	resp = verifySigned(1, generateOtp(1, 3), "dddddddddddddddddddd", "rotated")
+	assert.Equal(t, S_BAD_SIGNATURE, resp["status"], "the previous API key has expired")
+	assert.Equal(t, S_OK, verifySigned(1, generateOtp(1, 3), "eeeeeeeeeeeeeeeeeeee", "new")["status"])
+}
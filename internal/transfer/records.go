@@ -0,0 +1,299 @@
+package transfer
+
+import (
+	"encoding/base64"
+	"fmt"
+	"go-yubikey-val/internal/database"
+	"go-yubikey-val/internal/hsm"
+	"go-yubikey-val/internal/keyfile"
+	"go-yubikey-val/internal/secrets"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+var (
+	publicNamePattern = regexp.MustCompile(fmt.Sprintf(`^[cbdefghijklnrtuv]{1,%d}$`, keyfile.MAX_PUBLIC_ID_LENGTH))
+	privateIdPattern  = regexp.MustCompile(`^[0-9a-f]{12}$`)
+)
+
+// KeyRecord is an exported YubiKey, its secret and private id are only exported on request.
+type KeyRecord struct {
+	Active         bool   `json:"active"`
+	CreatedAt      int32  `json:"created_at"`
+	ModifiedAt     int32  `json:"modified_at"`
+	PublicName     string `json:"public_name"`
+	SessionCounter int32  `json:"session_counter"`
+	UseCounter     int32  `json:"use_counter"`
+	TimestampLow   int32  `json:"timestamp_low"`
+	TimestampHigh  int32  `json:"timestamp_high"`
+	Nonce          string `json:"nonce"`
+	Notes          string `json:"notes"`
+	SecretKey      string `json:"secret_key,omitempty"`
+	PrivateId      string `json:"private_id,omitempty"`
+}
+
+// ClientRecord is an exported client.
+type ClientRecord struct {
+	Id        int32  `json:"id"`
+	Active    bool   `json:"active"`
+	CreatedAt int32  `json:"created_at"`
+	Secret    string `json:"secret"`
+	Email     string `json:"email"`
+	Notes     string `json:"notes"`
+	Otp       string `json:"otp"`
+}
+
+// NewKeyRecord converts a stored YubiKey to a record without its secrets.
+func NewKeyRecord(key database.YubiKey) KeyRecord {
+	return KeyRecord{
+		Active:         key.Active,
+		CreatedAt:      key.CreatedAt,
+		ModifiedAt:     key.ModifiedAt,
+		PublicName:     key.PublicName,
+		SessionCounter: key.SessionCounter,
+		UseCounter:     key.UseCounter,
+		TimestampLow:   key.TimestampLow,
+		TimestampHigh:  key.TimestampHigh,
+		Nonce:          key.Nonce,
+		Notes:          key.Notes,
+	}
+}
+
+// EncryptedSecretKey returns the secret key of a stored YubiKey for an encrypted export,
+// secret keys still stored in plaintext are sealed under the master key first.
+func EncryptedSecretKey(masterKey []byte, key database.YubiKey) (string, error) {
+	if key.SecretKey == "" || secrets.IsSealed(key.SecretKey) || hsm.IsWrapped(key.SecretKey) {
+		return key.SecretKey, nil
+	}
+	sealed, err := secrets.Seal(masterKey, key.PublicName, key.SecretKey)
+	if err != nil {
+		return "", fmt.Errorf("error encrypting the plaintext secret key of %s: %v", key.PublicName, err)
+	}
+	return sealed, nil
+}
+
+// YubiKey converts the record to a YubiKey to be stored, a plaintext secret key has to be protected first.
+func (k KeyRecord) YubiKey() database.YubiKey {
+	return database.YubiKey{
+		Active:         k.Active,
+		CreatedAt:      k.CreatedAt,
+		ModifiedAt:     k.ModifiedAt,
+		PublicName:     k.PublicName,
+		SessionCounter: k.SessionCounter,
+		UseCounter:     k.UseCounter,
+		TimestampLow:   k.TimestampLow,
+		TimestampHigh:  k.TimestampHigh,
+		Nonce:          k.Nonce,
+		Notes:          k.Notes,
+		SecretKey:      k.SecretKey,
+		PrivateId:      k.PrivateId,
+	}
+}
+
+// NewClientRecord converts a stored client to a record.
+func NewClientRecord(client database.Client) ClientRecord {
+	return ClientRecord{
+		Id:        client.Id,
+		Active:    client.Active,
+		CreatedAt: client.CreatedAt,
+		Secret:    client.Secret,
+		Email:     client.Email,
+		Notes:     client.Notes,
+		Otp:       client.Otp,
+	}
+}
+
+// Client converts the record to a client to be stored.
+func (c ClientRecord) Client() database.Client {
+	return database.Client{
+		Id:        c.Id,
+		Active:    c.Active,
+		CreatedAt: c.CreatedAt,
+		Secret:    c.Secret,
+		Email:     c.Email,
+		Notes:     c.Notes,
+		Otp:       c.Otp,
+	}
+}
+
+// WriteKeys writes the YubiKeys in the format with the schema header.
+func WriteKeys(w io.Writer, format string, keys []KeyRecord) error {
+	records := make([]record, 0, len(keys))
+	for i := range keys {
+		records = append(records, &keys[i])
+	}
+	return write(w, format, SCHEMA_KEYS, records)
+}
+
+// ReadKeys reads and validates all YubiKeys, it returns all invalid records as errors with their line numbers.
+func ReadKeys(r io.Reader, format string) ([]KeyRecord, []error) {
+	records, errs := read(r, format, SCHEMA_KEYS, func() record { return &KeyRecord{} })
+	keys := make([]KeyRecord, 0, len(records))
+	seen := make(map[string]int)
+	for _, r := range records {
+		key := *r.record.(*KeyRecord)
+		if first, ok := seen[key.PublicName]; ok {
+			errs = append(errs, fmt.Errorf("line %d: duplicate YubiKey %s, first on line %d", r.line, key.PublicName, first))
+			continue
+		}
+		seen[key.PublicName] = r.line
+		keys = append(keys, key)
+	}
+	return keys, errs
+}
+
+// WriteClients writes the clients in the format with the schema header.
+func WriteClients(w io.Writer, format string, clients []ClientRecord) error {
+	records := make([]record, 0, len(clients))
+	for i := range clients {
+		records = append(records, &clients[i])
+	}
+	return write(w, format, SCHEMA_CLIENTS, records)
+}
+
+// ReadClients reads and validates all clients, it returns all invalid records as errors with their line numbers.
+func ReadClients(r io.Reader, format string) ([]ClientRecord, []error) {
+	records, errs := read(r, format, SCHEMA_CLIENTS, func() record { return &ClientRecord{} })
+	clients := make([]ClientRecord, 0, len(records))
+	seen := make(map[int32]int)
+	for _, r := range records {
+		client := *r.record.(*ClientRecord)
+		if first, ok := seen[client.Id]; ok {
+			errs = append(errs, fmt.Errorf("line %d: duplicate client %d, first on line %d", r.line, client.Id, first))
+			continue
+		}
+		seen[client.Id] = r.line
+		clients = append(clients, client)
+	}
+	return clients, errs
+}
+
+// active, created_at, modified_at, public_name, session_counter, use_counter, timestamp_low,
+// timestamp_high, nonce, notes and optionally secret_key and private_id
+func (k *KeyRecord) toRow() []string {
+	row := []string{formatBool(k.Active), itoa(k.CreatedAt), itoa(k.ModifiedAt), k.PublicName,
+		itoa(k.SessionCounter), itoa(k.UseCounter), itoa(k.TimestampLow), itoa(k.TimestampHigh), k.Nonce, k.Notes}
+	if k.SecretKey != "" || k.PrivateId != "" {
+		row = append(row, k.SecretKey, k.PrivateId)
+	}
+	return row
+}
+
+func (k *KeyRecord) fromRow(fields []string) error {
+	if len(fields) < 10 || len(fields) > 12 {
+		return fmt.Errorf("expected 10 to 12 fields, got %d", len(fields))
+	}
+	var err error
+	if k.Active, err = parseBool("active", fields[0]); err != nil {
+		return err
+	}
+	ints := []*int32{&k.CreatedAt, &k.ModifiedAt, nil, &k.SessionCounter, &k.UseCounter, &k.TimestampLow, &k.TimestampHigh}
+	names := []string{"created_at", "modified_at", "", "session_counter", "use_counter", "timestamp_low", "timestamp_high"}
+	for i, p := range ints {
+		if p == nil {
+			continue
+		}
+		if *p, err = parseInt(names[i], fields[i+1]); err != nil {
+			return err
+		}
+	}
+	k.PublicName, k.Nonce, k.Notes = fields[3], fields[8], fields[9]
+	if len(fields) > 10 {
+		k.SecretKey = fields[10]
+	}
+	if len(fields) > 11 {
+		k.PrivateId = fields[11]
+	}
+	return nil
+}
+
+func (k *KeyRecord) validate() error {
+	if !publicNamePattern.MatchString(k.PublicName) {
+		return fmt.Errorf("invalid public_name %q: must be 1 to 16 modhex characters", k.PublicName)
+	}
+	if k.SessionCounter < -1 || k.UseCounter < -1 {
+		return fmt.Errorf("invalid counters of %s: must be at least -1", k.PublicName)
+	}
+	if len(k.Nonce) > 40 {
+		return fmt.Errorf("invalid nonce of %s: must be at most 40 characters", k.PublicName)
+	}
+	if len(k.Notes) > 100 {
+		return fmt.Errorf("invalid notes of %s: must be at most 100 characters", k.PublicName)
+	}
+	if k.SecretKey != "" && !secrets.IsSealed(k.SecretKey) && !hsm.IsWrapped(k.SecretKey) && !secrets.ValidSecretKey(k.SecretKey) {
+		return fmt.Errorf("invalid secret_key of %s: must be 32 hex characters, encrypted or wrapped", k.PublicName)
+	}
+	if k.PrivateId != "" && !privateIdPattern.MatchString(k.PrivateId) {
+		return fmt.Errorf("invalid private_id of %s: must be 12 hex characters", k.PublicName)
+	}
+	return nil
+}
+
+// id, active, created_at, secret, email, notes, otp
+func (c *ClientRecord) toRow() []string {
+	return []string{itoa(c.Id), formatBool(c.Active), itoa(c.CreatedAt), c.Secret, c.Email, c.Notes, c.Otp}
+}
+
+func (c *ClientRecord) fromRow(fields []string) error {
+	if len(fields) != 7 {
+		return fmt.Errorf("expected 7 fields, got %d", len(fields))
+	}
+	var err error
+	if c.Id, err = parseInt("id", fields[0]); err != nil {
+		return err
+	}
+	if c.Active, err = parseBool("active", fields[1]); err != nil {
+		return err
+	}
+	if c.CreatedAt, err = parseInt("created_at", fields[2]); err != nil {
+		return err
+	}
+	c.Secret, c.Email, c.Notes, c.Otp = fields[3], fields[4], fields[5], fields[6]
+	return nil
+}
+
+func (c *ClientRecord) validate() error {
+	if c.Id <= 0 {
+		return fmt.Errorf("invalid id %d: must be positive", c.Id)
+	}
+	if secret, err := base64.StdEncoding.DecodeString(c.Secret); err != nil || len(secret) == 0 || len(c.Secret) > 60 {
+		return fmt.Errorf("invalid secret of client %d: must be base64 encoded, at most 60 characters", c.Id)
+	}
+	if len(c.Email) > 255 {
+		return fmt.Errorf("invalid email of client %d: must be at most 255 characters", c.Id)
+	}
+	if len(c.Notes) > 100 || len(c.Otp) > 100 {
+		return fmt.Errorf("invalid notes or otp of client %d: must be at most 100 characters", c.Id)
+	}
+	return nil
+}
+
+func itoa(i int32) string {
+	return strconv.Itoa(int(i))
+}
+
+func formatBool(b bool) string {
+	if b {
+		return "1"
+	}
+	return "0"
+}
+
+func parseInt(name string, value string) (int32, error) {
+	i, err := strconv.ParseInt(value, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: must be an integer", name, value)
+	}
+	return int32(i), nil
+}
+
+func parseBool(name string, value string) (bool, error) {
+	switch value {
+	case "1":
+		return true, nil
+	case "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid %s %q: must be 0 or 1", name, value)
+}
@@ -0,0 +1,363 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+const (
+	FORMAT_CSV   = "csv"
+	FORMAT_JSON  = "json"
+	FORMAT_JSONL = "jsonl"
+
+	// SCHEMA_VERSION is the version of the exported records, files without a version are version 1.
+	SCHEMA_VERSION = 1
+
+	SCHEMA_KEYS    = "ykval-keys"
+	SCHEMA_CLIENTS = "ykval-clients"
+)
+
+// Header identifies the records of an exported file.
+type Header struct {
+	Schema  string `json:"schema"`
+	Version int    `json:"version"`
+}
+
+// record is a YubiKey or client as exported, it is stored in a CSV row by position.
+type record interface {
+	toRow() []string
+	fromRow(fields []string) error
+	validate() error
+}
+
+// ValidFormat checks whether the format is one of csv, json or jsonl.
+func ValidFormat(format string) bool {
+	return format == FORMAT_CSV || format == FORMAT_JSON || format == FORMAT_JSONL
+}
+
+func write(w io.Writer, format string, schema string, records []record) error {
+	header := Header{Schema: schema, Version: SCHEMA_VERSION}
+	switch format {
+	case FORMAT_CSV:
+		if _, err := fmt.Fprintf(w, "# schema=%s version=%d\n", header.Schema, header.Version); err != nil {
+			return err
+		}
+		writer := csv.NewWriter(w)
+		for _, r := range records {
+			if err := writer.Write(r.toRow()); err != nil {
+				return err
+			}
+		}
+		writer.Flush()
+		return writer.Error()
+	case FORMAT_JSONL:
+		encoder := json.NewEncoder(w)
+		if err := encoder.Encode(header); err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err := encoder.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	case FORMAT_JSON:
+		if records == nil {
+			records = []record{}
+		}
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(struct {
+			Header
+			Records []record `json:"records"`
+		}{header, records})
+	default:
+		return fmt.Errorf("unknown format %s", format)
+	}
+}
+
+// numbered is a record with the line it starts on.
+type numbered struct {
+	record
+	line int
+}
+
+// read parses and validates all records, it returns all invalid records as errors with their line numbers.
+func read(r io.Reader, format string, schema string, newRecord func() record) ([]numbered, []error) {
+	switch format {
+	case FORMAT_CSV:
+		return readCsv(r, schema, newRecord)
+	case FORMAT_JSONL:
+		return readJsonl(r, schema, newRecord)
+	case FORMAT_JSON:
+		return readJson(r, schema, newRecord)
+	default:
+		return nil, []error{fmt.Errorf("unknown format %s", format)}
+	}
+}
+
+func checkHeader(header Header, schema string) error {
+	if header.Schema != schema {
+		return fmt.Errorf("expected schema %s, got %q", schema, header.Schema)
+	}
+	if header.Version < 1 || header.Version > SCHEMA_VERSION {
+		return fmt.Errorf("unsupported schema version %d, expected at most %d", header.Version, SCHEMA_VERSION)
+	}
+	return nil
+}
+
+// readCsv reads CSV rows, which span multiple lines if a quoted field contains a line break. Quotes
+// inside unquoted fields are kept, files exported by the PHP version do not escape them in notes.
+// Files exported before the header existed have no header, their rows are version 1.
+func readCsv(r io.Reader, schema string, newRecord func() record) ([]numbered, []error) {
+	var records []numbered
+	var errs []error
+
+	lines := &lineReader{reader: bufio.NewReader(r)}
+	for {
+		text, err := lines.reader.ReadString('\n')
+		if text == "" && err != nil {
+			if err != io.EOF {
+				errs = append(errs, err)
+			}
+			return nil, errs
+		}
+		lines.lines++
+		if strings.HasPrefix(text, "#") {
+			if strings.Contains(text, "schema=") {
+				var header Header
+				_, err := fmt.Sscanf(strings.TrimSpace(text), "# schema=%s version=%d", &header.Schema, &header.Version)
+				if err == nil {
+					err = checkHeader(header, schema)
+				}
+				if err != nil {
+					return nil, []error{fmt.Errorf("line %d: %v", lines.lines, err)}
+				}
+			}
+			continue
+		}
+		if strings.TrimSpace(text) != "" {
+			// the first row is handed to the CSV reader as if it was read by it
+			lines.pending = []byte(text)
+			lines.read = []string{text}
+			break
+		}
+	}
+
+	csvReader := csv.NewReader(lines)
+	csvReader.FieldsPerRecord = -1
+	csvReader.LazyQuotes = true
+	csvReader.Comment = '#'
+	for {
+		fields, err := csvReader.Read()
+		start := lines.rowStart()
+		if err == io.EOF {
+			break
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			errs = append(errs, fmt.Errorf("line %d: %v", start, parseErr.Err))
+			continue
+		}
+		if err != nil {
+			errs = append(errs, err)
+			break
+		}
+		if len(fields) == 1 && strings.TrimSpace(fields[0]) == "" {
+			continue
+		}
+		rec := newRecord()
+		if err := rec.fromRow(fields); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", start, err))
+			continue
+		}
+		if err := rec.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", start, err))
+			continue
+		}
+		records = append(records, numbered{rec, start})
+	}
+
+	return records, errs
+}
+
+// lineReader hands out one line per read, so the lines read by a CSV reader are those of the row
+// it returned last.
+type lineReader struct {
+	reader  *bufio.Reader
+	pending []byte
+	lines   int
+	read    []string
+}
+
+func (l *lineReader) Read(p []byte) (int, error) {
+	if len(l.pending) == 0 {
+		line, err := l.reader.ReadString('\n')
+		if line == "" {
+			return 0, err
+		}
+		l.pending = []byte(line)
+		l.lines++
+		l.read = append(l.read, line)
+	}
+	n := copy(p, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
+
+// rowStart returns the line the last row starts on, after the empty and comment lines skipped
+// by the CSV reader, and starts collecting the lines of the next row.
+func (l *lineReader) rowStart() int {
+	start := l.lines - len(l.read) + 1
+	for _, line := range l.read {
+		if strings.TrimRight(line, "\r\n") != "" && !strings.HasPrefix(line, "#") {
+			break
+		}
+		start++
+	}
+	l.read = nil
+	return start
+}
+
+func readJsonl(r io.Reader, schema string, newRecord func() record) ([]numbered, []error) {
+	var records []numbered
+	var errs []error
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	line := 0
+	header := false
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if !header {
+			var h Header
+			err := json.Unmarshal([]byte(text), &h)
+			if err == nil {
+				err = checkHeader(h, schema)
+			}
+			if err != nil {
+				return nil, []error{fmt.Errorf("line %d: invalid header: %v", line, err)}
+			}
+			header = true
+			continue
+		}
+
+		rec := newRecord()
+		if err := strictUnmarshal([]byte(text), rec); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		if err := rec.validate(); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+			continue
+		}
+		records = append(records, numbered{rec, line})
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+	if !header && len(errs) == 0 {
+		errs = append(errs, fmt.Errorf("missing header"))
+	}
+
+	return records, errs
+}
+
+// readJson reads a JSON document with the header fields and the records, the records are decoded
+// one by one to know their line numbers.
+func readJson(r io.Reader, schema string, newRecord func() record) ([]numbered, []error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, []error{err}
+	}
+	lineAt := func(offset int64) int {
+		return bytes.Count(data[:offset], []byte("\n")) + 1
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	syntaxError := func(err error) []error {
+		return []error{fmt.Errorf("line %d: %v", lineAt(decoder.InputOffset()), err)}
+	}
+
+	if t, err := decoder.Token(); err != nil || t != json.Delim('{') {
+		if err == nil {
+			err = fmt.Errorf("expected an object")
+		}
+		return nil, syntaxError(err)
+	}
+
+	var records []numbered
+	var errs []error
+	var header Header
+	hasRecords := false
+	for decoder.More() {
+		t, err := decoder.Token()
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+		switch t {
+		case "schema":
+			err = decoder.Decode(&header.Schema)
+		case "version":
+			err = decoder.Decode(&header.Version)
+		case "records":
+			hasRecords = true
+			if err := checkHeader(header, schema); err != nil {
+				return nil, syntaxError(err)
+			}
+			if t, err := decoder.Token(); err != nil || t != json.Delim('[') {
+				if err == nil {
+					err = fmt.Errorf("expected an array of records")
+				}
+				return nil, syntaxError(err)
+			}
+			for decoder.More() {
+				var raw json.RawMessage
+				if err := decoder.Decode(&raw); err != nil {
+					return nil, syntaxError(err)
+				}
+				// the raw record ends at the offset, leading white space is not part of it
+				line := lineAt(decoder.InputOffset() - int64(len(raw)))
+				rec := newRecord()
+				if err := strictUnmarshal(raw, rec); err != nil {
+					errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+					continue
+				}
+				if err := rec.validate(); err != nil {
+					errs = append(errs, fmt.Errorf("line %d: %v", line, err))
+					continue
+				}
+				records = append(records, numbered{rec, line})
+			}
+			_, err = decoder.Token()
+		default:
+			var ignored json.RawMessage
+			err = decoder.Decode(&ignored)
+		}
+		if err != nil {
+			return nil, syntaxError(err)
+		}
+	}
+	if !hasRecords {
+		if err := checkHeader(header, schema); err != nil {
+			return nil, []error{err}
+		}
+	}
+
+	return records, errs
+}
+
+// strictUnmarshal decodes a record, unknown fields are an error.
+func strictUnmarshal(data []byte, rec record) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(rec)
+}
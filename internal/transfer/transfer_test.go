@@ -0,0 +1,189 @@
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"go-yubikey-val/internal/secrets"
+	"strings"
+	"testing"
+)
+
+var testKeys = []KeyRecord{
+	{Active: true, CreatedAt: 1584699825, ModifiedAt: -1, PublicName: "vvcccccccccb", SessionCounter: -1, UseCounter: -1,
+		TimestampLow: -1, TimestampHigh: -1, Nonce: "0000000000000000", Notes: "plain"},
+	{Active: false, CreatedAt: 1584699825, ModifiedAt: 1584700000, PublicName: "vvcccccccccd", SessionCounter: 3, UseCounter: 7,
+		TimestampLow: 100, TimestampHigh: 2, Nonce: "abcdef", Notes: "lost, then \"found\"\nagain",
+		SecretKey: "ecde18dbe76fbd0c33330f1c354871db", PrivateId: "a1b2c3d4e5f6"},
+}
+
+var testClients = []ClientRecord{
+	{Id: 1, Active: true, CreatedAt: 1584699825, Secret: "c2VjcmV0", Email: "a@example.com", Notes: "web, vpn", Otp: ""},
+	{Id: 2, Active: false, CreatedAt: 1584699825, Secret: "b3RoZXI=", Email: "", Notes: "", Otp: ""},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, format := range []string{FORMAT_CSV, FORMAT_JSON, FORMAT_JSONL} {
+		var keys bytes.Buffer
+		assert.NoError(t, WriteKeys(&keys, format, testKeys), format)
+		readKeys, errs := ReadKeys(&keys, format)
+		assert.Empty(t, errs, format)
+		assert.Equal(t, testKeys, readKeys, format)
+
+		var clients bytes.Buffer
+		assert.NoError(t, WriteClients(&clients, format, testClients), format)
+		readClients, errs := ReadClients(&clients, format)
+		assert.Empty(t, errs, format)
+		assert.Equal(t, testClients, readClients, format)
+
+		var empty bytes.Buffer
+		assert.NoError(t, WriteClients(&empty, format, nil), format)
+		readClients, errs = ReadClients(&empty, format)
+		assert.Empty(t, errs, format)
+		assert.Empty(t, readClients, format)
+	}
+}
+
+func TestWriteCsv(t *testing.T) {
+	var out bytes.Buffer
+	assert.NoError(t, WriteClients(&out, FORMAT_CSV, testClients[:1]))
+	assert.Equal(t, "# schema=ykval-clients version=1\n1,1,1584699825,c2VjcmV0,a@example.com,\"web, vpn\",\n", out.String())
+}
+
+func TestReadLegacyCsv(t *testing.T) {
+	keys, errs := ReadKeys(strings.NewReader(
+		"1,1584699825,-1,vvcccccccccb,-1,-1,-1,-1,0000000000000000,plain\n"+
+			"\n"+
+			"0,1584699825,1584700000,vvcccccccccd,3,7,100,2,abcdef,notes,ecde18dbe76fbd0c33330f1c354871db\n"+
+			"1,1584699825,-1,vvcccccccccf,-1,-1,-1,-1,,the \"spare\" key\n"+
+			"1,1584699825,-1,vvcccccccccg,-1,-1,-1,-1,,\"quoted\nnotes\"\n"+
+			"1,1584699825,-1,vvcccccccccf,-1,-1,-1,-1,,again\n"),
+		FORMAT_CSV)
+	assert.Equal(t, []error{fmt.Errorf("line 7: duplicate YubiKey vvcccccccccf, first on line 4")}, errs)
+	if assert.Len(t, keys, 4) {
+		assert.Equal(t, testKeys[0], keys[0])
+		assert.Equal(t, "ecde18dbe76fbd0c33330f1c354871db", keys[1].SecretKey)
+		assert.Equal(t, "", keys[1].PrivateId)
+		assert.Equal(t, `the "spare" key`, keys[2].Notes)
+		assert.Equal(t, "quoted\nnotes", keys[3].Notes)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	var tests = []struct {
+		format   string
+		input    string
+		expected []string
+	}{
+		{FORMAT_CSV,
+			"# schema=ykval-clients version=1\n" +
+				"1,1,1584699825,c2VjcmV0,,,\n" +
+				"x,1,1584699825,c2VjcmV0,,,\n" +
+				"3,1,1584699825,\"multi\nline\",,,\n" +
+				"4,2,1584699825,c2VjcmV0,,,\n" +
+				"5,1,1584699825,c2VjcmV0,,\n" +
+				"1,1,1584699825,c2VjcmV0,,,\n",
+			[]string{
+				`line 3: invalid id "x": must be an integer`,
+				"line 4: invalid secret of client 3: must be base64 encoded, at most 60 characters",
+				`line 6: invalid active "2": must be 0 or 1`,
+				"line 7: expected 7 fields, got 6",
+				"line 8: duplicate client 1, first on line 2",
+			}},
+		{FORMAT_CSV,
+			"# schema=ykval-clients version=1\n1,1,1584699825,\"open,,,\n",
+			[]string{"line 2: expected 7 fields, got 4"}},
+		{FORMAT_CSV,
+			"# schema=ykval-keys version=1\n",
+			[]string{"line 1: expected schema ykval-clients, got \"ykval-keys\""}},
+		{FORMAT_JSONL,
+			"{\"schema\":\"ykval-clients\",\"version\":2}\n",
+			[]string{"line 1: invalid header: unsupported schema version 2, expected at most 1"}},
+		{FORMAT_JSONL,
+			"{\"id\":1,\"secret\":\"c2VjcmV0\"}\n",
+			[]string{"line 1: invalid header: expected schema ykval-clients, got \"\""}},
+		{FORMAT_JSONL,
+			"{\"schema\":\"ykval-clients\",\"version\":1}\n" +
+				"{\"id\":1,\"secret\":\"c2VjcmV0\"}\n" +
+				"{\"id\":2,\"secret\":\"c2VjcmV0\",\"extra\":true}\n" +
+				"{\"id\":-3,\"secret\":\"c2VjcmV0\"}\n" +
+				"{\"id\":1,\"secret\":\"c2VjcmV0\"}\n" +
+				"{\"id\":4,\n",
+			[]string{
+				`line 3: json: unknown field "extra"`,
+				"line 4: invalid id -3: must be positive",
+				"line 6: unexpected EOF",
+				"line 5: duplicate client 1, first on line 2",
+			}},
+		{FORMAT_JSON,
+			"{\n  \"schema\": \"ykval-clients\",\n  \"version\": 1,\n  \"records\": [\n" +
+				"    {\"id\": 1, \"secret\": \"c2VjcmV0\"},\n" +
+				"    {\n      \"id\": 0,\n      \"secret\": \"c2VjcmV0\"\n    },\n" +
+				"    {\"id\": 3, \"secret\": \"c2VjcmV0\", \"email\": 5}\n" +
+				"  ]\n}\n",
+			[]string{
+				"line 6: invalid id 0: must be positive",
+				"line 10: json: cannot unmarshal number into Go struct field ClientRecord.email of type string",
+			}},
+		{FORMAT_JSON,
+			"{\"schema\": \"ykval-clients\", \"version\": 1, \"records\": [\n{\"id\": 1,,}\n]}",
+			[]string{"line 2: invalid character ',' looking for beginning of object key string"}},
+	}
+
+	for _, test := range tests {
+		_, errs := ReadClients(strings.NewReader(test.input), test.format)
+		var actual []string
+		for _, err := range errs {
+			actual = append(actual, err.Error())
+		}
+		assert.Equal(t, test.expected, actual, test.input)
+	}
+}
+
+func TestValidateKey(t *testing.T) {
+	var tests = []struct {
+		modify func(k *KeyRecord)
+		valid  bool
+	}{
+		{func(k *KeyRecord) {}, true},
+		{func(k *KeyRecord) { k.PublicName = "" }, false},
+		{func(k *KeyRecord) { k.PublicName = "vvcccccccccz" }, false},
+		{func(k *KeyRecord) { k.PublicName = "vvcccccccccccccccc" }, false},
+		{func(k *KeyRecord) { k.Notes = strings.Repeat("n", 101) }, false},
+		{func(k *KeyRecord) { k.SecretKey = "not a secret" }, false},
+		{func(k *KeyRecord) { k.PrivateId = "a1b2c3" }, false},
+		{func(k *KeyRecord) { k.UseCounter = -2 }, false},
+	}
+
+	for i, test := range tests {
+		key := testKeys[1]
+		test.modify(&key)
+		assert.Equal(t, test.valid, key.validate() == nil, i)
+	}
+}
+
+func TestEncryptedSecretKey(t *testing.T) {
+	masterKey := bytes.Repeat([]byte{1}, 32)
+	key := testKeys[1].YubiKey()
+
+	sealed, err := EncryptedSecretKey(masterKey, key)
+	assert.NoError(t, err)
+	assert.True(t, secrets.IsSealed(sealed), "plaintext secrets are sealed")
+	opened, err := secrets.Open(masterKey, key.PublicName, sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, key.SecretKey, opened)
+
+	key.SecretKey = sealed
+	stored, err := EncryptedSecretKey(masterKey, key)
+	assert.NoError(t, err)
+	assert.Equal(t, sealed, stored, "sealed secrets are exported as stored")
+
+	key.SecretKey = "p11:d3JhcHBlZA=="
+	stored, err = EncryptedSecretKey(nil, key)
+	assert.NoError(t, err)
+	assert.Equal(t, key.SecretKey, stored, "wrapped secrets are exported as stored")
+
+	key.SecretKey = testKeys[1].SecretKey
+	_, err = EncryptedSecretKey(nil, key)
+	assert.EqualError(t, err, "error encrypting the plaintext secret key of vvcccccccccd: no master key configured")
+}